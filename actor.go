@@ -0,0 +1,326 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// ActorType - the type of an actor: a task with a mailbox
+var ActorType Value = Intern("<actor>")
+
+var ExitKey = Intern("exit:")
+var NormalKey = Intern("normal:")
+var TimeoutKey = Intern("timeout:")
+
+const mailboxSize = 1000
+
+// Actor - a task that receives messages in its mailbox. When it exits, the actors linked to it are sent an
+// exit message if it failed, and the actors monitoring it are sent one in any case.
+type Actor struct {
+	task     *Task
+	mailbox  *Channel
+	saved    []Value // messages passed over by selective receive. Only accessed by the actor itself
+	mutex    sync.Mutex
+	links    []*Actor
+	monitors []*Actor
+	overflow []Value // exit messages that arrived while the mailbox was full
+	reason   Value   // non-nil once the actor has exited
+}
+
+func (a *Actor) Type() Value {
+	return ActorType
+}
+
+func (a *Actor) String() string {
+	return fmt.Sprintf("#[actor %d %s]", a.task.id, a.task.Status().String())
+}
+
+func (a1 *Actor) Equals(another Value) bool {
+	if a2, ok := another.(*Actor); ok {
+		return a1 == a2
+	}
+	return false
+}
+
+// Tell - put the message in the actor's mailbox. Returns false if the actor has exited.
+func (a *Actor) Tell(msg Value) bool {
+	return SendChannel(a.mailbox, msg, -1)
+}
+
+// tellExit - put the exit message in the actor's mailbox without waiting, so that a watcher that is slow to receive
+// cannot hold up the actor that exited. If the mailbox is full, the message is kept until it has room.
+func (a *Actor) tellExit(msg Value) {
+	if SendChannel(a.mailbox, msg, 0) {
+		return
+	}
+	a.mutex.Lock()
+	if a.reason == nil {
+		a.overflow = append(a.overflow, msg)
+	}
+	a.mutex.Unlock()
+}
+
+// nextOverflow - the first exit message kept while the mailbox was full, if any
+func (a *Actor) nextOverflow() (Value, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.overflow) == 0 {
+		return nil, false
+	}
+	msg := a.overflow[0]
+	a.overflow = a.overflow[1:]
+	return msg, true
+}
+
+func exitMessage(a *Actor, reason Value) Value {
+	return NewList(ExitKey, a, reason)
+}
+
+func (a *Actor) exited(err error) {
+	var reason Value = NormalKey
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			reason = e
+		} else {
+			reason = MakeError(ErrorKey, NewString(err.Error()))
+		}
+	}
+	a.mutex.Lock()
+	a.reason = reason
+	links := a.links
+	monitors := a.monitors
+	a.links = nil
+	a.monitors = nil
+	a.mutex.Unlock()
+	CloseChannel(a.mailbox)
+	msg := exitMessage(a, reason)
+	if err != nil {
+		for _, other := range links {
+			other.tellExit(msg)
+		}
+	}
+	for _, other := range monitors {
+		other.tellExit(msg)
+	}
+}
+
+// watch - arrange for the watcher to be told when the actor exits. If it already has, the watcher is told now.
+func (a *Actor) watch(watcher *Actor, link bool) {
+	a.mutex.Lock()
+	reason := a.reason
+	if reason == nil {
+		if link {
+			a.links = append(a.links, watcher)
+		} else {
+			a.monitors = append(a.monitors, watcher)
+		}
+	}
+	a.mutex.Unlock()
+	if reason != nil && (!link || reason != NormalKey) {
+		watcher.tellExit(exitMessage(a, reason))
+	}
+}
+
+// receive - return the first message for which the predicate is true (any message, if the predicate is null),
+// waiting up to timeout seconds for one. Messages that don't match are kept for later receives, in order.
+// Returns timeout: if the timeout expires first.
+func (a *Actor) receive(vm *vm, pred Value, timeout float64) (Value, error) {
+	matches := func(msg Value) (bool, error) {
+		if pred == Null {
+			return true, nil
+		}
+		result, err := vm.call(pred, []Value{msg})
+		if err != nil {
+			return false, err
+		}
+		return result != False && result != Null, nil
+	}
+	for i, msg := range a.saved {
+		ok, err := matches(msg)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			a.saved = append(a.saved[:i], a.saved[i+1:]...)
+			return msg, nil
+		}
+	}
+	deadline := Now() + timeout
+	for {
+		remaining := -1.0
+		if timeout >= 0 {
+			remaining = deadline - Now()
+			if remaining < 0 {
+				remaining = 0
+			}
+		}
+		// the kept exit messages are only received once the mailbox is empty, so they follow the messages that filled it
+		msg, ok := ReceiveChannel(a.mailbox, 0)
+		if !ok {
+			msg, ok = a.nextOverflow()
+		}
+		if !ok && remaining != 0 {
+			msg, ok = ReceiveChannel(a.mailbox, remaining)
+		}
+		if !ok {
+			return TimeoutKey, nil
+		}
+		matched, err := matches(msg)
+		if err != nil {
+			a.saved = append(a.saved, msg)
+			return nil, err
+		}
+		if matched {
+			return msg, nil
+		}
+		a.saved = append(a.saved, msg)
+	}
+}
+
+func (vm *vm) self() *Actor {
+	if vm.task != nil {
+		return vm.task.actor
+	}
+	return nil
+}
+
+func ellSpawnActor(vm *vm, argv []Value) (Value, error) {
+	argc := len(argv)
+	if argc < 1 {
+		return nil, argcError("spawn-actor", 1, -1, argc)
+	}
+	a := &Actor{mailbox: NewChannel(mailboxSize, "mailbox")}
+	_, err := vm.startTask(argv[0], argc-1, argv, 1, a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func ellActorP(argv []Value) (Value, error) {
+	if argv[0].Type() == ActorType {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellActorTask(argv []Value) (Value, error) {
+	return argv[0].(*Actor).task, nil
+}
+
+func ellSelf(vm *vm, argv []Value) (Value, error) {
+	if len(argv) != 0 {
+		return nil, argcError("self", 0, 0, len(argv))
+	}
+	if a := vm.self(); a != nil {
+		return a, nil
+	}
+	return Null, nil
+}
+
+func ellTell(argv []Value) (Value, error) {
+	if argv[0].(*Actor).Tell(argv[1]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func receiveArgs(vm *vm, name string, argv []Value, withPred bool) (*Actor, Value, float64, error) {
+	argc := len(argv)
+	min := 0
+	if withPred {
+		min = 1
+	}
+	if argc < min || argc > min+1 {
+		return nil, nil, 0, argcError(name, min, min+1, argc)
+	}
+	a := vm.self()
+	if a == nil {
+		return nil, nil, 0, NewError(ErrorKey, name, ": not called from an actor")
+	}
+	pred := Null
+	if withPred {
+		pred = argv[0]
+		if pred.Type() != FunctionType {
+			return nil, nil, 0, NewError(ArgumentErrorKey, name, " expected a <function> for argument 1, got a ", TypeNameOf(pred))
+		}
+	}
+	timeout := -1.0
+	if argc > min {
+		if argv[min].Type() != NumberType {
+			return nil, nil, 0, NewError(ArgumentErrorKey, name, " expected a <number> for argument ", min+1, ", got a ", TypeNameOf(argv[min]))
+		}
+		timeout = Float64Value(argv[min])
+	}
+	return a, pred, timeout, nil
+}
+
+func ellReceiveMessage(vm *vm, argv []Value) (Value, error) {
+	a, pred, timeout, err := receiveArgs(vm, "receive", argv, false)
+	if err != nil {
+		return nil, err
+	}
+	return a.receive(vm, pred, timeout)
+}
+
+func ellReceiveIf(vm *vm, argv []Value) (Value, error) {
+	a, pred, timeout, err := receiveArgs(vm, "receive-if", argv, true)
+	if err != nil {
+		return nil, err
+	}
+	return a.receive(vm, pred, timeout)
+}
+
+func watchArgs(vm *vm, name string, argv []Value) (*Actor, *Actor, error) {
+	if len(argv) != 1 {
+		return nil, nil, argcError(name, 1, 1, len(argv))
+	}
+	other, ok := argv[0].(*Actor)
+	if !ok {
+		return nil, nil, NewError(ArgumentErrorKey, name, " expected a <actor> for argument 1, got a ", TypeNameOf(argv[0]))
+	}
+	a := vm.self()
+	if a == nil {
+		return nil, nil, NewError(ErrorKey, name, ": not called from an actor")
+	}
+	return a, other, nil
+}
+
+// link - each of the two actors is sent an exit message if the other one fails
+func ellLink(vm *vm, argv []Value) (Value, error) {
+	a, other, err := watchArgs(vm, "link", argv)
+	if err != nil {
+		return nil, err
+	}
+	other.watch(a, true)
+	a.watch(other, true)
+	return Null, nil
+}
+
+// monitor - the calling actor is sent an exit message when the other one exits, for whatever reason
+func ellMonitor(vm *vm, argv []Value) (Value, error) {
+	a, other, err := watchArgs(vm, "monitor", argv)
+	if err != nil {
+		return nil, err
+	}
+	other.watch(a, false)
+	return Null, nil
+}
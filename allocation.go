@@ -0,0 +1,311 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/boynton/ell/data"
+)
+
+var ResourceErrorKey = Intern("resource-error:")
+
+// The allocation budget. Each evaluation (a call to Eval or Call, or each top level expression of a file being
+// loaded) may allocate up to the limit, counted in approximate bytes. The VM counts the frames, closures,
+// vectors, and structs it makes, and the primitives that allocate count what they are about to allocate, before
+// they do it. Slurp counts the size of a file before reading it. The size of what is read from the network cannot be
+// known until it has been read, so it is counted just after, and no more than the limit is read. Tasks spawned
+// during the evaluation share its budget. The count is of all allocation, not of what is still in use. Once the budget is exceeded, the evaluation fails with a resource-error, which cannot be
+// caught.
+
+var allocationLimit int64 // zero means no limit
+
+// SetAllocationLimit - limit the allocation of each evaluation to the given number of bytes, or remove the limit
+// if it is zero.
+func SetAllocationLimit(bytes int64) {
+	atomic.StoreInt64(&allocationLimit, bytes)
+}
+
+// AllocationLimit - the current limit, or zero if there is none
+func AllocationLimit() int64 {
+	return atomic.LoadInt64(&allocationLimit)
+}
+
+type budget struct {
+	limit int64
+	used  int64
+}
+
+func newBudget() *budget {
+	limit := AllocationLimit()
+	if limit <= 0 {
+		return nil
+	}
+	return &budget{limit: limit}
+}
+
+func (b *budget) exhausted() bool {
+	return atomic.LoadInt64(&b.used) > b.limit
+}
+
+// allocate - count the bytes against the VM's budget, if it has one
+func (vm *vm) allocate(bytes int) error {
+	b := vm.budget
+	if b == nil {
+		return nil
+	}
+	if atomic.AddInt64(&b.used, int64(bytes)) > b.limit {
+		return NewError(ResourceErrorKey, "allocation limit of ", b.limit, " bytes exceeded")
+	}
+	return nil
+}
+
+// approximate sizes of things, in bytes
+const (
+	valueSize   = 16 // an interface value
+	cellSize    = 48 // a list cell
+	headerSize  = 32
+	frameSize   = 96
+	closureSize = 64
+)
+
+func frameCost(argc int) int {
+	if argc <= 5 {
+		return frameSize
+	}
+	return frameSize + argc*valueSize
+}
+
+func vectorCost(n int) int {
+	return headerSize + n*valueSize
+}
+
+func structCost(n int) int {
+	return headerSize + n*2*valueSize
+}
+
+func sizeArg(argv []Value, i int) int {
+	if i < len(argv) {
+		if n, ok := argv[i].(*Number); ok && n.Value > 0 {
+			if n.Value > 1e15 {
+				return 1e15
+			}
+			return int(n.Value)
+		}
+	}
+	return 0
+}
+
+func lengthOf(val Value) int {
+	switch p := val.(type) {
+	case *String:
+		return len(p.Value)
+	case *List:
+		return ListLength(p)
+	case *Vector:
+		return len(p.Elements)
+	case *Blob:
+		return len(p.Value)
+	case *Struct:
+		return p.Length()
+	}
+	return 1
+}
+
+// deepLength - the number of elements of the value, counting those of nested lists, vectors, and structs, and
+// the characters of strings if chars is true. Counting stops once it passes max, so shared or circular structure
+// cannot make it run on.
+func deepLength(val Value, chars bool, max int) int {
+	n := 0
+	var count func(val Value)
+	count = func(val Value) {
+		if n > max {
+			return
+		}
+		switch p := val.(type) {
+		case *String:
+			if chars {
+				n += len(p.Value) + 2
+			} else {
+				n++
+			}
+		case *List:
+			for ; p != EmptyList && n <= max; p = p.Cdr {
+				n++
+				count(p.Car)
+			}
+		case *Vector:
+			for _, elem := range p.Snapshot() {
+				if n > max {
+					return
+				}
+				n++
+				count(elem)
+			}
+		case *Struct:
+			for k, v := range p.Snapshot() {
+				if n > max {
+					return
+				}
+				n += len(k.Value) + 1
+				count(v)
+			}
+		default:
+			n += 8
+		}
+	}
+	count(val)
+	return n
+}
+
+// writtenCost - the approximate size of the string the value is written as
+func writtenCost(argv []Value) int {
+	if len(argv) == 0 {
+		return headerSize
+	}
+	return headerSize + deepLength(argv[0], true, int(AllocationLimit()))
+}
+
+func flattenCost(argv []Value) int {
+	if len(argv) == 0 {
+		return 0
+	}
+	return deepLength(argv[0], false, int(AllocationLimit())/cellSize) * cellSize
+}
+
+func substringCost(argv []Value) int {
+	n := sizeArg(argv, 2) - sizeArg(argv, 1)
+	if len(argv) > 0 && n > lengthOf(argv[0]) {
+		n = lengthOf(argv[0])
+	}
+	if n < 0 {
+		n = 0
+	}
+	return headerSize + n
+}
+
+// fileSize - the size of the file about to be slurped, or zero if it cannot be known
+func fileSize(path string) int {
+	var info fs.FileInfo
+	var err error
+	if strings.HasPrefix(path, "@/") {
+		info, err = fs.Stat(sysFS, "lib"+path[1:])
+	} else {
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return 0
+	}
+	return headerSize + int(info.Size())
+}
+
+// responseSize - the size of the body of an http response
+func responseSize(result Value) int {
+	if s, ok := result.(*Struct); ok {
+		return headerSize + lengthOf(s.Get(Intern("body:")))
+	}
+	return 0
+}
+
+func sumOfLengths(argv []Value) int {
+	n := 0
+	for _, arg := range argv {
+		n += lengthOf(arg)
+	}
+	return n
+}
+
+// allocationCosts - estimate what each allocating primitive allocates, from its arguments. The arguments may not
+// have been checked yet, so these must not assume their types.
+var allocationCosts = map[string]func(argv []Value) int{
+	"cons":         func(argv []Value) int { return cellSize },
+	"list":         func(argv []Value) int { return len(argv) * cellSize },
+	"vector":       func(argv []Value) int { return vectorCost(len(argv)) },
+	"make-vector":  func(argv []Value) int { return vectorCost(sizeArg(argv, 0)) },
+	"make-vector2": func(argv []Value) int { return vectorCost(sizeArg(argv, 0)) },
+	"struct":       func(argv []Value) int { return structCost(len(argv) / 2) },
+	"make-blob":    func(argv []Value) int { return headerSize + sizeArg(argv, 0) },
+	"random-list":  func(argv []Value) int { return sizeArg(argv, 0) * cellSize },
+	"string":       func(argv []Value) int { return headerSize + sumOfLengths(argv) },
+	"concat":       func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"reverse":      func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"to-list":      func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"to-vector":    func(argv []Value) int { return vectorCost(sumOfLengths(argv)) },
+	"to-struct":    func(argv []Value) int { return structCost(sumOfLengths(argv)) },
+	"to-blob":      func(argv []Value) int { return headerSize + sumOfLengths(argv) },
+	"substring":    substringCost,
+	"join":         func(argv []Value) int { return headerSize + sumOfLengths(argv)*16 },
+	"split":        func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"read":         func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"read-all":     func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"flatten":      flattenCost,
+	"to-string":    writtenCost,
+	"write":        writtenCost,
+	"write-all":    writtenCost,
+	"json":         writtenCost,
+	"make-struct":  func(argv []Value) int { return structCost(sizeArg(argv, 0)) },
+	"keys":         func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+	"values":       func(argv []Value) int { return sumOfLengths(argv) * cellSize },
+}
+
+// allocationSizes - the size of what a primitive allocated, from its arguments and result
+var allocationSizes = map[string]func(argv []Value, result Value) int{
+	"slurp": func(argv []Value, result Value) int {
+		if name, ok := argv[0].(*String); ok && isURL(name.Value) {
+			return headerSize + lengthOf(result)
+		}
+		return 0
+	},
+	"http": func(argv []Value, result Value) int { return responseSize(result) },
+}
+
+// setAllocationCosts - attach the cost estimates to the primitives
+func setAllocationCosts() {
+	for _, prim := range primitives {
+		if cost, ok := allocationCosts[prim.name]; ok {
+			prim.cost = cost
+		}
+		if size, ok := allocationSizes[prim.name]; ok {
+			prim.size = size
+		}
+	}
+}
+
+// invokePrimitive - call the primitive, first counting what it will allocate, or after, if that cannot be known
+func (vm *vm) invokePrimitive(prim *Primitive, argv []Value) (Value, error) {
+	if vm.budget != nil && prim.cost != nil {
+		if err := vm.allocate(prim.cost(argv)); err != nil {
+			return nil, err
+		}
+	}
+	var result Value
+	var err error
+	if prim.vmfun != nil {
+		result, err = prim.vmfun(vm, argv)
+	} else {
+		result, err = prim.fun(argv)
+	}
+	if err == nil && vm.budget != nil && prim.size != nil {
+		if err := vm.allocate(prim.size(argv, result)); err != nil {
+			return nil, err
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Bundles - a script and the modules it uses, compiled, appended to a copy of the ell executable. The bundle is
+// followed by its length and bundleMagic, so that Main can find it at the end of the executable it is run from, and
+// run the script instead of doing what ell does. The script is run as a module, then its main function is called with
+// the list of command-line arguments.
+
+const bundleMagic = "ell bundle"
+
+type bundleFile struct {
+	Magic   string
+	Version int
+	Script  string            // the name of the script's module
+	Modules map[string][]byte // the compiled modules, as saved in .lvm files, by name
+}
+
+// bundling - while a bundle is being made, the code of each module loaded, by name
+var bundling map[string][]*Code
+
+// Bundle - write an executable that runs the script, with the modules it uses, compiled, in it. The definitions and
+// uses of the script are run, so that the modules it uses are known, but nothing else is.
+func Bundle(script string, output string) error {
+	file, err := FindModuleFile(script)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if output == "" {
+		output = name
+	}
+	bundling = make(map[string][]*Code)
+	defer func() {
+		bundling = nil
+	}()
+	thunks, err := compileScript(file)
+	if err != nil {
+		return err
+	}
+	b := &bundleFile{Magic: bundleMagic, Version: imageVersion, Script: name, Modules: make(map[string][]byte)}
+	bundling[name] = thunks
+	for mod, thunks := range bundling {
+		data, err := encodeModule("", thunks)
+		if err != nil {
+			return err
+		}
+		b.Modules[mod] = data
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(b); err != nil {
+		return NewError(ErrorKey, "cannot encode the bundle: ", err.Error())
+	}
+	exe, size, err := openExecutable()
+	if err != nil {
+		return err
+	}
+	defer exe.Close()
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return NewError(IOErrorKey, err.Error())
+	}
+	if _, base, err := findBundle(exe, size); err == nil && base >= 0 {
+		// the executable is a bundle itself: copy only the ell executable it was made from
+		exe.Seek(0, io.SeekStart)
+		_, err = io.CopyN(out, exe, base)
+	} else {
+		exe.Seek(0, io.SeekStart)
+		_, err = io.Copy(out, exe)
+	}
+	if err == nil {
+		_, err = out.Write(payload.Bytes())
+	}
+	if err == nil {
+		err = binary.Write(out, binary.BigEndian, int64(payload.Len()))
+	}
+	if err == nil {
+		_, err = out.Write([]byte(bundleMagic))
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return NewError(IOErrorKey, err.Error())
+	}
+	return nil
+}
+
+// compileScript - compile the forms of the source (.ell) or compiled (.lvm) file, without running them. Its macros
+// are known to the forms after them, as they are when linting, and the modules it uses are loaded, to be bundled too
+func compileScript(file string) ([]*Code, error) {
+	if strings.HasSuffix(file, ".lvm") {
+		thunks, err := readCompiledModule(file, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, thunk := range thunks {
+			for pc := 0; pc < len(thunk.ops); pc += opcodeWidth(thunk.ops[pc]) {
+				if thunk.ops[pc] == opcodeUse {
+					if err := Load(constants[thunk.ops[pc+1]].(*Symbol).Text); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		return thunks, nil
+	}
+	text, err := SlurpFile(file)
+	if err != nil {
+		return nil, err
+	}
+	exprs, err := ReadAllFromString(text)
+	if err != nil {
+		return nil, err
+	}
+	x := newSourceExpander(nil)
+	x.load = true
+	var thunks []*Code
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		expr, err := x.macroexpandObject(exprs.Car)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.define(expr); err != nil {
+			return nil, err
+		}
+		thunk, err := Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		thunks = append(thunks, thunk)
+	}
+	return thunks, nil
+}
+
+func openExecutable() (*os.File, int64, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, 0, NewError(IOErrorKey, "cannot find the executable: ", err.Error())
+	}
+	exe, err := os.Open(path)
+	if err != nil {
+		return nil, 0, NewError(IOErrorKey, err.Error())
+	}
+	info, err := exe.Stat()
+	if err != nil {
+		exe.Close()
+		return nil, 0, NewError(IOErrorKey, err.Error())
+	}
+	return exe, info.Size(), nil
+}
+
+// findBundle - the bundle at the end of the file of the given size, and the size of the executable before it. The
+// size is -1 if there is no bundle.
+func findBundle(exe io.ReadSeeker, size int64) (*bundleFile, int64, error) {
+	trailer := make([]byte, 8+len(bundleMagic))
+	if size < int64(len(trailer)) {
+		return nil, -1, nil
+	}
+	if _, err := exe.Seek(size-int64(len(trailer)), io.SeekStart); err != nil {
+		return nil, -1, err
+	}
+	if _, err := io.ReadFull(exe, trailer); err != nil {
+		return nil, -1, err
+	}
+	if string(trailer[8:]) != bundleMagic {
+		return nil, -1, nil
+	}
+	n := int64(binary.BigEndian.Uint64(trailer))
+	start := size - int64(len(trailer)) - n
+	if n <= 0 || start < 0 {
+		return nil, -1, NewError(ErrorKey, "the bundle is corrupt")
+	}
+	if _, err := exe.Seek(start, io.SeekStart); err != nil {
+		return nil, -1, err
+	}
+	b := &bundleFile{}
+	if err := gob.NewDecoder(io.LimitReader(exe, n)).Decode(b); err != nil || b.Magic != bundleMagic {
+		return nil, -1, NewError(ErrorKey, "the bundle is corrupt")
+	}
+	if b.Version != imageVersion {
+		return nil, -1, NewError(ErrorKey, "the bundle was made by a different version of ell")
+	}
+	return b, start, nil
+}
+
+// executableBundle - the bundle appended to the running executable, or nil if there is none
+func executableBundle() (*bundleFile, error) {
+	exe, size, err := openExecutable()
+	if err != nil {
+		// then it cannot have a bundle either
+		return nil, nil
+	}
+	defer exe.Close()
+	b, _, err := findBundle(exe, size)
+	return b, err
+}
+
+// runBundle - run the bundled script, and call its main function, if it defines one, with the arguments
+func runBundle(b *bundleFile, args []string) error {
+	for name, data := range b.Modules {
+		RegisterModule(name, data)
+	}
+	if err := Load(b.Script); err != nil {
+		return err
+	}
+	main := GetGlobal(Intern("main"))
+	if main == nil {
+		return nil
+	}
+	argv := make([]Value, len(args))
+	for i, arg := range args {
+		argv[i] = NewString(arg)
+	}
+	_, err := Call(main, ListFromValues(argv))
+	return err
+}
@@ -18,6 +18,9 @@ package ell
 
 import (
 	"fmt"
+	"sync/atomic"
+	"time"
+
 	. "github.com/boynton/ell/data"
 )
 
@@ -30,7 +33,14 @@ var ChannelType Value = Intern("<channel>")
 type Channel struct {
 	name    string
 	bufsize int
-	channel chan Value // non-nil for channels
+	channel chan Value
+	closed  int32
+	stop    func() bool // for channels fed by a timer or ticker
+
+	// used instead of the Go channel by the deterministic scheduler
+	buffer    []Value
+	senders   []*pendingSend
+	receivers int
 }
 
 func (ch *Channel) Type() Value {
@@ -45,7 +55,7 @@ func (ch *Channel) String() string {
 	if ch.bufsize > 0 {
 		s += fmt.Sprintf(" [%d]", ch.bufsize)
 	}
-	if ch.channel == nil {
+	if ch.IsClosed() {
 		s += " CLOSED"
 	}
 	return s + "]"
@@ -63,6 +73,12 @@ func NewChannel(bufsize int, name string) *Channel {
 	return &Channel{name: name, bufsize: bufsize, channel: make(chan Value, bufsize)}
 }
 
+// WrapChannel - make an Ell channel for a Go channel, so that Go code and Ell code can send and receive on the same
+// channel. Closing it on either side ends receives on the other.
+func WrapChannel(ch chan Value, name string) *Channel {
+	return &Channel{name: name, bufsize: cap(ch), channel: ch}
+}
+
 // ChannelValue - return the Go channel object for the Ell channel
 func ChannelValue(obj Value) chan Value {
 	if v, ok := obj.(*Channel); ok {
@@ -71,13 +87,157 @@ func ChannelValue(obj Value) chan Value {
 	return nil
 }
 
+// IsClosed - true if the channel has been closed. Values already buffered can still be received from it.
+func (ch *Channel) IsClosed() bool {
+	return atomic.LoadInt32(&ch.closed) != 0
+}
+
 // CloseChannel - close the channel object
 func CloseChannel(obj Value) {
 	if v, ok := obj.(*Channel); ok {
-		c := v.channel
-		if c != nil {
-			v.channel = nil
-			close(c)
+		if atomic.CompareAndSwapInt32(&v.closed, 0, 1) {
+			if v.stop != nil {
+				v.stop()
+			}
+			close(v.channel)
+		}
+	}
+}
+
+// SendChannel - send a value on the channel, waiting up to timeout seconds for it to be accepted. A timeout of
+// zero doesn't wait at all, a negative one waits forever. Returns false if the value was not sent, including
+// when the channel is (or becomes) closed.
+func SendChannel(obj Value, val Value, timeout float64) (sent bool) {
+	v, ok := obj.(*Channel)
+	if !ok || v.IsClosed() {
+		return false
+	}
+	if virtual != nil {
+		return virtual.send(v, val, timeout)
+	}
+	defer func() {
+		if recover() != nil { //the channel was closed while we were waiting
+			sent = false
+		}
+	}()
+	ch := v.channel
+	if NumberEqual(timeout, 0.0) { //non-blocking
+		select {
+		case ch <- val:
+			return true
+		default:
+		}
+	} else if timeout > 0 { //with timeout
+		dur := time.Millisecond * time.Duration(timeout*1000.0)
+		select {
+		case ch <- val:
+			return true
+		case <-time.After(dur):
+		}
+	} else { //block forever
+		ch <- val
+		return true
+	}
+	return false
+}
+
+// ReceiveChannel - receive a value from the channel, waiting up to timeout seconds for one. The result is false
+// if nothing was received, because the timeout expired or because the channel is closed and empty.
+func ReceiveChannel(obj Value, timeout float64) (Value, bool) {
+	v, ok := obj.(*Channel)
+	if !ok {
+		return Null, false
+	}
+	if virtual != nil {
+		return virtual.receive(v, timeout)
+	}
+	ch := v.channel
+	if NumberEqual(timeout, 0.0) { //non-blocking
+		select {
+		case val, ok := <-ch:
+			if ok {
+				return val, true
+			}
+		default:
+		}
+	} else if timeout > 0 { //with timeout
+		dur := time.Millisecond * time.Duration(timeout*1000.0)
+		select {
+		case val, ok := <-ch:
+			if ok {
+				return val, true
+			}
+		case <-time.After(dur):
 		}
+	} else { //block forever
+		if val, ok := <-ch; ok {
+			return val, true
+		}
+	}
+	return Null, false
+}
+
+func timeValue(t time.Time) Value {
+	return Float(float64(t.UnixNano()) / float64(time.Second))
+}
+
+// NewTimerChannel - create a channel that receives the time, once, after the delay in seconds
+func NewTimerChannel(delay float64) *Channel {
+	ch := NewChannel(1, "after")
+	if virtual != nil {
+		timer := virtual.newTimer(delay, 0, func() {
+			SendChannel(ch, Float(virtual.now), 0)
+		})
+		ch.stop = func() bool { return virtual.stopTimer(timer) }
+		return ch
 	}
+	timer := time.AfterFunc(time.Duration(delay*float64(time.Second)), func() {
+		SendChannel(ch, timeValue(time.Now()), 0)
+	})
+	ch.stop = timer.Stop
+	return ch
+}
+
+// NewTickerChannel - create a channel that receives the time repeatedly, every interval seconds. Like
+// a Go ticker, ticks are dropped if the receiver falls behind.
+func NewTickerChannel(interval float64) *Channel {
+	ch := NewChannel(1, "ticker")
+	if virtual != nil {
+		timer := virtual.newTimer(interval, interval, func() {
+			SendChannel(ch, Float(virtual.now), 0)
+		})
+		ch.stop = func() bool { return virtual.stopTimer(timer) }
+		return ch
+	}
+	ticker := time.NewTicker(time.Duration(interval * float64(time.Second)))
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case t := <-ticker.C:
+				SendChannel(ch, timeValue(t), 0)
+			case <-done:
+				return
+			}
+		}
+	}()
+	ch.stop = func() bool {
+		ticker.Stop()
+		close(done)
+		return true
+	}
+	return ch
+}
+
+// StopTimer - stop the timer or ticker feeding the channel, and close the channel. Returns true if the timer had
+// not already fired (or the ticker was running).
+func StopTimer(obj Value) bool {
+	if v, ok := obj.(*Channel); ok && v.stop != nil {
+		if atomic.CompareAndSwapInt32(&v.closed, 0, 1) {
+			stopped := v.stop()
+			close(v.channel)
+			return stopped
+		}
+	}
+	return false
 }
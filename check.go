@@ -0,0 +1,456 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Static type checking. Check reads and expands a source file as Lint does, then infers the type of each expression
+// from the types of constants, the declared argument and result types of primitives and functions, and the fields
+// of the structs the file defines with defstruct. The types of let bindings and typed parameters are carried into
+// their bodies, an if has the union of the types of its branches, and a function defined in the file without a
+// declared result has the type of its body. A variable that is ever assigned with set! is of unknown type.
+//
+// Only definite errors are reported: a value whose type has nothing in common with the type expected of it, like a
+// <number> passed to string-length, or a <vector> to car. A value of unknown type is never an error.
+//
+// The file is walked twice, the first time only to learn the result types of its functions, so that a call of a
+// function defined further down the file is checked too.
+
+// Check - the type errors in the source file, in the order of their lines
+func Check(name string) ([]*Warning, error) {
+	file, exprs, lines, err := readSource(name)
+	if err != nil {
+		return nil, err
+	}
+	x := newSourceExpander(lines)
+	expanded, err := x.expandSource(exprs)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		report:       newReport(file, x),
+		globals:      make(map[Value]Value),
+		assigned:     make(map[Value]bool),
+		results:      make(map[Value]Value),
+		structs:      make(map[Value]map[Value]Value),
+		constructors: make(map[Value]Value),
+		makers:       make(map[Value]Value),
+	}
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		c.noteStructs(exprs.Car)
+	}
+	for pass := 0; pass < 2; pass++ {
+		c.learning = pass == 0
+		for _, expr := range expanded {
+			c.infer(expr, 0)
+		}
+	}
+	return c.sorted(), nil
+}
+
+type checker struct {
+	*report
+	learning     bool                      // true on the first pass, when nothing is reported
+	scopes       [][]*checkVar             // the local variables, innermost last
+	globals      map[Value]Value           // the types of the globals defined in the file
+	assigned     map[Value]bool            // the globals the file assigns with set!
+	results      map[Value]Value           // the result types of the functions defined in the file
+	structs      map[Value]map[Value]Value // the types of the fields of each struct type defined in the file
+	constructors map[Value]Value           // the struct type of each constructor defined by defstruct
+	makers       map[Value]Value           // the struct type each function defined by defstruct returns
+}
+
+type checkVar struct {
+	sym Value
+	typ Value
+}
+
+func (c *checker) warn(line int, args ...interface{}) {
+	if !c.learning {
+		c.report.warn(line, args...)
+	}
+}
+
+// noteStructs - note the field types of the structs defined by the defstruct form, i.e. (defstruct point x: <number>)
+func (c *checker) noteStructs(expr Value) {
+	lst, ok := expr.(*List)
+	if !ok || lst == EmptyList {
+		return
+	}
+	switch lst.Car {
+	case Intern("do"):
+		for body := lst.Cdr; body != EmptyList; body = body.Cdr {
+			c.noteStructs(body.Car)
+		}
+	case Intern("defstruct"):
+		sym, ok := Cadr(lst).(*Symbol)
+		if !ok {
+			return
+		}
+		typ := Intern("<" + sym.Text + ">")
+		fields := make(map[Value]Value)
+		for spec := Cddr(lst); spec != EmptyList && spec.Cdr != EmptyList; spec = Cddr(spec) {
+			if IsType(Cadr(spec)) {
+				fields[spec.Car] = Cadr(spec)
+			} else {
+				fields[spec.Car] = AnyType
+			}
+		}
+		c.structs[typ] = fields
+		c.constructors[sym] = typ
+		c.makers[sym] = typ
+		c.makers[Intern("as-"+sym.Text)] = typ
+	}
+}
+
+func (c *checker) lookup(sym Value) *checkVar {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		vars := c.scopes[i]
+		for j := len(vars) - 1; j >= 0; j-- {
+			if vars[j].sym == sym {
+				return vars[j]
+			}
+		}
+	}
+	return nil
+}
+
+// bind - push a scope with the variables, of the types, for the body. A variable the body assigns is of unknown type.
+func (c *checker) bind(syms []Value, types []Value, body *List) {
+	vars := make([]*checkVar, len(syms))
+	for i, sym := range syms {
+		t := types[i]
+		if assigns(body, sym) {
+			t = AnyType
+		}
+		vars[i] = &checkVar{sym, t}
+	}
+	c.scopes = append(c.scopes, vars)
+}
+
+func (c *checker) unbind() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+func (c *checker) inferSequence(lst *List, line int) Value {
+	var t Value = NullType
+	for ; lst != EmptyList; lst = lst.Cdr {
+		t = c.infer(lst.Car, line)
+	}
+	return t
+}
+
+// infer - the type of the value of the expanded expression, or <any> if it is not known. The line is that of the
+// nearest enclosing list read from the source.
+func (c *checker) infer(expr Value, line int) Value {
+	switch p := expr.(type) {
+	case *Symbol:
+		if v := c.lookup(p); v != nil {
+			return v.typ
+		}
+		if t, ok := c.globals[p]; ok && !c.assigned[p] {
+			return t
+		}
+		return AnyType
+	case *Vector:
+		for _, e := range p.Elements {
+			c.infer(e, line)
+		}
+		return VectorType
+	case *Struct:
+		for k, v := range p.Bindings {
+			c.infer(k.ToValue(), line)
+			c.infer(v, line)
+		}
+		return StructType
+	case *List:
+		if p == EmptyList {
+			return ListType
+		}
+		if n := c.sourceLine(p); n > 0 {
+			line = n
+		}
+		return c.inferList(p, line)
+	}
+	return expr.Type()
+}
+
+func (c *checker) inferList(lst *List, line int) Value {
+	switch lst.Car {
+	case Intern("quote"):
+		return Cadr(lst).Type()
+	case Intern("code"), Intern("use"), Intern("undef"), Intern("defmacro"):
+		return AnyType
+	case Intern("do"):
+		return c.inferSequence(lst.Cdr, line)
+	case Intern("if"):
+		lstlen := ListLength(lst)
+		if lstlen != 3 && lstlen != 4 {
+			return AnyType
+		}
+		c.infer(Cadr(lst), line)
+		consequent := c.infer(Caddr(lst), line)
+		var antecedent Value = NullType
+		if lstlen == 4 {
+			antecedent = c.infer(Cadddr(lst), line)
+		}
+		return unionType(consequent, antecedent)
+	case Intern("def"):
+		name := Cadr(lst)
+		var t Value
+		if fn, ok := Caddr(lst).(*List); ok && fn != EmptyList && fn.Car == Intern("fn") && ListLength(fn) >= 3 {
+			result := c.inferFn(name, Cadr(fn), Cddr(fn), line)
+			if len(c.scopes) == 0 {
+				c.results[name] = result
+			}
+			t = FunctionType
+		} else {
+			t = c.infer(Caddr(lst), line)
+		}
+		if len(c.scopes) == 0 && c.learning {
+			if prev, ok := c.globals[name]; ok {
+				t = unionType(prev, t)
+			}
+			c.globals[name] = t
+		}
+		return t
+	case Intern("fn"):
+		if ListLength(lst) >= 3 {
+			c.inferFn(nil, Cadr(lst), Cddr(lst), line)
+		}
+		return FunctionType
+	case Intern("set!"):
+		c.infer(Caddr(lst), line)
+		if sym, ok := Cadr(lst).(*Symbol); ok && c.lookup(sym) == nil {
+			c.assigned[sym] = true
+		}
+		return AnyType
+	}
+	if head, ok := lst.Car.(*List); ok && head != EmptyList && head.Car == Intern("fn") && ListLength(head) >= 3 {
+		if vars, ok := Cadr(head).(*List); ok && isVariableList(vars) && ListLength(vars) == ListLength(lst.Cdr) {
+			// a let, letrec, or named let
+			var types []Value
+			for inits := lst.Cdr; inits != EmptyList; inits = inits.Cdr {
+				types = append(types, c.infer(inits.Car, line))
+			}
+			body := Cddr(head)
+			c.bind(ListToVector(vars).Elements, types, body)
+			t := c.inferSequence(body, line)
+			c.unbind()
+			return t
+		}
+	}
+	var types []Value
+	for args := lst.Cdr; args != EmptyList; args = args.Cdr {
+		types = append(types, c.infer(args.Car, line))
+	}
+	switch fn := lst.Car.(type) {
+	case *Symbol:
+		return c.inferCall(fn, lst.Cdr, types, line)
+	case *Keyword:
+		return c.inferField(fn, types, line)
+	}
+	c.infer(lst.Car, line)
+	return AnyType
+}
+
+// inferFn - check the body of a fn form, and return the type of its result
+func (c *checker) inferFn(name Value, args Value, body *List, line int) Value {
+	var result Value
+	if ListLength(body) > 1 && IsType(body.Car) {
+		result = body.Car
+		body = body.Cdr
+	}
+	syms, types := fnParameterTypes(args)
+	c.bind(syms, types, body)
+	t := c.inferSequence(body, line)
+	c.unbind()
+	if result == nil {
+		return t
+	}
+	if disjoint(t, result) {
+		what := "anonymous function"
+		if name != nil {
+			what = name.String()
+		}
+		c.warn(line, fmt.Sprintf("%s expected to return a %s, got a %s", what, result, t))
+	}
+	return result
+}
+
+// inferCall - check the types of the arguments of a call of the global function, and return the type of its result
+func (c *checker) inferCall(sym *Symbol, args *List, types []Value, line int) Value {
+	if c.lookup(sym) != nil || c.assigned[sym] {
+		return AnyType
+	}
+	if typ, ok := c.constructors[sym]; ok {
+		c.checkFields(typ, args, types, line)
+	}
+	if typ, ok := c.makers[sym]; ok {
+		return typ
+	}
+	val, _ := c.x.global(sym)
+	fun, ok := val.(*Function)
+	if !ok {
+		return AnyType
+	}
+	for i, t := range types {
+		if expected := argumentType(fun, i); disjoint(t, expected) {
+			c.warn(line, fmt.Sprintf("%s expected a %s for argument %d, got a %s", sym, expected, i+1, t))
+		}
+	}
+	if code := fun.code; code != nil && code.result != nil {
+		return code.result
+	}
+	if prim := fun.primitive; prim != nil && prim.result != nil {
+		return prim.result
+	}
+	if t, ok := c.results[sym]; ok {
+		return t
+	}
+	return AnyType
+}
+
+// checkFields - check the keyword arguments of a call of the constructor of a struct type defined in the file
+func (c *checker) checkFields(typ Value, args *List, types []Value, line int) {
+	if len(types)%2 != 0 {
+		return
+	}
+	fields := c.structs[typ]
+	for i := 0; args != EmptyList; i, args = i+2, Cddr(args) {
+		key, ok := args.Car.(*Keyword)
+		if !ok {
+			continue
+		}
+		if expected, ok := fields[key]; !ok {
+			c.warn(line, typ, " has no field ", key)
+		} else if disjoint(types[i+1], expected) {
+			c.warn(line, fmt.Sprintf("%s expected a %s for field %s, got a %s", typ, expected, key, types[i+1]))
+		}
+	}
+}
+
+// inferField - the type of a field of a struct type defined in the file, as got by calling the field's keyword
+func (c *checker) inferField(key *Keyword, types []Value, line int) Value {
+	if len(types) != 1 {
+		return AnyType
+	}
+	fields, ok := c.structs[types[0]]
+	if !ok {
+		return AnyType
+	}
+	t, ok := fields[key]
+	if !ok {
+		c.warn(line, types[0], " has no field ", key)
+		return AnyType
+	}
+	return t
+}
+
+// argumentType - the type the function declares for its argument i, or <any>
+func argumentType(fun *Function, i int) Value {
+	if prim := fun.primitive; prim != nil {
+		switch {
+		case prim.argc < 0:
+		case i < prim.argc || (prim.defaults != nil && len(prim.defaults) > 0 && prim.keys == nil):
+			if i < len(prim.args) {
+				return prim.args[i]
+			}
+		case prim.defaults != nil && len(prim.defaults) == 0 && prim.rest != nil:
+			return prim.rest
+		}
+	} else if code := fun.code; code != nil && i < len(code.argtypes) {
+		return code.argtypes[i]
+	}
+	return AnyType
+}
+
+// assigns - true if the expression sets the variable, outside of quoted data
+func assigns(expr Value, sym Value) bool {
+	lst, ok := expr.(*List)
+	if !ok || lst == EmptyList || lst.Car == Intern("quote") {
+		return false
+	}
+	if lst.Car == Intern("set!") && Cadr(lst) == sym {
+		return true
+	}
+	for ; lst != EmptyList; lst = lst.Cdr {
+		if assigns(lst.Car, sym) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeBases - the simple types a value of the type may be of, not counting element types
+func typeBases(t Value) []Value {
+	expr, err := typeExpression(t)
+	if err != nil {
+		return []Value{AnyType}
+	}
+	if expr == nil {
+		return []Value{t}
+	}
+	var bases []Value
+	for _, term := range expr {
+		bases = append(bases, term.base)
+	}
+	return bases
+}
+
+// unionType - the type of a value that is of one of the types
+func unionType(t1 Value, t2 Value) Value {
+	if t1 == t2 {
+		return t1
+	}
+	seen := make(map[Value]bool)
+	var names []string
+	for _, t := range append(typeBases(t1), typeBases(t2)...) {
+		if t == AnyType {
+			return AnyType
+		}
+		if !seen[t] {
+			seen[t] = true
+			name := t.String()
+			names = append(names, name[1:len(name)-1])
+		}
+	}
+	sort.Strings(names)
+	return Intern("<" + strings.Join(names, "|") + ">")
+}
+
+// disjoint - true if no value of the inferred type is of the expected type
+func disjoint(inferred Value, expected Value) bool {
+	if inferred == AnyType || expected == AnyType {
+		return false
+	}
+	bases := typeBases(expected)
+	for _, t := range typeBases(inferred) {
+		for _, base := range bases {
+			if t == AnyType || base == AnyType || t == base {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -43,6 +43,9 @@ const (
 	opcodeVector
 	opcodeStruct
 	opcodeUndefGlobal
+	opcodeCallGlobal     // a global followed by a call
+	opcodeTailCallGlobal // a global followed by a tailcall
+	opcodeLocalJumpFalse // a local followed by a jumpfalse
 	opcodeCount
 )
 
@@ -63,6 +66,9 @@ var DefmacroSymbol = Intern("defmacro")
 var VectorSymbol = Intern("vector")
 var StructSymbol = Intern("struct")
 var UndefineSymbol = Intern("undefine")
+var CallglobalSymbol = Intern("callglobal")
+var TailcallglobalSymbol = Intern("tailcallglobal")
+var LocaljumpfalseSymbol = Intern("localjumpfalse")
 var FuncSymbol = Intern("func")
 
 var opsyms = initOpsyms()
@@ -86,6 +92,9 @@ func initOpsyms() []Value {
 	syms[opcodeVector] = VectorSymbol
 	syms[opcodeStruct] = StructSymbol
 	syms[opcodeUndefGlobal] = UndefineSymbol
+	syms[opcodeCallGlobal] = CallglobalSymbol
+	syms[opcodeTailCallGlobal] = TailcallglobalSymbol
+	syms[opcodeLocalJumpFalse] = LocaljumpfalseSymbol
 	return syms
 }
 
@@ -93,11 +102,15 @@ var CodeType Value = Intern("<code>")
 
 // Code - compiled Ell bytecode
 type Code struct {
-	name     string
-	ops      []int
-	argc     int
-	defaults []Value
-	keys     []Value
+	name      string
+	ops       []int
+	argc      int
+	defaults  []Value
+	keys      []Value
+	frameSize int     // if more than the arguments need, the size of the frame, which also holds the variables of lets
+	argtypes  []Value // if set, the declared type of each required argument, <any> for those not declared
+	result    Value   // if set, the declared type of the result
+	loops     []*loop // while compiling, the named lets being compiled as loops, innermost last
 }
 
 func MakeCode(argc int, defaults []Value, keys []Value, name string) *Code {
@@ -108,6 +121,10 @@ func MakeCode(argc int, defaults []Value, keys []Value, name string) *Code {
 		argc,
 		defaults, //nil for normal procs, empty for rest, and non-empty for optional/keyword
 		keys,
+		0,
+		nil,
+		nil,
+		nil,
 	}
 	return code
 }
@@ -124,6 +141,24 @@ func (code1 *Code) Equals(another Value) bool {
 }
 
 func (code *Code) signature() string {
+	if code.argtypes != nil || code.result != nil {
+		args := code.argtypes
+		if args == nil {
+			args = make([]Value, code.argc)
+			for i := range args {
+				args[i] = AnyType
+			}
+		}
+		var rest Value
+		if code.defaults != nil {
+			rest = AnyType
+		}
+		result := code.result
+		if result == nil {
+			result = AnyType
+		}
+		return functionSignatureFromTypes(result, args, rest)
+	}
 	//
 	//experimental: external annotations on the functions: *declarations* is a map from symbol to string
 	//
@@ -186,6 +221,17 @@ func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool) {
 	} else {
 		buf.WriteString(" []")
 	}
+	if code.frameSize > 0 || code.argtypes != nil || code.result != nil {
+		buf.WriteString(" " + strconv.Itoa(code.frameSize))
+	}
+	if code.argtypes != nil || code.result != nil {
+		buf.WriteString(" " + Write(NewVector(code.argtypes...)) + " ")
+		if code.result != nil {
+			buf.WriteString(Write(code.result))
+		} else {
+			buf.WriteString("null")
+		}
+	}
 	buf.WriteString(")")
 	if pretty {
 		indent = indent + indentAmount
@@ -207,6 +253,12 @@ func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool) {
 		case opcodeLocal, opcodeSetLocal:
 			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + " " + strconv.Itoa(code.ops[offset+2]) + ")")
 			offset += 3
+		case opcodeCallGlobal, opcodeTailCallGlobal:
+			buf.WriteString(s + " " + Write(constants[code.ops[offset+1]]) + " " + strconv.Itoa(code.ops[offset+2]) + ")")
+			offset += 3
+		case opcodeLocalJumpFalse:
+			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + " " + strconv.Itoa(code.ops[offset+2]) + " " + strconv.Itoa(code.ops[offset+3]) + ")")
+			offset += 4
 		case opcodeClosure:
 			buf.WriteString(s)
 			if pretty {
@@ -228,6 +280,30 @@ func (code *Code) decompileInto(buf *bytes.Buffer, indent string, pretty bool) {
 	buf.WriteString(")")
 }
 
+// opcodeWidth - the number of ints the instruction occupies, including its operands
+func opcodeWidth(op int) int {
+	switch op {
+	case opcodePop, opcodeReturn:
+		return 1
+	case opcodeLocal, opcodeSetLocal, opcodeCallGlobal, opcodeTailCallGlobal:
+		return 3
+	case opcodeLocalJumpFalse:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// hasConstantOperand - true if the instruction's operand is an index into the constants
+func hasConstantOperand(op int) bool {
+	switch op {
+	case opcodeLiteral, opcodeDefGlobal, opcodeUse, opcodeGlobal, opcodeUndefGlobal, opcodeDefMacro, opcodeClosure,
+		opcodeCallGlobal, opcodeTailCallGlobal:
+		return true
+	}
+	return false
+}
+
 func (code *Code) String() string {
 	return code.decompile(true)
 	//	return fmt.Sprintf("(function (%d %v %s) %v)", code.argc, code.defaults, code.keys, code.ops)
@@ -249,8 +325,11 @@ func (code *Code) loadOps(lst *List) error {
 			var name string
 			var defaults []Value
 			var keys []Value
+			var frameSize int
+			var argtypes []Value
+			var result Value
 			var err error
-			if lst, ok := funcParams.(*List); ok && lst.Length() == 4 {
+			if lst, ok := funcParams.(*List); ok && (lst.Length() == 4 || lst.Length() == 5 || lst.Length() == 7) {
 				a := lst.Car
 				lst = lst.Cdr
 				name, err = AsStringValue(a)
@@ -270,13 +349,32 @@ func (code *Code) loadOps(lst *List) error {
 					defaults = v.Elements
 				}
 				a = lst.Car
+				lst = lst.Cdr
 				if v, ok := a.(*Vector); ok {
 					keys = v.Elements
 				}
+				if lst != EmptyList {
+					frameSize, err = AsIntValue(lst.Car)
+					if err != nil {
+						return NewError(SyntaxErrorKey, funcParams)
+					}
+					lst = lst.Cdr
+				}
+				if lst != EmptyList {
+					if v, ok := lst.Car.(*Vector); ok && len(v.Elements) > 0 {
+						argtypes = v.Elements
+					}
+					if t := Cadr(lst); t != Null {
+						result = t
+					}
+				}
 			} else {
 				return NewError(SyntaxErrorKey, funcParams)
 			}
 			fun := MakeCode(argc, defaults, keys, name)
+			fun.frameSize = frameSize
+			fun.argtypes = argtypes
+			fun.result = result
 			fun.loadOps(Cdr(lstFunc))
 			code.emitClosure(fun)
 		case LiteralSymbol:
@@ -334,6 +432,34 @@ func (code *Code) loadOps(lst *List) error {
 				return err
 			}
 			code.emitTailCall(argc)
+		case CallglobalSymbol, TailcallglobalSymbol:
+			sym := Cadr(instr)
+			if !IsSymbol(sym) {
+				return NewError(op, " argument 1 not a symbol: ", sym)
+			}
+			argc, err := AsIntValue(Caddr(instr))
+			if err != nil {
+				return err
+			}
+			if op == CallglobalSymbol {
+				code.emitCallGlobal(sym, argc)
+			} else {
+				code.emitTailCallGlobal(sym, argc)
+			}
+		case LocaljumpfalseSymbol:
+			i, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			j, err := AsIntValue(Caddr(instr))
+			if err != nil {
+				return err
+			}
+			loc, err := AsIntValue(Cadddr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitLocalJumpFalse(i, j, loc)
 		case ReturnSymbol:
 			code.emitReturn()
 		case PopSymbol:
@@ -424,6 +550,23 @@ func (code *Code) emitStruct(slen int) {
 	code.ops = append(code.ops, opcodeStruct)
 	code.ops = append(code.ops, slen)
 }
+func (code *Code) emitCallGlobal(sym Value, argc int) {
+	code.ops = append(code.ops, opcodeCallGlobal)
+	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, argc)
+}
+func (code *Code) emitTailCallGlobal(sym Value, argc int) {
+	code.ops = append(code.ops, opcodeTailCallGlobal)
+	code.ops = append(code.ops, putConstant(sym))
+	code.ops = append(code.ops, argc)
+}
+func (code *Code) emitLocalJumpFalse(i int, j int, offset int) {
+	code.ops = append(code.ops, opcodeLocalJumpFalse)
+	code.ops = append(code.ops, i)
+	code.ops = append(code.ops, j)
+	code.ops = append(code.ops, offset)
+}
+
 func (code *Code) emitUse(sym Value) {
 	code.ops = append(code.ops, opcodeUse)
 	code.ops = append(code.ops, putConstant(sym))
@@ -32,21 +32,28 @@ func Compile(expr Value) (*Code, error) {
 		return nil, err
 	}
 	target.emitReturn()
+	target.optimizeOps(false)
 	return target, nil
 }
 
+// calculateLocation - the frame and slot of the variable. A frame can bind a name more than once, since the variables
+// of a let compiled into the frame follow the ones already in it, and then the last one is the innermost.
 func calculateLocation(sym Value, env *List) (int, int, bool) {
 	i := 0
 	for env != EmptyList {
 		j := 0
+		found := -1
 		ee := env.Car
 		for ee != EmptyList {
 			if Car(ee) == sym {
-				return i, j, true
+				found = j
 			}
 			j++
 			ee = Cdr(ee)
 		}
+		if found >= 0 {
+			return i, found, true
+		}
 		i++
 		env = env.Cdr
 	}
@@ -241,6 +248,20 @@ func compileList(target *Code, env *List, expr Value, isTail bool, ignoreResult
 	default: // a funcall
 		// (<fn>)
 		// (<fn> <arg> ...)
+		if env != EmptyList {
+			if name, vars, inits, body, ok := loopForm(env, lst.(*List)); ok {
+				return compileLoop(target, env, name, vars, inits, body, isTail, ignoreResult, context)
+			}
+			if vars, inits, body, ok := letForm(env, lst.(*List)); ok {
+				return compileLet(target, env, vars, inits, body, isTail, ignoreResult, context)
+			}
+			if lp := loopFor(target, env, fn); lp != nil {
+				return compileLoopCall(target, env, lp, Cdr(lst), context)
+			}
+		}
+		if val, ok := constantLiteral(env, lst); ok {
+			return compileSelfEvalLiteral(target, val, isTail, ignoreResult)
+		}
 		fn, args := fn, Cdr(lst)
 		if optimize {
 			fn, args = optimizeFuncall(fn, args)
@@ -321,6 +342,7 @@ func compileFn(target *Code, env *List, args Value, body *List, isTail bool, ign
 	var syms []Value
 	var defaults []Value
 	var keys []Value
+	var types []Value
 	tmp := args
 	rest := false
 	if !IsSymbol(args) {
@@ -378,6 +400,16 @@ func compileFn(target *Code, env *List, args Value, body *List, isTail bool, ign
 				}
 				tmp = EmptyList
 				break
+			} else if lst, ok := a.(*List); ok && !rest && ListLength(lst) == 2 && IsSymbol(lst.Car) && lst.Car != Intern("&") && IsType(Cadr(lst)) {
+				//i.e. ((x <number>) y) declares the type of the required argument x
+				if _, err := typeExpression(Cadr(lst)); err != nil {
+					return err
+				}
+				for len(types) < argc {
+					types = append(types, AnyType)
+				}
+				types = append(types, Cadr(lst))
+				a = lst.Car
 			} else if !IsSymbol(a) {
 				return NewError(SyntaxErrorKey, tmp)
 			}
@@ -405,11 +437,30 @@ func compileFn(target *Code, env *List, args Value, body *List, isTail bool, ign
 			return NewError(SyntaxErrorKey, tmp)
 		}
 	}
+	if types != nil {
+		for len(types) < argc {
+			types = append(types, AnyType)
+		}
+	}
+	var result Value
+	if ListLength(body) > 1 && IsType(Car(body)) {
+		//i.e. (fn ((x <number>)) <string> ...) declares the type of the result
+		result = Car(body)
+		body = Cdr(body)
+		if _, err := typeExpression(result); err != nil {
+			return err
+		}
+	}
 	args = ListFromValues(syms) //why not just use the vector format in general?
 	newEnv := Cons(args, env)
 	fnCode := MakeCode(argc, defaults, keys, context)
-	err := compileSequence(fnCode, newEnv, body, true, false, context)
+	fnCode.argtypes = types
+	fnCode.result = result
+	var err error
+	//a declared result is checked as the function returns, by the VM, so the body keeps its tail calls
+	err = compileSequence(fnCode, newEnv, body, true, false, context)
 	if err == nil {
+		fnCode.optimizeOps(true)
 		if !ignoreResult {
 			target.emitClosure(fnCode)
 			if isTail {
@@ -493,6 +544,12 @@ func compileIfElse(target *Code, env *List, predicate Value, Consequent Value, a
 	if antecedentOptional != EmptyList {
 		antecedent = Car(antecedentOptional)
 	}
+	if pred, ok := constantValue(env, predicate); ok { //only one branch can be taken
+		if pred != False {
+			return compileExpr(target, env, Consequent, isTail, ignoreResult, context)
+		}
+		return compileExpr(target, env, antecedent, isTail, ignoreResult, context)
+	}
 	err := compileExpr(target, env, predicate, false, false, context)
 	if err != nil {
 		return err
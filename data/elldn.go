@@ -31,6 +31,9 @@ type Reader struct {
 	Input     *bufio.Reader
 	Position  int
 	Extension ReaderExtension
+	Lines     map[*List]int // if not nil, the line (counting from 1) on which each list read starts is recorded here
+	newlines  int
+	last      byte
 }
 
 func (reader *Reader) Read() (Value, error) {
@@ -77,6 +80,10 @@ func (dr *Reader) GetChar() (byte, error) {
 	b, e := dr.Input.ReadByte()
 	if e == nil {
 		dr.Position++
+		dr.last = b
+		if b == '\n' {
+			dr.newlines++
+		}
 	}
 	return b, e
 }
@@ -85,6 +92,10 @@ func (dr *Reader) UngetChar() error {
 	e := dr.Input.UnreadByte()
 	if e == nil {
 		dr.Position--
+		if dr.last == '\n' {
+			dr.newlines--
+		}
+		dr.last = 0
 	}
 	return e
 }
@@ -195,11 +206,16 @@ func (dr *Reader) DecodeString() (Value, error) {
 }
 
 func (dr *Reader) DecodeList() (Value, error) {
+	line := dr.newlines + 1
 	items, err := dr.DecodeSequence(')')
 	if err != nil {
 		return nil, err
 	}
-	return ListFromValues(items), nil
+	lst := ListFromValues(items)
+	if dr.Lines != nil && lst != EmptyList {
+		dr.Lines[lst] = line
+	}
+	return lst, nil
 }
 
 func (dr *Reader) DecodeVector() (Value, error) {
@@ -365,7 +381,6 @@ func (dr *Reader) DecodeAtomString(firstChar byte) (string, error) {
 func (dr *Reader) DecodeType(firstChar byte) (string, error) {
 	var buf []byte
 	if firstChar != '<' {
-		panic("here!")
 		return "", NewError(SyntaxErrorKey, "Invalid type name")
 	}
 	buf = append(buf, firstChar)
@@ -561,9 +576,10 @@ func (writer *Writer) WriteData(o Value, json bool, indent string, indentSize st
 }
 
 func (writer *Writer) WriteVector(vec *Vector, json bool, indent string, indentSize string) (string, error) {
+	el := vec.Snapshot()
 	var buf bytes.Buffer
 	buf.WriteString("[")
-	vlen := len(vec.Elements)
+	vlen := len(el)
 	if vlen > 0 {
 		delim := ""
 		if json {
@@ -577,13 +593,13 @@ func (writer *Writer) WriteVector(vec *Vector, json bool, indent string, indentS
 		} else {
 			delim = delim + " "
 		}
-		s, err := writer.WriteData(vec.Elements[0], json, nextIndent, indentSize)
+		s, err := writer.WriteData(el[0], json, nextIndent, indentSize)
 		if err != nil {
 			return "", err
 		}
 		buf.WriteString(s)
 		for i := 1; i < vlen; i++ {
-			s, err := writer.WriteData(vec.Elements[i], json, nextIndent, indentSize)
+			s, err := writer.WriteData(el[i], json, nextIndent, indentSize)
 			if err != nil {
 				return "", err
 			}
@@ -599,9 +615,10 @@ func (writer *Writer) WriteVector(vec *Vector, json bool, indent string, indentS
 }
 
 func (writer *Writer) WriteStruct(strct *Struct, json bool, indent string, indentSize string) (string, error) {
+	bindings := strct.Snapshot()
 	var buf bytes.Buffer
 	buf.WriteString("{")
-	size := len(strct.Bindings)
+	size := len(bindings)
 	delim := ""
 	sep := " "
 	if json {
@@ -619,7 +636,7 @@ func (writer *Writer) WriteStruct(strct *Struct, json bool, indent string, inden
 		}
 	}
 	first := true
-	for k, v := range strct.Bindings {
+	for k, v := range bindings {
 		if first {
 			first = false
 		} else {
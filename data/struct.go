@@ -17,11 +17,13 @@ package data
 
 import (
 	"bytes"
+	"sync"
 )
 
 type Struct struct {
 	Bindings map[StructKey]Value
 	Error    error
+	mutex    *sync.RWMutex // non-nil if the struct is synchronized
 }
 
 var EmptyStruct *Struct = NewStruct()
@@ -47,12 +49,14 @@ func MakeStruct(fieldvals []Value) (*Struct, error) {
 		switch o.Type() {
 		case StructType: // not a valid key, just copy bindings from it
 			p := o.(*Struct)
+			p.RLock()
 			if bindings == nil {
 				bindings = make(map[StructKey]Value, len(p.Bindings))
 			}
 			for k, v := range p.Bindings {
 				bindings[k] = v
 			}
+			p.RUnlock()
 		case StringType, SymbolType, KeywordType, TypeType:
 			if i == count {
 				return nil, NewError(ArgumentErrorKey, "Mismatched keyword/value in arglist: ", o)
@@ -74,12 +78,69 @@ func MakeStruct(fieldvals []Value) (*Struct, error) {
 	return strct, nil
 }
 
+// Synchronize - make the struct safe to share between goroutines, by locking it in its accessors. This should be
+// done before the struct is shared. Code that uses the Bindings directly should hold the lock, see RLock, or read a
+// Snapshot.
+func (s *Struct) Synchronize() {
+	if s.mutex == nil {
+		s.mutex = new(sync.RWMutex)
+	}
+}
+
+func (s *Struct) IsSynchronized() bool {
+	return s.mutex != nil
+}
+
+// RLock - lock a synchronized struct for reading. Does nothing for unsynchronized structs
+func (s *Struct) RLock() {
+	if s.mutex != nil {
+		s.mutex.RLock()
+	}
+}
+
+func (s *Struct) RUnlock() {
+	if s.mutex != nil {
+		s.mutex.RUnlock()
+	}
+}
+
+// Snapshot - the bindings of the struct. Those of a synchronized struct are copied under its lock, so that they can
+// be read without holding it, by code that may reach the struct, or lock another, through the values.
+func (s *Struct) Snapshot() map[StructKey]Value {
+	if s.mutex == nil {
+		return s.Bindings
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	bindings := make(map[StructKey]Value, len(s.Bindings))
+	for k, v := range s.Bindings {
+		bindings[k] = v
+	}
+	return bindings
+}
+
+// Lock - lock a synchronized struct for writing. Does nothing for unsynchronized structs
+func (s *Struct) Lock() {
+	if s.mutex != nil {
+		s.mutex.Lock()
+	}
+}
+
+func (s *Struct) Unlock() {
+	if s.mutex != nil {
+		s.mutex.Unlock()
+	}
+}
+
 // Equal returns true if the object is equal to the argument
 func (s1 *Struct) Equals(another Value) bool {
 	if s2, ok := another.(*Struct); ok {
-		bindings1 := s1.Bindings
+		if s1 == s2 {
+			return true
+		}
+		bindings1 := s1.Snapshot()
 		size := len(bindings1)
-		bindings2 := s2.Bindings
+		bindings2 := s2.Snapshot()
 		if size == len(bindings2) {
 			for k, v := range bindings1 {
 				v2, ok := bindings2[k]
@@ -104,7 +165,7 @@ func (d *Struct) String() string {
 	var buf bytes.Buffer
 	buf.WriteString("{")
 	first := true
-	for k, v := range d.Bindings {
+	for k, v := range d.Snapshot() {
 		if first {
 			first = false
 		} else {
@@ -150,13 +211,17 @@ func (d *Struct) Value() Value {
 }
 
 func (data *Struct) Length() int {
+	data.RLock()
+	defer data.RUnlock()
 	return len(data.Bindings)
 }
 
 func (strct *Struct) Get(key Value) Value {
 	if IsValidStructKey(key) {
 		k := newStructKey(key)
+		strct.RLock()
 		result, ok := strct.Bindings[k]
+		strct.RUnlock()
 		if ok {
 			return result
 		}
@@ -175,13 +240,17 @@ func (strct *Struct) Put(key Value, val Value) *Struct {
 		//strct.Error = fmt.Errorf("Bad key for struct: %v", key)
 		//I'd like to return an Error, but then the Put method cannot be chained. Unless Value had all methods. Maybe?
 	} else {
+		strct.Lock()
 		strct.Bindings[k] = val
+		strct.Unlock()
 	}
 	return strct
 }
 
 func (strct *Struct) Unput(key Value) *Struct {
 	k := newStructKey(key)
+	strct.Lock()
 	delete(strct.Bindings, k)
+	strct.Unlock()
 	return strct
 }
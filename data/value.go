@@ -28,9 +28,22 @@ func Equal(o1 Value, o2 Value) bool {
 	if o1 == nil || o2 == nil {
 		return false
 	}
+	if len(typeEquality) > 0 {
+		if equal, ok := typeEquality[o1.Type()]; ok {
+			return o1.Type() == o2.Type() && equal(o1, o2)
+		}
+	}
 	return o1.Equals(o2)
 }
 
+var typeEquality = make(map[Value]func(Value, Value) bool)
+
+// SetTypeEquality - compare values of the type with the function, rather than their Equals method. This is meant
+// to be called during initialization, before values are compared.
+func SetTypeEquality(typ Value, equal func(Value, Value) bool) {
+	typeEquality[typ] = equal
+}
+
 var Null Value = &NullValue{}
 
 type NullValue struct {
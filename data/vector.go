@@ -17,10 +17,12 @@ package data
 
 import (
 	"bytes"
+	"sync"
 )
 
 type Vector struct {
 	Elements []Value
+	mutex    *sync.RWMutex // non-nil if the vector is synchronized
 }
 
 var EmptyVector *Vector = VectorFromElementsNoCopy(nil) //NewVector()
@@ -52,8 +54,60 @@ func (v *Vector) Type() Value {
 	return VectorType
 }
 
+// Synchronize - make the vector safe to share between goroutines, by locking it in its accessors. This should be
+// done before the vector is shared. Code that uses the Elements directly should hold the lock, see RLock, or read a
+// Snapshot.
+func (v *Vector) Synchronize() {
+	if v.mutex == nil {
+		v.mutex = new(sync.RWMutex)
+	}
+}
+
+func (v *Vector) IsSynchronized() bool {
+	return v.mutex != nil
+}
+
+// RLock - lock a synchronized vector for reading. Does nothing for unsynchronized vectors
+func (v *Vector) RLock() {
+	if v.mutex != nil {
+		v.mutex.RLock()
+	}
+}
+
+func (v *Vector) RUnlock() {
+	if v.mutex != nil {
+		v.mutex.RUnlock()
+	}
+}
+
+// Snapshot - the elements of the vector. Those of a synchronized vector are copied under its lock, so that they can
+// be read without holding it, by code that may reach the vector, or lock another, through the elements.
+func (v *Vector) Snapshot() []Value {
+	if v.mutex == nil {
+		return v.Elements
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	el := make([]Value, len(v.Elements))
+	copy(el, v.Elements)
+	return el
+}
+
+// Lock - lock a synchronized vector for writing. Does nothing for unsynchronized vectors
+func (v *Vector) Lock() {
+	if v.mutex != nil {
+		v.mutex.Lock()
+	}
+}
+
+func (v *Vector) Unlock() {
+	if v.mutex != nil {
+		v.mutex.Unlock()
+	}
+}
+
 func (v *Vector) String() string {
-	el := v.Elements
+	el := v.Snapshot()
 	var buf bytes.Buffer
 	buf.WriteString("[")
 	count := len(el)
@@ -70,8 +124,11 @@ func (v *Vector) String() string {
 
 func (v1 *Vector) Equals(another Value) bool {
 	if v2, ok := another.(*Vector); ok {
-		el1 := v1.Elements
-		el2 := v2.Elements
+		if v1 == v2 {
+			return true
+		}
+		el1 := v1.Snapshot()
+		el2 := v2.Snapshot()
 		count := len(el1)
 		if count != len(el2) {
 			return false
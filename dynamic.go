@@ -0,0 +1,278 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// winder - a dynamic extent entered by dynamic-wind or parameterize. The list of winders is per VM, and is
+// captured by continuations, so that calling one can leave and re-enter extents as needed.
+type winder struct {
+	before Value        // a thunk called whenever control enters the extent
+	after  Value        // a thunk called whenever control leaves the extent
+	params []*Parameter // parameters rebound during the extent
+	values []Value      // the corresponding values
+	parent *winder
+	depth  int
+}
+
+func (vm *vm) pushWinder(before Value, after Value) {
+	vm.pushExtent(&winder{before: before, after: after})
+}
+
+func (vm *vm) pushExtent(w *winder) {
+	w.parent = vm.winders
+	w.depth = 1
+	if vm.winders != nil {
+		w.depth = vm.winders.depth + 1
+	}
+	vm.winders = w
+}
+
+func commonWinder(w1 *winder, w2 *winder) *winder {
+	for w1 != w2 {
+		if w2 == nil || (w1 != nil && w1.depth > w2.depth) {
+			w1 = w1.parent
+		} else {
+			w2 = w2.parent
+		}
+	}
+	return w1
+}
+
+// rewind - leave the current extents that are not shared with the target (innermost first),
+// then enter the target's extents (outermost first). Each thunk runs with the winders of its outer extent.
+func (vm *vm) rewind(target *winder) error {
+	common := commonWinder(vm.winders, target)
+	for vm.winders != common {
+		w := vm.winders
+		vm.winders = w.parent
+		if w.after != nil {
+			_, err := vm.call(w.after, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	var entering []*winder
+	for w := target; w != common; w = w.parent {
+		entering = append(entering, w)
+	}
+	for i := len(entering) - 1; i >= 0; i-- {
+		w := entering[i]
+		if w.before != nil {
+			_, err := vm.call(w.before, nil)
+			if err != nil {
+				return err
+			}
+		}
+		vm.winders = w
+	}
+	return nil
+}
+
+// unwind - leave extents until the outer one is reached, as when an error escapes the VM.
+// Errors from the after thunks are reported, but do not stop the unwinding.
+func (vm *vm) unwind(outer *winder) {
+	for vm.winders != nil && vm.winders != outer {
+		w := vm.winders
+		vm.winders = w.parent
+		if w.after != nil {
+			_, err := vm.call(w.after, nil)
+			if err != nil {
+				println("; [*** error while unwinding: ", err.Error(), "]")
+			}
+		}
+	}
+}
+
+func ellPushWinder(vm *vm, argv []Value) (Value, error) {
+	if len(argv) != 2 {
+		return nil, argcError("push-winder", 2, 2, len(argv))
+	}
+	for i, thunk := range argv {
+		if thunk.Type() != FunctionType {
+			return nil, NewError(ArgumentErrorKey, "push-winder expected a <function> for argument ", i+1, ", got a ", TypeNameOf(thunk))
+		}
+	}
+	vm.pushWinder(argv[0], argv[1])
+	return Null, nil
+}
+
+func ellPopWinder(vm *vm, argv []Value) (Value, error) {
+	if len(argv) != 0 {
+		return nil, argcError("pop-winder", 0, 0, len(argv))
+	}
+	if vm.winders == nil {
+		return nil, NewError(ErrorKey, "pop-winder: no dynamic extent to leave")
+	}
+	vm.winders = vm.winders.parent
+	return Null, nil
+}
+
+// Parameter - a dynamic variable. Its value can be rebound by parameterize for a dynamic extent, which
+// is private to the VM (and therefore the task) doing it. Outside of any such extent, the value is shared.
+type Parameter struct {
+	mutex     sync.Mutex
+	value     Value
+	converter Value
+}
+
+var topHandlerSymbol = Intern("*top-handler*")
+
+func parameterOf(val Value) *Parameter {
+	if fun, ok := val.(*Function); ok {
+		return fun.parameter
+	}
+	return nil
+}
+
+// NewParameter - create a parameter object, which is a function returning its current value
+func NewParameter(value Value, converter Value) *Function {
+	p := &Parameter{value: value, converter: converter}
+	fun := newIntrinsic("parameter", func(vm *vm, argv []Value) (Value, error) {
+		switch len(argv) {
+		case 0:
+			return vm.parameterValue(p), nil
+		case 1:
+			vm.setParameterValue(p, argv[0])
+			return Null, nil
+		default:
+			return nil, argcError("parameter", 0, 1, len(argv))
+		}
+	}, "(<any>*) <any>")
+	fun.parameter = p
+	return fun
+}
+
+func (vm *vm) parameterBinding(p *Parameter) (*winder, int) {
+	for w := vm.winders; w != nil; w = w.parent {
+		for i, bp := range w.params {
+			if bp == p {
+				return w, i
+			}
+		}
+	}
+	return nil, 0
+}
+
+func (vm *vm) parameterValue(p *Parameter) Value {
+	if w, i := vm.parameterBinding(p); w != nil {
+		return w.values[i]
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.value
+}
+
+func (vm *vm) setParameterValue(p *Parameter, val Value) {
+	if w, i := vm.parameterBinding(p); w != nil {
+		w.values[i] = val
+		return
+	}
+	p.mutex.Lock()
+	p.value = val
+	p.mutex.Unlock()
+}
+
+// globalValue - the value of the global variable, as seen by this VM. Parameters are dereferenced.
+func (vm *vm) globalValue(sym Value) Value {
+	val := GetGlobal(sym)
+	if p := parameterOf(val); p != nil {
+		return vm.parameterValue(p)
+	}
+	return val
+}
+
+// parameterSnapshot - an extent with the parameter bindings currently visible to this VM, for a spawned task to start with.
+// The error handler is not inherited, since its continuation cannot be called from another task.
+func (vm *vm) parameterSnapshot() *winder {
+	snapshot := &winder{depth: 1}
+	handler := parameterOf(GetGlobal(topHandlerSymbol))
+	for w := vm.winders; w != nil; w = w.parent {
+		for i, p := range w.params {
+			if p == handler {
+				continue
+			}
+			if bw, _ := vm.parameterBinding(p); bw == w {
+				snapshot.params = append(snapshot.params, p)
+				snapshot.values = append(snapshot.values, w.values[i])
+			}
+		}
+	}
+	if snapshot.params == nil {
+		return nil
+	}
+	return snapshot
+}
+
+func ellMakeParameter(vm *vm, argv []Value) (Value, error) {
+	argc := len(argv)
+	if argc < 1 || argc > 2 {
+		return nil, argcError("make-parameter", 1, 2, argc)
+	}
+	value := argv[0]
+	converter := Null
+	if argc == 2 {
+		converter = argv[1]
+		if converter.Type() != FunctionType {
+			return nil, NewError(ArgumentErrorKey, "make-parameter expected a <function> for argument 2, got a ", TypeNameOf(converter))
+		}
+		v, err := vm.call(converter, []Value{value})
+		if err != nil {
+			return nil, err
+		}
+		value = v
+	}
+	return NewParameter(value, converter), nil
+}
+
+func ellParameterP(argv []Value) (Value, error) {
+	if parameterOf(argv[0]) != nil {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellPushParameters(vm *vm, argv []Value) (Value, error) {
+	argc := len(argv)
+	if argc%2 != 0 {
+		return nil, NewError(ArgumentErrorKey, "push-parameters expected parameter/value pairs, got ", argc, " arguments")
+	}
+	w := &winder{params: make([]*Parameter, 0, argc/2), values: make([]Value, 0, argc/2)}
+	for i := 0; i < argc; i += 2 {
+		p := parameterOf(argv[i])
+		if p == nil {
+			return nil, NewError(ArgumentErrorKey, "push-parameters expected a parameter for argument ", i+1, ", got ", argv[i])
+		}
+		val := argv[i+1]
+		if p.converter != Null {
+			v, err := vm.call(p.converter, []Value{val})
+			if err != nil {
+				return nil, err
+			}
+			val = v
+		}
+		w.params = append(w.params, p)
+		w.values = append(w.values, val)
+	}
+	vm.pushExtent(w)
+	return Null, nil
+}
@@ -16,7 +16,16 @@ limitations under the License.
 package ell
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "github.com/boynton/ell/data"
 )
@@ -61,3 +70,871 @@ func TestBooleans(t *testing.T) {
 	testType(t, "<boolean>", b1.Type())
 	testType(t, "<boolean>", b2.Type())
 }
+
+var initOnce sync.Once
+
+func testEval(t testing.TB, src string) Value {
+	initOnce.Do(func() { Init() })
+	expr, err := ReadFromString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := Eval(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func testCall(t *testing.T, fn Value, expected Value, args ...Value) {
+	val, err := Call(fn, args...)
+	if err != nil {
+		t.Error("call of", fn, "failed:", err)
+	} else if !Equal(val, expected) {
+		t.Error("call of", fn, "returned", val, "instead of", expected)
+	}
+}
+
+func TestCall(t *testing.T) {
+	testCall(t, testEval(t, "(fn (a b) (- a b))"), Integer(3), Integer(5), Integer(2))
+	testCall(t, testEval(t, "(fn (a [(b 10)]) (+ a b))"), Integer(11), Integer(1))
+	testCall(t, testEval(t, "+"), Integer(3), Integer(1), Integer(2))
+	testCall(t, testEval(t, "apply"), Integer(6), testEval(t, "*"), Integer(2), testEval(t, "'(3)"))
+	testCall(t, testEval(t, "x:"), Integer(23), testEval(t, "{x: 23}"))
+	k := testEval(t, "(callcc (fn (k) k))")
+	testCall(t, k, Integer(7), Integer(7))
+	testEval(t, "(defn test-call-global (s) (string s \"!\"))")
+	val, err := CallGlobal("test-call-global", NewString("hello"))
+	if err != nil || StringValue(val) != "hello!" {
+		t.Error("CallGlobal returned", val, err)
+	}
+	if _, err := CallGlobal("no-such-function-defined"); err == nil {
+		t.Error("CallGlobal of an undefined function should fail")
+	}
+	if _, err := Call(Integer(1)); err == nil {
+		t.Error("a number should not be callable")
+	}
+}
+
+func TestWrapChannel(t *testing.T) {
+	ch := make(chan Value, 1)
+	echo := testEval(t, "(fn (ch) (send ch (+ 1 (recv ch))))")
+	ch <- Integer(41)
+	testCall(t, echo, True, WrapChannel(ch, "go"))
+	if val := <-ch; !Equal(val, Integer(42)) {
+		t.Error("expected 42 back from Ell, got", val)
+	}
+	if ChannelValue(WrapChannel(ch, "go")) != ch {
+		t.Error("ChannelValue should return the wrapped Go channel")
+	}
+}
+
+// a type defined in Go: an angle in degrees, written as #<angle>90, and equal to the same angle plus any number of
+// full turns
+type testAngle struct {
+	degrees int
+}
+
+var testAngleType = Intern("<angle>")
+
+func (a *testAngle) Type() Value {
+	return testAngleType
+}
+
+func (a *testAngle) String() string {
+	return Write(a)
+}
+
+func (a *testAngle) Equals(another Value) bool {
+	return false
+}
+
+func TestDefineType(t *testing.T) {
+	testEval(t, "null")
+	err := DefineType(&ValueType{
+		Name: "<angle>",
+		Read: func(data Value) (Value, error) {
+			if !IsNumber(data) {
+				return nil, NewError(SyntaxErrorKey, "bad angle: ", data)
+			}
+			return &testAngle{IntValue(data)}, nil
+		},
+		Write: func(val Value) Value {
+			return Integer(val.(*testAngle).degrees)
+		},
+		Equal: func(v1, v2 Value) bool {
+			return (v1.(*testAngle).degrees-v2.(*testAngle).degrees)%360 == 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DefineType(&ValueType{Name: "angle"}); err == nil {
+		t.Error("DefineType should reject a bad type name")
+	}
+	a := testEval(t, "'#<angle>90")
+	if p, ok := a.(*testAngle); !ok || p.degrees != 90 {
+		t.Fatal("reader did not construct an angle:", a)
+	}
+	if s := Write(a); s != "#<angle>90" {
+		t.Error("angle written as", s)
+	}
+	testType(t, "<angle>", testEval(t, "(type '#<angle>90)"))
+	testIdentical(t, True, testEval(t, "(equal? '#<angle>90 '#<angle>450)"))
+	testIdentical(t, True, testEval(t, "(equal? (list '#<angle>0) (list '#<angle>-360))"))
+	testIdentical(t, False, testEval(t, "(equal? '#<angle>90 '#<angle>180)"))
+	if _, err := ReadFromString("#<angle>\"ninety\""); err == nil {
+		t.Error("the angle reader should reject a string")
+	}
+	if v := testEval(t, "'#<something>{x: 1}"); v.Type() != Intern("<something>") {
+		t.Error("unregistered types should still read as instances, got", v)
+	}
+}
+
+func TestReadConnection(t *testing.T) {
+	testEval(t, "null")
+	src := "#<connection>{endpoint: \"localhost:1\" remote: \"127.0.0.1:1\"}"
+	val, err := ReadFromString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := val.(*Connection)
+	if !ok {
+		t.Fatal("expected a connection, got", val)
+	}
+	if c.Con != nil {
+		t.Error("reading a connection should not connect it")
+	}
+	if s := Write(c); !strings.Contains(s, `endpoint: "localhost:1"`) || !strings.Contains(s, `remote: "127.0.0.1:1"`) {
+		t.Error("connection written as", s)
+	}
+}
+
+func TestDefineReaderMacro(t *testing.T) {
+	testEval(t, "null")
+	err := DefineReaderMacro('%', func(r *Reader) (Value, error) {
+		val, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		return NewList(Intern("*"), val, val), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DefineReaderMacro('\\', nil); err == nil {
+		t.Error("built in reader macros should not be redefinable")
+	}
+	if v := testEval(t, "(+ 1 #%7)"); !Equal(v, Integer(50)) {
+		t.Error("expected 50 from the reader macro, got", v)
+	}
+}
+
+func testError(t *testing.T, src string, key Value) {
+	expr, err := ReadFromString(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Eval(expr)
+	if e, ok := err.(*Error); !ok || e.Data.(*Vector).Elements[0] != key {
+		t.Error("expected a", key, "from", src, "got", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	testEval(t, "null")
+	defer SetCapabilities(AllCapabilities)
+	dir := t.TempDir()
+	if err := SpitFile(filepath.Join(dir, "data.txt"), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetCapabilities(Capabilities{Filesystem: FilesystemReadOnly, Root: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if s := testEval(t, `(slurp "/data.txt")`); StringValue(s) != "hello" {
+		t.Error("expected to read the file in the root directory, got", s)
+	}
+	testEval(t, `(use ell)`)
+	testError(t, `(spit "out.txt" "no")`, PermissionErrorKey)
+	testError(t, `(getenv "HOME")`, PermissionErrorKey)
+	testError(t, `(connect "localhost" 80)`, PermissionErrorKey)
+	testError(t, `(listen 0)`, PermissionErrorKey)
+	if err := SpitFile(filepath.Join(dir, "capmod.ell"), `(def capmod-data (slurp "/data.txt"))`); err != nil {
+		t.Fatal(err)
+	}
+	if s := testEval(t, `(do (use capmod) capmod-data)`); StringValue(s) != "hello" {
+		t.Error("expected the module to be found and run with the capabilities of the code using it, got", s)
+	}
+	SetCapabilities(Capabilities{Filesystem: FilesystemNone, Network: true, Environment: true})
+	testError(t, `(slurp "/data.txt")`, PermissionErrorKey)
+	testError(t, `(load "anything")`, PermissionErrorKey)
+	if err := SpitFile(filepath.Join(dir, "host.txt"), "host"); err != nil {
+		t.Error("expected Go code to be unrestricted, got", err)
+	}
+	if s, err := SlurpFile(filepath.Join(dir, "host.txt")); err != nil || s != "host" {
+		t.Error("expected Go code to be unrestricted, got", s, err)
+	}
+	spawned := testEval(t, `(let ((gate (channel bufsize: 1))) (list gate (spawn (fn () (recv gate) (slurp "/data.txt")))))`)
+	SetCapabilities(AllCapabilities)
+	SendChannel(Car(spawned), True, -1)
+	task := Cadr(spawned).(*Task)
+	task.Wait(-1)
+	if e, ok := task.err.(*Error); !ok || e.Data.(*Vector).Elements[0] != PermissionErrorKey {
+		t.Error("expected the task to keep the capabilities of the evaluation that spawned it, got", task.err)
+	}
+	SetCapabilities(AllCapabilities)
+	if s := testEval(t, `(slurp "`+filepath.Join(dir, "data.txt")+`")`); StringValue(s) != "hello" {
+		t.Error("expected full access again, got", s)
+	}
+}
+
+func TestAllocationLimit(t *testing.T) {
+	testEval(t, "null")
+	SetAllocationLimit(1000000)
+	defer SetAllocationLimit(0)
+	if n := testEval(t, `(length (make-vector 1000))`); IntValue(n) != 1000 {
+		t.Error("expected a small allocation to succeed, got", n)
+	}
+	testError(t, `(make-vector 100000000)`, ResourceErrorKey)
+	testError(t, `(make-blob 100000000)`, ResourceErrorKey)
+	testError(t, `(to-string (make-vector 50000 "abcdefghijklmnopqrst"))`, ResourceErrorKey)
+	testError(t, `(json (make-vector 50000 "abcdefghijklmnopqrst"))`, ResourceErrorKey)
+	testError(t, `(make-vector2 20000000 0)`, ResourceErrorKey)
+	testError(t, `(write-all (list (make-vector 40000 "abcdefghijklmnopqrst")))`, ResourceErrorKey)
+	big := filepath.Join(t.TempDir(), "big.txt")
+	if err := SpitFile(big, strings.Repeat("x", 2000000)); err != nil {
+		t.Fatal(err)
+	}
+	testError(t, `(slurp "`+big+`")`, ResourceErrorKey)
+	testError(t, `(letrec ((grow (fn (l) (grow (cons 1 l))))) (grow '()))`, ResourceErrorKey)
+	testError(t, `(catch (make-vector 100000000) (fn (e) 'caught))`, ResourceErrorKey)
+	SetAllocationLimit(0)
+	if n := testEval(t, `(length (make-vector 100000))`); IntValue(n) != 100000 {
+		t.Error("expected no limit, got", n)
+	}
+}
+
+func TestImage(t *testing.T) {
+	testEval(t, `(def image-counter (let ((n 0)) (fn () (set! n (+ n 1)) n)))`)
+	testEval(t, `(def image-shared [1 2 3])`)
+	testEval(t, `(def image-data {a: image-shared b: image-shared})`)
+	testEval(t, `(defmacro image-twice (x) (list '* x 2))`)
+	testEval(t, `(image-counter)`)
+	img, err := EncodeImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEval(t, `(def image-counter null)`)
+	testEval(t, `(undef image-data)`)
+	if err := DecodeImage(img); err != nil {
+		t.Fatal(err)
+	}
+	if n := testEval(t, `(image-counter)`); IntValue(n) != 2 {
+		t.Error("expected the closure's state to be restored, got", n)
+	}
+	if b := testEval(t, `(identical? (a: image-data) (b: image-data))`); b != True {
+		t.Error("expected shared structure to be preserved")
+	}
+	if n := testEval(t, `(image-twice 21)`); IntValue(n) != 42 {
+		t.Error("expected the macro to be restored, got", n)
+	}
+	testEval(t, `(def image-channel (channel))`)
+	defer testEval(t, `(undef image-channel)`)
+	if _, err := EncodeImage(); err == nil {
+		t.Error("expected an error saving a channel")
+	}
+	if err := DecodeImage([]byte("not an image")); err == nil {
+		t.Error("expected an error loading a bad image")
+	}
+}
+
+func TestCorruptImage(t *testing.T) {
+	testEval(t, `(def corrupt-image-fn (fn (x) (+ x 1)))`)
+	data, err := EncodeImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptions := map[string]func(img *imageFile){
+		"reference": func(img *imageFile) {
+			for i := range img.Objects {
+				if len(img.Objects[i].Refs) > 0 {
+					img.Objects[i].Refs[0] = len(img.Objects) + 10
+					return
+				}
+			}
+		},
+		"global": func(img *imageFile) { img.Globals[1] = -1 },
+		"code": func(img *imageFile) {
+			for i := range img.Objects {
+				if img.Objects[i].Kind == imageCode {
+					img.Objects[i].Ints[1] = 1000
+					return
+				}
+			}
+		},
+		"instruction": func(img *imageFile) {
+			for i := range img.Objects {
+				if img.Objects[i].Kind == imageCode {
+					img.Objects[i].Ints = append(img.Objects[i].Ints, opcodeLiteral)
+					return
+				}
+			}
+		},
+	}
+	for what, corrupt := range corruptions {
+		img, err := decodeImage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupt(img)
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(img); err != nil {
+			t.Fatal(err)
+		}
+		if err := DecodeImage(buf.Bytes()); err == nil {
+			t.Error("expected an error loading an image with a bad", what)
+		}
+	}
+}
+
+func TestCompiledModule(t *testing.T) {
+	testEval(t, "null")
+	dir := t.TempDir()
+	source := filepath.Join(dir, "cached.ell")
+	compiled := filepath.Join(dir, "cached.lvm")
+	if err := SpitFile(source, `(defmacro cached-double (x) (list '* x 2)) (defn cached-value () (cached-double 21))`); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFile(source); err != nil {
+		t.Fatal(err)
+	}
+	if !IsFileReadable(compiled) {
+		t.Fatal("expected the compiled module to be saved")
+	}
+	testEval(t, `(undef cached-value)`)
+	if err := LoadFile(source); err != nil {
+		t.Fatal(err)
+	}
+	if n := testEval(t, `(cached-value)`); IntValue(n) != 42 {
+		t.Error("expected the compiled module to define cached-value, got", n)
+	}
+	if _, err := readCompiledModule(compiled, sourceHash("something else")); err == nil {
+		t.Error("expected a compiled module with a different source hash to be out of date")
+	}
+	if err := SpitFile(source, `(defn cached-value () 7)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFile(source); err != nil {
+		t.Fatal(err)
+	}
+	if n := testEval(t, `(cached-value)`); IntValue(n) != 7 {
+		t.Error("expected the changed source to be recompiled, got", n)
+	}
+}
+
+func TestCompiledModuleKey(t *testing.T) {
+	testEval(t, "null")
+	dir := t.TempDir()
+	used := filepath.Join(dir, "cachedmacros.ell")
+	source := filepath.Join(dir, "cacheduser.ell")
+	testEval(t, `(def *load-path* "`+dir+`")`)
+	defer testEval(t, `(def *load-path* ".")`)
+	if err := SpitFile(used, `(defmacro cached-twice (x) (list '* x 2))`); err != nil {
+		t.Fatal(err)
+	}
+	if err := SpitFile(source, `(use cachedmacros) (defn cached-user () (cached-twice 21))`); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFile(source); err != nil {
+		t.Fatal(err)
+	}
+	if n := testEval(t, `(cached-user)`); IntValue(n) != 42 {
+		t.Fatal("expected 42, got", n)
+	}
+	if err := SpitFile(used, `(defmacro cached-twice (x) (list '+ x 2))`); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadFile(source); err != nil {
+		t.Fatal(err)
+	}
+	if n := testEval(t, `(cached-user)`); IntValue(n) != 23 {
+		t.Error("expected a change to a used module's macro to recompile the module, got", n)
+	}
+	key := moduleKey(`(defn f () 1)`)
+	optimize = true
+	defer func() { optimize = false }()
+	if moduleKey(`(defn f () 1)`) == key {
+		t.Error("expected the module key to depend on the optimize flag")
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	fun := testEval(t, "(defn peephole-test (x) (if x (inc (inc x)) (peephole-test 1)))").(*Function)
+	ops := fun.code.decompile(false)
+	for _, op := range []string{"callglobal", "tailcallglobal", "localjumpfalse"} {
+		if !strings.Contains(ops, "("+op+" ") {
+			t.Errorf("expected the compiled code to use %s: %s", op, ops)
+		}
+	}
+	if n := testEval(t, "(peephole-test false)"); IntValue(n) != 3 {
+		t.Error("expected (peephole-test false) to be 3, got", n)
+	}
+	testError(t, "(peephole-undefined 1)", ErrorKey)
+}
+
+func TestConstantFolding(t *testing.T) {
+	folded := func(src string) string {
+		return testEval(t, src).(*Function).code.decompile(false)
+	}
+	if ops := folded(`(fn () (string "a" (+ 1 (* 2 3))))`); !strings.Contains(ops, `(literal "a7")`) || strings.Contains(ops, "call") {
+		t.Error("expected the pure primitive calls to be folded:", ops)
+	}
+	if ops := folded(`(fn () (if (> 2 1) 'yes (launch-missiles)))`); strings.Contains(ops, "jump") || strings.Contains(ops, "launch-missiles") {
+		t.Error("expected the dead branch to be eliminated:", ops)
+	}
+	if ops := folded(`(fn () (vector-length [1 "two" {three: 'four}]))`); !strings.Contains(ops, "(literal 3)") {
+		t.Error("expected the call with a constant vector to be folded:", ops)
+	}
+	testEval(t, `(defn folded-vector () [0 0 0])`)
+	if v := testEval(t, `(do (vector-set! (folded-vector) 0 99) (folded-vector))`); Write(v) != "[0 0 0]" {
+		t.Error("expected each evaluation of a vector literal to make a new vector, got", v)
+	}
+	testEval(t, `(defn folded-struct () {x: 1})`)
+	if v := testEval(t, `(do (put! (folded-struct) x: 2) (folded-struct))`); Write(v) != "{x: 1}" {
+		t.Error("expected each evaluation of a struct literal to make a new struct, got", v)
+	}
+	if ops := folded(`(fn (+) (+ 1 2))`); !strings.Contains(ops, "tailcall") {
+		t.Error("expected a call of a local variable not to be folded:", ops)
+	}
+	if ops := folded(`(fn () (car 1))`); !strings.Contains(ops, "tailcallglobal car") {
+		t.Error("expected a call that fails not to be folded:", ops)
+	}
+	testError(t, `(car 1)`, ArgumentErrorKey)
+}
+
+func TestLetInFrame(t *testing.T) {
+	compiled := func(src string) string {
+		return testEval(t, src).(*Function).code.decompile(false)
+	}
+	if ops := compiled(`(fn (n) (let ((total 0)) (dorange (i n) (set! total (+ total i))) total))`); strings.Contains(ops, "closure") || !strings.Contains(ops, "(jump -") {
+		t.Error("expected the lets to be compiled into the frame, and the loop to jump back:", ops)
+	}
+	if ops := compiled(`(fn (n) (let ((x n)) (fn () x)))`); !strings.Contains(ops, "closure") {
+		t.Error("expected a let whose variables are captured to be compiled as a call:", ops)
+	}
+	testEval(t, `(defn frame-square (x) (if (< x 0) (frame-square (- x)) (* x x)))`)
+	if ops := compiled(`(fn (n) (let ((total 0)) (dorange (i n) (set! total (+ total (frame-square i)))) total))`); strings.Contains(ops, "closure") || !strings.Contains(ops, "(jump -") {
+		t.Error("expected a loop calling a function that cannot capture a continuation to be compiled into the frame:", ops)
+	}
+	testEval(t, `(defn frame-grab () (frame-square (callcc (fn (k) 1))))`)
+	if ops := compiled(`(fn (n) (let ((total 0)) (dorange (i n) (set! total (+ total (frame-grab)))) total))`); !strings.Contains(ops, "closure") {
+		t.Error("expected a loop calling a function that calls callcc to be compiled as a call:", ops)
+	}
+	if n := testEval(t, `((fn (n) (let loop ((i 0) (acc 0)) (if (< i n) (loop (inc i) (+ acc i)) acc))) 10)`); IntValue(n) != 45 {
+		t.Error("expected the loop to sum to 45, got", n)
+	}
+}
+
+func TestTypedFunction(t *testing.T) {
+	testEval(t, `(defn typed-label ((n <number>) suffix) <string> (if (> n 0) (string n suffix) n))`)
+	if sig := testEval(t, `(function-signature typed-label)`); StringValue(sig) != "(<number> <any>) <string>" {
+		t.Error("expected the declared types in the signature, got", sig)
+	}
+	if s := testEval(t, `(typed-label 3 "x")`); StringValue(s) != "3x" {
+		t.Error("expected 3x, got", s)
+	}
+	if err := testEval(t, `(catch (typed-label "3" "x"))`); !strings.Contains(err.String(), "typed-label expected a <number> for argument 1") {
+		t.Error("expected an argument type error, got", err)
+	}
+	if err := testEval(t, `(catch (typed-label 0 "x"))`); !strings.Contains(err.String(), "typed-label expected to return a <string>") {
+		t.Error("expected a result type error, got", err)
+	}
+	for _, opt := range []bool{false, true} {
+		optimize = opt
+		fun := testEval(t, `(defn typed-even? ((n <number>)) <boolean> (if (= n 0) true (typed-odd? (dec n))))`).(*Function)
+		testEval(t, `(defn typed-odd? ((n <number>)) <boolean> (if (= n 0) false (typed-even? (dec n))))`)
+		if ops := fun.code.decompile(false); !strings.Contains(ops, "(tailcallglobal typed-odd? 1)") {
+			t.Error("expected a function with a declared result to keep its tail calls:", ops)
+		}
+		if b := testEval(t, `(typed-even? 100001)`); b != False {
+			t.Error("expected false, got", b)
+		}
+		testEval(t, `(defn typed-tail ((n <number>)) <string> (inc n))`)
+		if err := testEval(t, `(catch (typed-tail 1))`); !strings.Contains(err.String(), "typed-tail expected to return a <string>") {
+			t.Error("expected a result type error for a tail call, got", err)
+		}
+		testEval(t, `(defn typed-relay ((n <number>)) <string> (typed-even? n))`)
+		if err := testEval(t, `(catch (typed-relay 4))`); !strings.Contains(err.String(), "typed-relay expected to return a <string>, got a boolean") {
+			t.Error("expected a result type error after the callee returned, got", err)
+		}
+	}
+	optimize = false
+}
+
+func TestLint(t *testing.T) {
+	testEval(t, "null")
+	dir := t.TempDir()
+	source := filepath.Join(dir, "linted.ell")
+	if err := SpitFile(filepath.Join(dir, "linthelper.ell"), `(defn lint-helper (a) a)`); err != nil {
+		t.Fatal(err)
+	}
+	testEval(t, `(def *load-path* "`+dir+`")`)
+	defer testEval(t, `(def *load-path* ".")`)
+	text := `(defn lint-area (w h)
+  (* w h))
+
+(defn lint-report (shape _unused)
+  (let ((a (lint-area shape))
+        (b 2))
+    (pritnln "area: " a)
+    (list-length 1 2)))
+
+(defmacro lint-twice (x) (list '* x 2))
+(defn car (x) (lint-twice x))
+(use linthelper)
+(lint-helper 1 2)
+`
+	if err := SpitFile(source, text); err != nil {
+		t.Fatal(err)
+	}
+	warnings, err := Lint(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, w := range warnings {
+		got = append(got, fmt.Sprintf("%d: %s", w.Line, w.Message))
+	}
+	expected := []string{
+		"5: unused let binding: b",
+		"5: wrong number of arguments to lint-area: expected 2 arguments, got 1",
+		"7: undefined symbol: pritnln",
+		"8: wrong number of arguments to list-length: expected 1 argument, got 2",
+		"13: wrong number of arguments to lint-helper: expected 1 argument, got 2",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if n := testEval(t, `(car '(1 2))`); IntValue(n) != 1 {
+		t.Error("expected linting not to define the file's functions, got", n)
+	}
+	if GetMacro(Intern("lint-twice")) != nil {
+		t.Error("expected linting not to define the file's macros")
+	}
+	if GetGlobal(Intern("lint-helper")) != nil {
+		t.Error("expected linting not to define the functions of the modules the file uses")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	testEval(t, "null")
+	source := filepath.Join(t.TempDir(), "checked.ell")
+	text := `(defstruct checked-shape name: <string> sides: <number>)
+
+(defn checked-size ((s <checked-shape>))
+  (let ((n (sides: s)))
+    (string-length n)))
+
+(defn checked-first (v)
+  (if (vector? v) (car [1 2]) (colour: (checked-shape name: 4 sides: 3))))
+
+(defn checked-name () <symbol> (checked-label))
+(defn checked-label () "a")
+`
+	if err := SpitFile(source, text); err != nil {
+		t.Fatal(err)
+	}
+	warnings, err := Check(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, w := range warnings {
+		got = append(got, fmt.Sprintf("%d: %s", w.Line, w.Message))
+	}
+	expected := []string{
+		"5: string-length expected a <string> for argument 1, got a <number>",
+		"8: car expected a <list> for argument 1, got a <vector>",
+		"8: <checked-shape> expected a <string> for field name:, got a <number>",
+		"8: <checked-shape> has no field colour:",
+		"10: checked-name expected to return a <symbol>, got a <string>",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected the warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestBuildGo(t *testing.T) {
+	testEval(t, "null")
+	source := filepath.Join(t.TempDir(), "built.ell")
+	text := `(defn built-add (a b) (+ a b))
+(defn built-adder (n) (fn (x) (built-add x n)))
+(defn built-sum (& xs) (apply + xs))
+`
+	if err := SpitFile(source, text); err != nil {
+		t.Fatal(err)
+	}
+	src, notes, err := BuildGo(source, "built")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"package built", "func f_built_2dadd(vm ell.Context, l0, l1 Value)", "func f_built_2dadder_fn1(vm ell.Context, up *ell.Frame, l0 Value)", "return ell.TailCallFunction(p_built_2dadd, s1, s0)"} {
+		if !strings.Contains(src, s) {
+			t.Errorf("expected the generated Go to contain %q", s)
+		}
+	}
+	if len(notes) != 1 || notes[0] != "built-sum: not compiled to Go: it has optional, rest, or keyword arguments" {
+		t.Error("expected a note that built-sum is left as byte code, got", notes)
+	}
+	thunks, hash, err := compileModule(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := encodeModule(hash, thunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k []Value
+	add := func(vm Context, argv []Value) (Value, error) {
+		return NewString("linked"), nil
+	}
+	RegisterModule("built-linked", code, &GoFunction{Name: "built-add", Fun: add, Constants: &k})
+	if s := testEval(t, `(do (use built-linked) (built-add 1 2))`); !Equal(s, NewString("linked")) {
+		t.Error("expected the use of a linked module to bind its functions to Go, got", s)
+	}
+	if len(k) == 0 {
+		t.Error("expected the constants of the linked function to be set")
+	}
+	if n := testEval(t, `((built-adder 2) 3)`); !Equal(n, NewString("linked")) {
+		t.Error("expected the linked module's byte code to call the Go function, got", n)
+	}
+}
+
+// TestBuildGoProgram builds a program linked with a module compiled to Go, and runs it
+func TestBuildGoProgram(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a Go program")
+	}
+	goCmd, err := osexec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not installed")
+	}
+	testEval(t, "null")
+	repo, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	source := filepath.Join(dir, "evenodd.ell")
+	text := `(defn ev? (n) (if (= n 0) true (od? (dec n))))
+(defn od? (n) (if (= n 0) false (ev? (dec n))))
+(defn parity (n) <string> (if (ev? n) "even" (od-name n)))
+(defn od-name (n) <string> (if (od? n) "odd" n))
+(defn bad-parity (n) <string> (ev? n))
+(def depth (make-parameter 1))
+(defn get-depth () (depth))
+(defn spin (n) (spin (inc n)))
+(defn grow (n acc) (if (= n 0) (length acc) (grow (dec n) (cons [n] acc))))
+`
+	if err := SpitFile(source, text); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildGoPackage(source, filepath.Join(dir, "evenodd")); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := SlurpFile(filepath.Join(repo, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod = strings.Replace(mod, "module github.com/boynton/ell", "module evenoddtest", 1)
+	mod += "\nrequire github.com/boynton/ell v0.0.0\n\nreplace github.com/boynton/ell => " + repo + "\n"
+	sum, err := SlurpFile(filepath.Join(repo, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := `package main
+
+import (
+	"fmt"
+	"os"
+
+	"evenoddtest/evenodd"
+	"github.com/boynton/ell"
+)
+
+func main() {
+	ell.Init(evenodd.Extension)
+	for _, src := range os.Args[1:] {
+		if src == "--maxalloc" {
+			ell.SetAllocationLimit(100000)
+			continue
+		}
+		expr, err := ell.ReadFromString(src)
+		if err == nil {
+			expr, err = ell.Eval(expr)
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(expr)
+		}
+	}
+}
+`
+	for file, text := range map[string]string{"go.mod": mod, "go.sum": sum, "main.go": main} {
+		if err := SpitFile(filepath.Join(dir, file), text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := osexec.Command(goCmd, "run", ".", "(use evenodd)", "(ev? 10000000)", "(parity 1000001)", "(bad-parity 7)",
+		"(parameterize ((depth 2)) (get-depth))",
+		"(let ((task (spawn spin 0))) (sleep 0.1) (task-cancel task) (task-wait task 1) (task-status task))",
+		"--maxalloc", "(grow 100000 '())")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	expected := "evenodd\ntrue\nodd\n#<error>[error: bad-parity expected to return a <string>, got a boolean]\n" +
+		"2\ncancelled:\n#<error>[resource-error: allocation limit of 100000 bytes exceeded]\n"
+	if string(out) != expected {
+		t.Errorf("expected the program to print %q, got %q", expected, string(out))
+	}
+}
+
+// hookValue - a value that runs its hook when it is compared
+type hookValue struct {
+	hook func()
+}
+
+func (h *hookValue) Type() Value {
+	return Intern("<hook>")
+}
+
+func (h *hookValue) String() string {
+	return "#[hook]"
+}
+
+func (h *hookValue) Equals(another Value) bool {
+	if h.hook != nil {
+		h.hook()
+	}
+	return true
+}
+
+// TestSynchronizedEqual checks that comparing synchronized structs and vectors holds no lock while their contents are
+// compared, so that a writer waiting for the lock cannot deadlock a comparison that reads them again
+func TestSynchronizedEqual(t *testing.T) {
+	s := NewStruct()
+	v := NewVector(Zero)
+	h := &hookValue{}
+	s.Put(Intern("k:"), h)
+	v.Elements[0] = h
+	s.Synchronize()
+	v.Synchronize()
+	h.hook = func() {
+		go s.Put(Intern("w:"), One)
+		go func() {
+			v.Lock()
+			v.Elements[0] = h
+			v.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		_ = s.String() + v.String()
+	}
+	s2, _ := MakeStruct([]Value{Intern("k:"), &hookValue{}})
+	v2 := NewVector(&hookValue{})
+	done := make(chan bool)
+	go func() {
+		Equal(s, s2)
+		Equal(v, v2)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("comparing synchronized values deadlocked")
+	}
+}
+
+func TestBundle(t *testing.T) {
+	testEval(t, "null")
+	dir := t.TempDir()
+	script := filepath.Join(dir, "bundled.ell")
+	helper := filepath.Join(dir, "bundled-helper.ell")
+	if err := SpitFile(helper, `(defn bundled-greeting () "hello")`); err != nil {
+		t.Fatal(err)
+	}
+	text := `(use bundled-helper)
+(def bundled-result null)
+(defn main (args) (set! bundled-result (cons (bundled-greeting) args)))
+`
+	if err := SpitFile(script, text); err != nil {
+		t.Fatal(err)
+	}
+	AddEllDirectory(dir)
+	output := filepath.Join(dir, "bundled")
+	if err := Bundle(script, output); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := findBundle(f, info.Size())
+	if err != nil || b == nil {
+		t.Fatal("expected the executable to have a bundle, got", err)
+	}
+	if _, ok := b.Modules["bundled-helper"]; !ok || b.Script != "bundled" || len(b.Modules) != 2 {
+		t.Fatal("expected the bundle to have the script and the module it uses, got", b.Script, len(b.Modules))
+	}
+	testEval(t, `(undef bundled-greeting)`)
+	os.Remove(helper)
+	if err := runBundle(b, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if r := testEval(t, `bundled-result`); Write(r) != `("hello" "a" "b")` {
+		t.Error("expected main to be called with the arguments, got", r)
+	}
+}
+
+// The benchmarks are the workloads of lib/bench.ell: building a list with dorange, sorting it, and computing digits
+// of pi with lib/pi.ell.
+
+const benchMakeList = `(defn bench-make-list (n) (let ((tmp '())) (dorange (i n) (set! tmp (cons i tmp))) (reverse tmp)))`
+
+func BenchmarkMakeList(b *testing.B) {
+	testEval(b, benchMakeList)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		testEval(b, `(bench-make-list 20000)`)
+	}
+}
+
+func BenchmarkSort(b *testing.B) {
+	testEval(b, `(use sort)`)
+	testEval(b, benchMakeList)
+	testEval(b, `(def bench-list (bench-make-list 20000))`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		testEval(b, `(sort bench-list <)`)
+		testEval(b, `(sort bench-list >)`)
+	}
+}
+
+func BenchmarkPi(b *testing.B) {
+	testEval(b, `(use pi)`)
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer func() { os.Stdout = stdout }()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		testEval(b, `(pi 200 5)`)
+	}
+}
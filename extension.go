@@ -0,0 +1,113 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// Extension - a Go package that adds to Ell. Init is called by ell.Init, after the primitives are defined, and is
+// where the extension defines its functions, types, and reader macros.
+type Extension interface {
+	Init() error
+	Cleanup()
+	String() string
+}
+
+var extensions []Extension
+
+// ValueType - how values of a type defined in Go are named, read, written, and compared. The values themselves
+// implement Value, and their Type method returns the interned Name.
+type ValueType struct {
+	Name  string                          // the type name, i.e. "<connection>"
+	Read  func(data Value) (Value, error) // makes a value from the data read after #<name>. If nil, the type is not readable
+	Write func(val Value) Value           // the data written after #<name>, which Read makes back into an equal value
+	Equal func(v1, v2 Value) bool         // for equal?. If nil, the values' Equals method is used
+}
+
+var valueTypes = make(map[Value]*ValueType)
+
+// DefineType - register a value type, so that values of it are written as #<name>data, and #<name>data in the
+// reader is made into a value by the type's Read function.
+func DefineType(vt *ValueType) error {
+	if !IsValidTypeName(vt.Name) {
+		return NewError(ArgumentErrorKey, "DefineType: not a valid type name: ", vt.Name)
+	}
+	tag := Intern(vt.Name)
+	valueTypes[tag] = vt
+	if vt.Equal != nil {
+		SetTypeEquality(tag, vt.Equal)
+	}
+	return nil
+}
+
+// ReaderMacro - reads the value for #c, where c is the character the macro is defined for. The reader is positioned
+// just after c.
+type ReaderMacro func(r *Reader) (Value, error)
+
+var readerMacros = make(map[byte]ReaderMacro)
+
+// DefineReaderMacro - define the meaning of #c in the reader. The built in ones (#\, #!, #[, and #<) cannot be
+// redefined.
+func DefineReaderMacro(c byte, macro ReaderMacro) error {
+	switch c {
+	case '\\', '!', '[', '<':
+		return NewError(ArgumentErrorKey, "DefineReaderMacro: cannot redefine #", string(c))
+	}
+	readerMacros[c] = macro
+	return nil
+}
+
+// readInstance - read #<type>data, with the type's own constructor if it has one
+func readInstance(r *Reader) (Value, error) {
+	name, err := r.DecodeType('<')
+	if err != nil {
+		return nil, err
+	}
+	if !IsValidTypeName(name) {
+		return nil, NewError(SyntaxErrorKey, "Bad reader macro: #", name, " ...")
+	}
+	tag := Intern(name)
+	data, err := r.ReadValue()
+	if err != nil {
+		return nil, NewError(SyntaxErrorKey, "Bad reader macro: #", name, " ...")
+	}
+	if vt, ok := valueTypes[tag]; ok {
+		if vt.Read == nil {
+			return nil, NewError(SyntaxErrorKey, "Unreadable object: #", name, data)
+		}
+		return vt.Read(data)
+	}
+	return NewInstance(tag, data)
+}
+
+// writeValue - the external representation of a value of a registered type, if it has one
+func writeValue(w *Writer, val Value) (string, error, bool) {
+	if len(valueTypes) == 0 {
+		return "", nil, false
+	}
+	vt, ok := valueTypes[val.Type()]
+	if !ok || vt.Write == nil {
+		return "", nil, false
+	}
+	data := vt.Write(val)
+	s, err := w.WriteData(data, w.Json, "", "")
+	if err != nil || w.Json {
+		return s, err, true
+	}
+	return "#" + vt.Name + s, nil, true
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// Constant folding. An expression is constant if its value can be known when it is compiled: a literal, a quoted
+// datum, a vector or struct literal of constants, an if with a constant predicate and a constant result, or a call of a
+// pure primitive with constant arguments. A pure primitive has no side effects, and its result depends only on its
+// arguments and shares no mutable state with them. The call is made when the code is compiled, using the primitive
+// the global names at that time. If it fails, the call is left to fail when the code is run. Vectors and structs are
+// mutable, so a constant one is only compiled to a literal if it is quoted: otherwise each evaluation makes its own.
+
+// purePrimitives - the primitives that can be called when the code is compiled
+var purePrimitives = []string{
+	"boolean?", "not", "equal?", "null?", "type", "type?", "conforms?", "type-name",
+	"keyword?", "keyword-name", "to-keyword", "symbol?", "symbol",
+	"string?", "string", "to-string", "string-length", "join", "character?", "to-character", "substring",
+	"blob?", "blob-length", "blob-ref",
+	"number?", "int?", "float?", "to-number", "int", "floor", "ceiling", "inc", "dec", "+", "-", "*", "/",
+	"quotient", "remainder", "modulo", "=", "<=", ">=", ">", "<", "zero?", "abs",
+	"exp", "log", "sin", "cos", "tan", "asin", "acos", "atan", "atan2",
+	"list?", "empty?", "car", "cdr", "list-length", "vector?", "vector-length", "vector-ref",
+	"struct?", "struct-length", "has?", "get", "function?",
+}
+
+func setPurePrimitives() {
+	for _, name := range purePrimitives {
+		if fun, ok := Intern(name).(*Symbol).Value.(*Function); ok && fun.primitive != nil {
+			fun.primitive.pure = true
+		}
+	}
+}
+
+// constantLiteral - the value of the expression, if it can be known when it is compiled, and shared by every
+// evaluation of it
+func constantLiteral(env *List, expr Value) (Value, bool) {
+	val, ok := constantValue(env, expr)
+	if !ok {
+		return nil, false
+	}
+	switch val.(type) {
+	case *Vector, *Struct:
+		if lst, ok := expr.(*List); !ok || lst == EmptyList || lst.Car != Intern("quote") {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
+// constantValue - the value of the expression, if it can be known when it is compiled
+func constantValue(env *List, expr Value) (Value, bool) {
+	switch p := expr.(type) {
+	case *Symbol:
+		return nil, false
+	case *List:
+		return constantListValue(env, p)
+	case *Vector:
+		elements := make([]Value, len(p.Elements))
+		for i, e := range p.Elements {
+			val, ok := constantValue(env, e)
+			if !ok {
+				return nil, false
+			}
+			elements[i] = val
+		}
+		return NewVector(elements...), true
+	case *Struct:
+		bindings := make([]Value, 0, len(p.Bindings)*2)
+		for k, v := range p.Bindings {
+			key, ok := constantValue(env, k.ToValue())
+			if !ok {
+				return nil, false
+			}
+			val, ok := constantValue(env, v)
+			if !ok {
+				return nil, false
+			}
+			bindings = append(bindings, key, val)
+		}
+		strct, err := MakeStruct(bindings)
+		if err != nil {
+			return nil, false
+		}
+		return strct, true
+	}
+	return expr, true
+}
+
+func constantListValue(env *List, lst *List) (Value, bool) {
+	if lst == EmptyList {
+		return lst, true
+	}
+	lstlen := ListLength(lst)
+	switch lst.Car {
+	case Intern("quote"):
+		if lstlen == 2 {
+			return Cadr(lst), true
+		}
+	case Intern("if"):
+		if lstlen == 3 || lstlen == 4 {
+			pred, ok := constantValue(env, Cadr(lst))
+			if !ok {
+				return nil, false
+			}
+			if pred != False {
+				return constantValue(env, Caddr(lst))
+			}
+			if lstlen == 3 {
+				return Null, true
+			}
+			return constantValue(env, Cadddr(lst))
+		}
+	default:
+		prim := purePrimitive(env, lst.Car)
+		if prim == nil || lstlen < 0 {
+			return nil, false
+		}
+		argv := make([]Value, 0, lstlen-1)
+		for args := lst.Cdr; args != EmptyList; args = args.Cdr {
+			val, ok := constantValue(env, args.Car)
+			if !ok {
+				return nil, false
+			}
+			argv = append(argv, val)
+		}
+		val, err := new(vm).callPrimitive(prim, argv)
+		if err != nil {
+			return nil, false
+		}
+		return val, true
+	}
+	return nil, false
+}
+
+// purePrimitive - the pure primitive the symbol names, if it is not shadowed by a local variable
+func purePrimitive(env *List, fn Value) *Primitive {
+	sym, ok := fn.(*Symbol)
+	if !ok {
+		return nil
+	}
+	if _, _, local := calculateLocation(sym, env); local {
+		return nil
+	}
+	if fun, ok := sym.Value.(*Function); ok && fun.primitive != nil && fun.primitive.pure {
+		return fun.primitive
+	}
+	return nil
+}
@@ -0,0 +1,1009 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Compiling modules to Go. BuildGo compiles a module, and translates the code of each function it defines at the
+// top level into a Go function. The result is the source of a Go package whose Extension registers the module with
+// RegisterModule, so that (use name) in a program linked with it loads the module from the program instead of the
+// load path, and binds the functions to their Go translations instead of their byte code.
+//
+// The VM's stack becomes Go variables: the stack depth at each instruction is known when the code is compiled, so
+// each depth is a variable. So is each slot of the frame, unless the function makes closures, in which case its
+// variables are kept in a Frame the closures can share. The closures are compiled to Go too, unless they have
+// optional, rest, or keyword arguments. Jumps become gotos. A call of a top level function of the module, with the
+// right number of arguments, is a direct Go call, and a tail call of a function by itself jumps back to its start.
+// Other calls are made by the VM the function was called in, which each compiled function is passed as its Context,
+// so that they share its parameters, task, allocation budget, and capabilities. Other tail calls are returned, as a
+// tailCall error, to the trampoline the function was called from, which makes them, so that the Go stack does not grow
+// with a chain of tail calls between compiled functions. Tail calls between compiled functions and byte code still use
+// the stack. Like the VM, a compiled function counts its frame, and the closures, vectors, and structs it makes,
+// against the evaluation's budget, and can be cancelled when it is called and each time it loops.
+//
+// A top level function with optional, rest, or keyword arguments is left as byte code.
+
+// Context - the VM a function compiled to Go is called in, for Go code compiled from a module
+type Context = *vm
+
+// GoFunction - a top level function of a module, compiled to Go by BuildGo. Fun may return tail calls, which the
+// primitive the function is bound to makes. When the module is loaded, Constants is set to the constants of its code,
+// as listed by codeConstants.
+type GoFunction struct {
+	Name      string
+	Fun       func(vm Context, argv []Value) (Value, error)
+	Constants *[]Value
+}
+
+type linkedModule struct {
+	code      []byte
+	functions []*GoFunction
+}
+
+var linkedModules = make(map[string]*linkedModule)
+
+// RegisterModule - link a compiled module into the program. When it is used, the code, as saved in a .lvm file, is
+// run, and then the functions are bound to their Go translations.
+func RegisterModule(name string, code []byte, functions ...*GoFunction) {
+	linkedModules[name] = &linkedModule{code: code, functions: functions}
+}
+
+// findLinkedModule - the module of the name linked into the program, if any
+func findLinkedModule(name string) (*linkedModule, bool) {
+	mod, ok := linkedModules[strings.TrimSuffix(name, ".ell")]
+	return mod, ok
+}
+
+func (mod *linkedModule) load(caps *Capabilities) error {
+	thunks, err := decodeModule(mod.code, "")
+	if err != nil {
+		return err
+	}
+	if err := runThunks(thunks, caps); err != nil {
+		return err
+	}
+	for _, f := range mod.functions {
+		sym := Intern(f.Name).(*Symbol)
+		fun, ok := sym.Value.(*Function)
+		if !ok || fun.code == nil {
+			return NewError(ErrorKey, "the compiled module does not define the function ", f.Name)
+		}
+		*f.Constants = codeConstants(fun.code)
+		prim := goPrimitive(f.Name, f.Fun, fun.code)
+		defGlobal(sym, &Function{primitive: prim})
+	}
+	return nil
+}
+
+// codeTypes - the declared types of the arguments and result of code with a fixed number of arguments
+func codeTypes(code *Code) ([]Value, Value) {
+	args := code.argtypes
+	if args == nil {
+		args = make([]Value, code.argc)
+		for i := range args {
+			args[i] = AnyType
+		}
+	}
+	result := code.result
+	if result == nil {
+		result = AnyType
+	}
+	return args, result
+}
+
+// codeConstants - the constants the instructions of the code refer to, in order, and its declared result type if it
+// has one, followed by those of the code of each closure it makes, in the same order
+func codeConstants(code *Code) []Value {
+	var result []Value
+	var closures []*Code
+	for pc := 0; pc < len(code.ops); pc += opcodeWidth(code.ops[pc]) {
+		if hasConstantOperand(code.ops[pc]) {
+			val := constants[code.ops[pc+1]]
+			result = append(result, val)
+			if code.ops[pc] == opcodeClosure {
+				closures = append(closures, val.(*Code))
+			}
+		}
+	}
+	if code.result != nil {
+		result = append(result, code.result)
+	}
+	for _, closure := range closures {
+		result = append(result, codeConstants(closure)...)
+	}
+	return result
+}
+
+// Global - the value of the global, for Go code compiled from a module
+func Global(sym Value) (Value, error) {
+	val := sym.(*Symbol).Value
+	if val == nil {
+		return nil, NewError(ErrorKey, "Undefined symbol: ", sym)
+	}
+	return val, nil
+}
+
+// CallFunction - call the function in the VM, for Go code compiled from a module
+func CallFunction(vm Context, fn Value, args ...Value) (Value, error) {
+	return vm.call(fn, args)
+}
+
+// CallGlobalSymbol - call the function the global is bound to in the VM, for Go code compiled from a module
+func CallGlobalSymbol(vm Context, sym Value, args ...Value) (Value, error) {
+	s := sym.(*Symbol)
+	switch s.Value.(type) {
+	case *Function, *Keyword:
+		return vm.call(s.Value, args)
+	}
+	return nil, notCallableGlobal(s)
+}
+
+// EnterFunction - what the VM does when it calls a function with argc arguments, for Go code compiled from a module:
+// check for an interrupt or the cancellation of its task, and count the function's frame against its budget
+func EnterFunction(vm Context, argc int) error {
+	if interrupted || checkInterrupt() {
+		return NewError(InterruptKey)
+	}
+	if err := vm.loopback(nil); err != nil {
+		return err
+	}
+	return vm.allocate(frameCost(argc))
+}
+
+// LoopBack - what the VM does when it jumps back to the start of a loop, for Go code compiled from a module
+func LoopBack(vm Context) error {
+	return vm.loopback(nil)
+}
+
+// MakeClosure - a closure of the code, counted against the VM's budget, for Go code compiled from a module
+func MakeClosure(vm Context, code *Code, frame *Frame) (Value, error) {
+	if err := vm.allocate(closureSize); err != nil {
+		return nil, err
+	}
+	return Closure(code, frame), nil
+}
+
+// AllocateVector - a vector of the elements, counted against the VM's budget, for Go code compiled from a module
+func AllocateVector(vm Context, elements ...Value) (Value, error) {
+	if err := vm.allocate(vectorCost(len(elements))); err != nil {
+		return nil, err
+	}
+	return NewVector(elements...), nil
+}
+
+// AllocateStruct - a struct of the keys and values, counted against the VM's budget, for Go code compiled from a
+// module
+func AllocateStruct(vm Context, fieldvals ...Value) (Value, error) {
+	if err := vm.allocate(structCost(len(fieldvals) / 2)); err != nil {
+		return nil, err
+	}
+	return MakeStruct(fieldvals)
+}
+
+// CheckResult - the error for a function returning a value that is not of its declared result type, if it is not
+func CheckResult(name string, t Value, val Value) error {
+	if conforms(val, t) {
+		return nil
+	}
+	return NewError(ErrorKey, fmt.Sprintf("%s expected to return a %s, got a %s", name, t.String(), typeMismatch(val, t)))
+}
+
+// CheckTailResult - the value a function with the declared result type returns, after checking it. If it returns a
+// tail call, the value is checked when the call returns it.
+func CheckTailResult(name string, t Value, val Value, err error) (Value, error) {
+	if tc, ok := err.(*tailCall); ok {
+		tc.results = addResult(tc.results, goResult{name, t})
+		return nil, tc
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckResult(name, t, val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// tailCall - a call in tail position by a function compiled to Go. The function returns it as its error, and the
+// trampoline it was called from makes the call, so that a chain of tail calls does not grow the Go stack. The results
+// are the declared result types of the functions that made the chain of calls.
+type tailCall struct {
+	fn      Value
+	direct  intrinsicFunction // if set, the function compiled to Go to call instead of fn
+	args    []Value
+	results []goResult
+}
+
+type goResult struct {
+	name string
+	t    Value
+}
+
+func (tc *tailCall) Error() string {
+	return "tail call not made"
+}
+
+// addResult - the result types, with the one added if it is not already there, so that tail calls between functions
+// with declared results use no more space
+func addResult(results []goResult, r goResult) []goResult {
+	for _, r2 := range results {
+		if r2.name == r.name && Equal(r2.t, r.t) {
+			return results
+		}
+	}
+	return append(results, r)
+}
+
+// TailCall - call the function in tail position, for Go code compiled from a module
+func TailCall(fn Value, args ...Value) (Value, error) {
+	return nil, &tailCall{fn: fn, args: args}
+}
+
+// TailCallGlobalSymbol - call the function the global is bound to in tail position, for Go code compiled from a module
+func TailCallGlobalSymbol(sym Value, args ...Value) (Value, error) {
+	s := sym.(*Symbol)
+	switch s.Value.(type) {
+	case *Function, *Keyword:
+		return nil, &tailCall{fn: s.Value, args: args}
+	}
+	return nil, notCallableGlobal(s)
+}
+
+// TailCallFunction - call the function compiled to Go in tail position, for Go code compiled from a module
+func TailCallFunction(fun func(vm Context, argv []Value) (Value, error), args ...Value) (Value, error) {
+	return nil, &tailCall{direct: fun, args: args}
+}
+
+func (tc *tailCall) call(vm *vm) (Value, error) {
+	if tc.direct != nil {
+		return tc.direct(vm, tc.args)
+	}
+	if fun, ok := tc.fn.(*Function); ok && fun.primitive != nil && fun.primitive.tail != nil {
+		if err := checkArguments(fun.primitive, tc.args); err != nil {
+			return nil, err
+		}
+		return fun.primitive.tail(vm, tc.args)
+	}
+	return vm.call(tc.fn, tc.args)
+}
+
+// Trampoline - the value a function compiled to Go returns, after making the tail calls it returns in the VM, for
+// Go code compiled from a module
+func (vm *vm) Trampoline(val Value, err error) (Value, error) {
+	var results []goResult
+	for {
+		tc, ok := err.(*tailCall)
+		if !ok {
+			break
+		}
+		for _, r := range tc.results {
+			results = addResult(results, r)
+		}
+		val, err = tc.call(vm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if err := CheckResult(r.name, r.t, val); err != nil {
+			return nil, err
+		}
+	}
+	return val, nil
+}
+
+// goPrimitive - the primitive for a function compiled to Go, which may return tail calls. It is called with the VM
+// calling it, or, if there is none, a new one.
+func goPrimitive(name string, fun intrinsicFunction, code *Code) *Primitive {
+	args, result := codeTypes(code)
+	vmfun := func(vm *vm, argv []Value) (Value, error) {
+		return vm.Trampoline(fun(vm, argv))
+	}
+	return &Primitive{
+		name: name,
+		fun: func(argv []Value) (Value, error) {
+			return vmfun(VM(defaultStackSize), argv)
+		},
+		signature: functionSignatureFromTypes(result, args, nil),
+		argc:      code.argc,
+		result:    result,
+		args:      args,
+		tail:      fun,
+		vmfun:     vmfun,
+	}
+}
+
+// NewFrame - a frame of the given size, nested in up, with the arguments in its first slots, for Go code compiled
+// from a module
+func NewFrame(up *Frame, size int, args ...Value) *Frame {
+	f := &Frame{locals: up}
+	if size <= 5 {
+		f.elements = f.firstfive[:]
+	} else {
+		f.elements = make([]Value, size)
+	}
+	copy(f.elements, args)
+	return f
+}
+
+// Up - the frame i levels out from this one
+func (frame *Frame) Up(i int) *Frame {
+	for ; i > 0; i-- {
+		frame = frame.locals
+	}
+	return frame
+}
+
+// Get - the value in slot j of the frame
+func (frame *Frame) Get(j int) Value {
+	return frame.elements[j]
+}
+
+// Set - store the value in slot j of the frame
+func (frame *Frame) Set(j int, val Value) {
+	frame.elements[j] = val
+}
+
+// NewGoClosure - a closure of the code, compiled to the Go function, counted against the VM's budget, for Go code
+// compiled from a module. The function may return tail calls.
+func NewGoClosure(vm Context, code *Code, fun func(vm Context, argv []Value) (Value, error)) (Value, error) {
+	if err := vm.allocate(closureSize); err != nil {
+		return nil, err
+	}
+	return &Function{primitive: goPrimitive(code.name, fun, code)}, nil
+}
+
+// BuildGo - the source of a Go package, of the given name, with the module compiled to Go. The module is loaded to
+// compile it. Also returns a note for each top level function of the module left as byte code, saying why.
+func BuildGo(name string, pkg string) (string, []string, error) {
+	file, err := FindModuleFile(name)
+	if err != nil {
+		return "", nil, err
+	}
+	var thunks []*Code
+	var hash string
+	if strings.HasSuffix(file, ".lvm") {
+		thunks, err = readCompiledModule(file, "")
+		if err == nil {
+			err = runThunks(thunks, nil)
+		}
+	} else {
+		thunks, hash, err = compileModule(file)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := encodeModule(hash, thunks)
+	if err != nil {
+		return "", nil, err
+	}
+	modName := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	g := &goGenerator{functions: make(map[Value]*goFunction), closures: make(map[*Code]*goFunction)}
+	var notes []string
+	for _, f := range moduleFunctions(thunks) {
+		if reason := goUnsupported(f.code, 0); reason != "" {
+			notes = append(notes, fmt.Sprintf("%s: not compiled to Go: %s", f.sym, reason))
+			continue
+		}
+		f.ident = goIdentifier(f.sym.Text)
+		f.top = f
+		g.functions[f.sym] = f
+		g.add(f, 0)
+	}
+	src, err := g.generate(modName, pkg, filepath.Base(file), data)
+	return src, notes, err
+}
+
+// BuildGoPackage - compile the module to Go, in a package in the directory, which is named after the module if it
+// is "". Returns the notes from BuildGo.
+func BuildGoPackage(name string, dir string) ([]string, error) {
+	if dir == "" {
+		dir = goPackageName(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)))
+	}
+	pkg := goPackageName(filepath.Base(dir))
+	src, notes, err := BuildGo(name, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return notes, SpitFile(filepath.Join(dir, pkg+".go"), src)
+}
+
+// goPackageName - the name, as the name of a Go package
+func goPackageName(name string) string {
+	var buf strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' && buf.Len() > 0 {
+			buf.WriteRune(c)
+		}
+	}
+	if buf.Len() == 0 {
+		return "module"
+	}
+	return buf.String()
+}
+
+// compileModule - compile and run the forms of the source file, as loading it does
+func compileModule(file string) ([]*Code, string, error) {
+	fileText, err := SlurpFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+	exprs, err := ReadAllFromString(fileText)
+	if err != nil {
+		return nil, "", err
+	}
+	var thunks []*Code
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		thunk, err := compileForm(exprs.Car)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := importCode(thunk, nil); err != nil {
+			return nil, "", err
+		}
+		thunks = append(thunks, thunk)
+	}
+	return thunks, sourceHash(fileText), nil
+}
+
+type goFunction struct {
+	sym      *Symbol // the global a top level function is bound to, or nil for a closure
+	code     *Code
+	ident    string      // the Go name of the function
+	top      *goFunction // the top level function it is in, or itself
+	base     int         // the index of its first constant in the constants of the top level function
+	level    int         // the number of functions it is nested in
+	frame    bool        // true if it makes closures, so that its variables are kept in a frame they can share
+	closures int         // for a top level function, the number of closures in it that are compiled to Go
+	result   int         // if the code declares its result type, the index of it in the constants of top
+}
+
+// moduleFunctions - the functions the top level forms of the module define, and that are still bound when it has
+// been loaded
+func moduleFunctions(thunks []*Code) []*goFunction {
+	var result []*goFunction
+	seen := make(map[*Code]bool)
+	for _, thunk := range thunks {
+		ops := thunk.ops
+		for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+			if ops[pc] != opcodeClosure {
+				continue
+			}
+			code := constants[ops[pc+1]].(*Code)
+			sym, ok := Intern(code.name).(*Symbol)
+			if !ok || seen[code] {
+				continue
+			}
+			if fun, ok := sym.Value.(*Function); ok && fun.code == code {
+				seen[code] = true
+				result = append(result, &goFunction{sym: sym, code: code})
+			}
+		}
+	}
+	return result
+}
+
+// goUnsupported - the reason the code, nested in level functions, cannot be compiled to Go, or "" if it can
+func goUnsupported(code *Code, level int) string {
+	if code.defaults != nil {
+		return "it has optional, rest, or keyword arguments"
+	}
+	ops := code.ops
+	for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+		switch ops[pc] {
+		case opcodeLocal, opcodeSetLocal, opcodeLocalJumpFalse:
+			if ops[pc+1] > level {
+				return "it refers to the variables of an enclosing function"
+			}
+		case opcodeDefGlobal, opcodeUndefGlobal, opcodeUse, opcodeDefMacro:
+			return "it uses " + opsyms[ops[pc]].String()
+		}
+	}
+	return ""
+}
+
+// goIdentifier - the name as a Go identifier, with each character that cannot be in one, and _, written in hex
+func goIdentifier(name string) string {
+	var buf strings.Builder
+	for _, c := range name {
+		if c < 128 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			buf.WriteRune(c)
+		} else {
+			fmt.Fprintf(&buf, "_%x", c)
+		}
+	}
+	return buf.String()
+}
+
+type goGenerator struct {
+	functions map[Value]*goFunction // the top level functions compiled to Go, by name
+	closures  map[*Code]*goFunction // the closures compiled to Go, by their code
+	order     []*goFunction
+}
+
+// add - add the function, whose constants start at base in those of its top level function, and the closures it
+// makes that can be compiled to Go
+func (g *goGenerator) add(f *goFunction, base int) {
+	f.base = base
+	g.order = append(g.order, f)
+	next := base
+	var closures []*Code
+	ops := f.code.ops
+	for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+		if hasConstantOperand(ops[pc]) {
+			next++
+			if ops[pc] == opcodeClosure {
+				closures = append(closures, constants[ops[pc+1]].(*Code))
+			}
+		}
+	}
+	if f.code.result != nil {
+		f.result = next
+		next++
+	}
+	f.frame = len(closures) > 0
+	for _, code := range closures {
+		if _, ok := g.closures[code]; !ok && goUnsupported(code, f.level+1) == "" {
+			f.top.closures++
+			closure := &goFunction{code: code, top: f.top, level: f.level + 1}
+			closure.ident = fmt.Sprintf("%s_fn%d", f.top.ident, f.top.closures)
+			g.closures[code] = closure
+			g.add(closure, next)
+		}
+		next += len(codeConstants(code))
+	}
+}
+
+func (g *goGenerator) generate(modName string, pkg string, file string, data []byte) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by ell --build-go from %s. DO NOT EDIT.\n\n", file)
+	fmt.Fprintf(&buf, "// Package %s is the Ell module %s, compiled to Go. Pass Extension to ell.Init or ell.Main to link it into\n", pkg, modName)
+	fmt.Fprintf(&buf, "// a program, and (use %s) loads it from the program, with its functions compiled to Go.\n", modName)
+	fmt.Fprintf(&buf, "package %s\n\n", pkg)
+	buf.WriteString("import (\n\t\"github.com/boynton/ell\"\n\t. \"github.com/boynton/ell/data\"\n)\n\n")
+	buf.WriteString("// Extension - registers the module\nvar Extension ell.Extension = extension{}\n\n")
+	buf.WriteString("type extension struct{}\n\n")
+	buf.WriteString("func (extension) Init() error {\n")
+	fmt.Fprintf(&buf, "\tell.RegisterModule(%q, module,\n", modName)
+	for _, f := range g.order {
+		if f.sym != nil {
+			fmt.Fprintf(&buf, "\t\t&ell.GoFunction{Name: %q, Fun: p_%s, Constants: &k_%s},\n", f.sym.Text, f.ident, f.ident)
+		}
+	}
+	buf.WriteString("\t)\n\treturn nil\n}\n\n")
+	buf.WriteString("func (extension) Cleanup() {}\n\n")
+	fmt.Fprintf(&buf, "func (extension) String() string {\n\treturn %q\n}\n\n", modName)
+	fmt.Fprintf(&buf, "// module - the compiled module, as saved in %s.lvm\n", modName)
+	fmt.Fprintf(&buf, "var module = []byte(%s)\n", strconv.Quote(string(data)))
+	for _, f := range g.order {
+		buf.WriteString("\n")
+		g.function(&buf, f)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", NewError(ErrorKey, "cannot format the generated Go code: ", err.Error())
+	}
+	return string(src), nil
+}
+
+func (g *goGenerator) function(buf *bytes.Buffer, f *goFunction) {
+	code := f.code
+	params := make([]string, code.argc)
+	args := []string{"vm"}
+	for i := range params {
+		params[i] = fmt.Sprintf("l%d", i)
+		args = append(args, fmt.Sprintf("argv[%d]", i))
+	}
+	sig := []string{"vm ell.Context"}
+	if f.sym != nil {
+		argv := "argv"
+		if code.argc == 0 {
+			argv = "_"
+		}
+		fmt.Fprintf(buf, "var k_%s []Value\n\n", f.ident)
+		fmt.Fprintf(buf, "func p_%s(vm ell.Context, %s []Value) (Value, error) {\n\treturn f_%s(%s)\n}\n\n", f.ident, argv, f.ident, strings.Join(args, ", "))
+		fmt.Fprintf(buf, "// f_%s - %s\n", f.ident, f.sym.Text)
+	} else {
+		sig = append(sig, "up *ell.Frame")
+		fmt.Fprintf(buf, "// f_%s - a function in %s\n", f.ident, f.top.sym.Text)
+	}
+	if len(params) > 0 {
+		sig = append(sig, strings.Join(params, ", ")+" Value")
+	}
+	fmt.Fprintf(buf, "func f_%s(%s) (Value, error) {\n", f.ident, strings.Join(sig, ", "))
+	fmt.Fprintf(buf, "\tif err := ell.EnterFunction(vm, %d); err != nil {\n\t\treturn nil, err\n\t}\n", code.argc)
+	// the body is translated twice: the first time to learn which variables are read, so that the second can leave
+	// out the others
+	t := &goTranslation{g: g, f: f, reads: make(map[string]bool)}
+	t.translate()
+	t = &goTranslation{g: g, f: f, reads: make(map[string]bool), used: t.reads}
+	body := t.translate()
+	var vars []string
+	for v := range t.reads {
+		if v[0] != 's' && v[0] != 'l' {
+			continue
+		}
+		if n, _ := strconv.Atoi(v[1:]); v[0] == 'l' && n < code.argc {
+			continue
+		}
+		vars = append(vars, v)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return goVariableLess(vars[i], vars[j])
+	})
+	if len(vars) > 0 {
+		fmt.Fprintf(buf, "\tvar %s Value\n", strings.Join(vars, ", "))
+	}
+	if t.reads["err"] {
+		buf.WriteString("\tvar err error\n")
+	}
+	if f.frame {
+		up := "up"
+		if f.sym != nil {
+			up = "nil"
+		}
+		size := code.argc
+		if code.frameSize > size {
+			size = code.frameSize
+		}
+		fmt.Fprintf(buf, "\tenv := ell.NewFrame(%s, %d", up, size)
+		for _, p := range params {
+			fmt.Fprintf(buf, ", %s", p)
+		}
+		buf.WriteString(")\n")
+	}
+	buf.WriteString(body)
+	buf.WriteString("}\n")
+}
+
+func goVariableLess(v1 string, v2 string) bool {
+	if v1[0] != v2[0] {
+		return v1[0] < v2[0]
+	}
+	n1, _ := strconv.Atoi(v1[1:])
+	n2, _ := strconv.Atoi(v2[1:])
+	return n1 < n2
+}
+
+// goTranslation - the translation of the code of a function to the body of a Go function. The value at depth d of
+// the stack is the variable sd, and the variable in slot j of the frame is lj, or is kept in env if the function
+// makes closures. The frame of the function a closure is in is up.
+type goTranslation struct {
+	g     *goGenerator
+	f     *goFunction
+	buf   bytes.Buffer
+	reads map[string]bool // the variables read
+	used  map[string]bool // if set, the variables that are read somewhere. Values stored in other variables are dropped
+}
+
+func (t *goTranslation) read(v string) string {
+	t.reads[v] = true
+	return v
+}
+
+func (t *goTranslation) write(v string) string {
+	if t.used != nil && !t.used[v] {
+		return "_"
+	}
+	return v
+}
+
+func (t *goTranslation) stack(d int) string {
+	return fmt.Sprintf("s%d", d)
+}
+
+// frame - the frame i levels out from the function's own, when its variables are kept in one
+func (t *goTranslation) frame(i int) string {
+	switch i {
+	case 0:
+		return "env"
+	case 1:
+		return "up"
+	}
+	return fmt.Sprintf("up.Up(%d)", i-1)
+}
+
+// getLocal - the value of the variable in slot j of the frame i levels out
+func (t *goTranslation) getLocal(i int, j int) string {
+	if i == 0 && !t.f.frame {
+		return t.read(fmt.Sprintf("l%d", j))
+	}
+	return fmt.Sprintf("%s.Get(%d)", t.frame(i), j)
+}
+
+// setLocal - the statement that stores the value in the variable in slot j of the frame i levels out
+func (t *goTranslation) setLocal(i int, j int, val string) string {
+	if i == 0 && !t.f.frame {
+		return fmt.Sprintf("%s = %s", t.write(fmt.Sprintf("l%d", j)), val)
+	}
+	return fmt.Sprintf("%s.Set(%d, %s)", t.frame(i), j, val)
+}
+
+// constant - the constant i of the function's code
+func (t *goTranslation) constant(i int) string {
+	return fmt.Sprintf("k_%s[%d]", t.f.top.ident, t.f.base+i)
+}
+
+// args - the values of the argc arguments of a call, the first of which is at depth d of the stack and the rest below
+func (t *goTranslation) args(d int, argc int) string {
+	vals := make([]string, argc)
+	for i := range vals {
+		vals[i] = t.read(t.stack(d - i))
+	}
+	return strings.Join(vals, ", ")
+}
+
+func (t *goTranslation) emit(pattern string, args ...interface{}) {
+	t.buf.WriteString("\t")
+	fmt.Fprintf(&t.buf, pattern, args...)
+	t.buf.WriteString("\n")
+}
+
+func (t *goTranslation) emitCheck() {
+	t.read("err")
+	t.emit("if err != nil {\n\t\treturn nil, err\n\t}")
+}
+
+// emitReturn - return the value of the variable, checking it is of the declared result type, if the code has one
+func (t *goTranslation) emitReturn(v string) {
+	if t.f.code.result != nil {
+		t.read("err")
+		t.emit("if err = ell.CheckResult(%q, k_%s[%d], %s); err != nil {\n\t\treturn nil, err\n\t}", codeName(t.f.code), t.f.top.ident, t.f.result, t.read(v))
+	}
+	t.emit("return %s, nil", t.read(v))
+}
+
+// emitTailCall - return the tail call, for the trampoline the function was called from to make. If the code declares
+// its result type, the tail call is returned with it, using the variable.
+func (t *goTranslation) emitTailCall(call string, v string) {
+	if t.f.code.result == nil {
+		t.emit("return %s", call)
+		return
+	}
+	t.read("err")
+	t.emit("%s, err = %s", t.write(v), call)
+	t.emit("return ell.CheckTailResult(%q, k_%s[%d], %s, err)", codeName(t.f.code), t.f.top.ident, t.f.result, t.read(v))
+}
+
+// depths - the depth of the stack before each instruction, or -1 if it is never reached. Also the locations jumped
+// to.
+func (t *goTranslation) depths() ([]int, map[int]bool) {
+	ops := t.f.code.ops
+	depths := make([]int, len(ops))
+	for i := range depths {
+		depths[i] = -1
+	}
+	targets := make(map[int]bool)
+	depths[0] = 0
+	work := []int{0}
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		d := depths[pc]
+		next := pc + opcodeWidth(ops[pc])
+		var succ []int
+		switch ops[pc] {
+		case opcodeLiteral, opcodeLocal, opcodeGlobal, opcodeClosure:
+			succ = []int{next}
+			d++
+		case opcodeSetLocal:
+			succ = []int{next}
+		case opcodePop:
+			succ = []int{next}
+			d--
+		case opcodeJump:
+			succ = []int{pc + ops[pc+1]}
+			targets[succ[0]] = true
+		case opcodeJumpFalse:
+			succ = []int{next, pc + ops[pc+1]}
+			targets[succ[1]] = true
+			d--
+		case opcodeLocalJumpFalse:
+			succ = []int{next, pc + ops[pc+3]}
+			targets[succ[1]] = true
+		case opcodeCall:
+			succ = []int{next}
+			d -= ops[pc+1]
+		case opcodeCallGlobal:
+			succ = []int{next}
+			d -= ops[pc+2] - 1
+		case opcodeTailCallGlobal:
+			if t.selfCall(constants[ops[pc+1]], ops[pc+2]) {
+				targets[0] = true
+			}
+		case opcodeVector, opcodeStruct:
+			succ = []int{next}
+			d -= ops[pc+1] - 1
+		}
+		for _, s := range succ {
+			if depths[s] < 0 {
+				depths[s] = d
+				work = append(work, s)
+			}
+		}
+	}
+	return depths, targets
+}
+
+// selfCall - true if the call of the global with argc arguments is a call of the function being translated, that
+// can reuse its variables
+func (t *goTranslation) selfCall(sym Value, argc int) bool {
+	code := t.f.code
+	return sym == t.f.sym && argc == code.argc && code.argtypes == nil && !t.f.frame
+}
+
+// direct - the identifier of the Go function to call the global with directly, if there is one
+func (t *goTranslation) direct(sym Value, argc int) (string, bool) {
+	callee, ok := t.g.functions[sym]
+	if !ok || argc != callee.code.argc || callee.code.argtypes != nil {
+		return "", false
+	}
+	return callee.ident, true
+}
+
+// closure - the call that makes a closure of the code
+func (t *goTranslation) closure(code *Code, k string) string {
+	closure, ok := t.g.closures[code]
+	if !ok {
+		return fmt.Sprintf("ell.MakeClosure(vm, %s.(*ell.Code), env)", k)
+	}
+	args := []string{"vm", "env"}
+	for i := 0; i < code.argc; i++ {
+		args = append(args, fmt.Sprintf("argv[%d]", i))
+	}
+	argv := "argv"
+	if code.argc == 0 {
+		argv = "_"
+	}
+	return fmt.Sprintf("ell.NewGoClosure(vm, %s.(*ell.Code), func(vm ell.Context, %s []Value) (Value, error) {\n\t\treturn f_%s(%s)\n\t})", k, argv, closure.ident, strings.Join(args, ", "))
+}
+
+// jump - the statement that jumps from the instruction to the target. Jumping back is another iteration of a loop,
+// which can be cancelled.
+func (t *goTranslation) jump(pc int, target int) string {
+	if target > pc {
+		return fmt.Sprintf("goto L%d", target)
+	}
+	t.read("err")
+	return fmt.Sprintf("if err = ell.LoopBack(vm); err != nil {\n\t\treturn nil, err\n\t}\n\tgoto L%d", target)
+}
+
+func (t *goTranslation) translate() string {
+	ops := t.f.code.ops
+	depths, targets := t.depths()
+	ki := 0
+	for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+		op := ops[pc]
+		k := ""
+		if hasConstantOperand(op) {
+			k = t.constant(ki)
+			ki++
+		}
+		d := depths[pc]
+		if d < 0 {
+			continue
+		}
+		if targets[pc] {
+			fmt.Fprintf(&t.buf, "L%d:\n", pc)
+		}
+		switch op {
+		case opcodeLiteral:
+			t.emit("%s = %s", t.write(t.stack(d)), k)
+		case opcodeLocal:
+			t.emit("%s = %s", t.write(t.stack(d)), t.getLocal(ops[pc+1], ops[pc+2]))
+		case opcodeSetLocal:
+			t.emit("%s", t.setLocal(ops[pc+1], ops[pc+2], t.read(t.stack(d-1))))
+		case opcodeGlobal:
+			t.emit("%s, err = ell.Global(%s)", t.write(t.stack(d)), k)
+			t.emitCheck()
+		case opcodeClosure:
+			t.emit("%s, err = %s", t.write(t.stack(d)), t.closure(constants[ops[pc+1]].(*Code), k))
+			t.emitCheck()
+		case opcodePop:
+		case opcodeJump:
+			t.emit("%s", t.jump(pc, pc+ops[pc+1]))
+		case opcodeJumpFalse:
+			t.emit("if %s == False {\n\t\t%s\n\t}", t.read(t.stack(d-1)), t.jump(pc, pc+ops[pc+1]))
+		case opcodeLocalJumpFalse:
+			t.emit("if %s == False {\n\t\t%s\n\t}", t.getLocal(ops[pc+1], ops[pc+2]), t.jump(pc, pc+ops[pc+3]))
+		case opcodeReturn:
+			t.emitReturn(t.stack(d - 1))
+		case opcodeCall, opcodeTailCall:
+			argc := ops[pc+1]
+			args := ""
+			if argc > 0 {
+				args = ", " + t.args(d-2, argc)
+			}
+			if op == opcodeTailCall {
+				t.emitTailCall(fmt.Sprintf("ell.TailCall(%s%s)", t.read(t.stack(d-1)), args), t.stack(d-1-argc))
+			} else {
+				t.emit("%s, err = ell.CallFunction(vm, %s%s)", t.write(t.stack(d-1-argc)), t.read(t.stack(d-1)), args)
+				t.emitCheck()
+			}
+		case opcodeCallGlobal, opcodeTailCallGlobal:
+			sym := constants[ops[pc+1]]
+			argc := ops[pc+2]
+			if op == opcodeTailCallGlobal && t.selfCall(sym, argc) {
+				if argc > 0 {
+					locals := make([]string, argc)
+					for i := range locals {
+						locals[i] = t.write(fmt.Sprintf("l%d", i))
+					}
+					t.emit("%s = %s", strings.Join(locals, ", "), t.args(d-1, argc))
+				}
+				t.emit("%s", t.jump(pc, 0))
+				continue
+			}
+			args := ""
+			if argc > 0 {
+				args = t.args(d-1, argc)
+			}
+			fn, direct := t.direct(sym, argc)
+			var call string
+			switch {
+			case direct && op == opcodeTailCallGlobal:
+				if args != "" {
+					args = ", " + args
+				}
+				call = fmt.Sprintf("ell.TailCallFunction(p_%s%s)", fn, args)
+			case direct:
+				if args != "" {
+					args = ", " + args
+				}
+				call = fmt.Sprintf("vm.Trampoline(f_%s(vm%s))", fn, args)
+			default:
+				if args != "" {
+					args = ", " + args
+				}
+				if op == opcodeTailCallGlobal {
+					call = fmt.Sprintf("ell.TailCallGlobalSymbol(%s%s)", k, args)
+				} else {
+					call = fmt.Sprintf("ell.CallGlobalSymbol(vm, %s%s)", k, args)
+				}
+			}
+			if op == opcodeTailCallGlobal {
+				t.emitTailCall(call, t.stack(d-argc))
+			} else {
+				t.emit("%s, err = %s", t.write(t.stack(d-argc)), call)
+				t.emitCheck()
+			}
+		case opcodeVector:
+			n := ops[pc+1]
+			t.emit("%s, err = ell.AllocateVector(vm, %s)", t.write(t.stack(d-n)), t.args(d-1, n))
+			t.emitCheck()
+		case opcodeStruct:
+			n := ops[pc+1]
+			t.emit("%s, err = ell.AllocateStruct(vm, %s)", t.write(t.stack(d-n)), t.args(d-1, n))
+			t.emitCheck()
+		}
+	}
+	return t.buf.String()
+}
@@ -0,0 +1,756 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Images - a snapshot of the global environment: every global binding and macro, and everything they refer to,
+// including compiled code, closures and their frames, and the data the types defined with defstruct and deftype
+// are made of. Values are written as a table of objects that refer to each other by index, so shared and circular
+// structure is preserved. Primitives are referred to by name, and must exist in the program loading the image.
+// Values that belong to the running process (channels, tasks, continuations, and so on) cannot be saved.
+
+const imageMagic = "ell image"
+
+// imageVersion must change whenever the layout of objects, or the instruction set, does
+const imageVersion = 5
+
+const (
+	imageNull = iota
+	imageBoolean
+	imageNumber
+	imageString
+	imageCharacter
+	imageName // a symbol, keyword, or type
+	imageEmptyList
+	imageList
+	imageVector
+	imageStruct
+	imageInstance
+	imageError
+	imageBlob
+	imageCode
+	imageClosure
+	imageBuiltin // a primitive, intrinsic, or special function, by name
+	imageParameter
+	imageFrame
+	imageExtension // a value of a type defined with DefineType, as its data
+)
+
+type imageObject struct {
+	Kind   int
+	Text   string
+	Number float64
+	Flag   bool
+	Ints   []int
+	Refs   []int
+	Bytes  []byte
+}
+
+type imageFile struct {
+	Magic   string
+	Version int
+	Objects []imageObject
+	Globals []int // symbols and their values, in pairs
+	Macros  []int // symbols and their expanders, in pairs
+}
+
+// imageWriter - turns values into objects, each value only once
+type imageWriter struct {
+	objects []imageObject
+	index   map[Value]int
+	frames  map[*Frame]int // frames are not values, so they are indexed separately
+	context string         // what is being saved, for errors
+}
+
+func newImageWriter() *imageWriter {
+	return &imageWriter{index: make(map[Value]int), frames: make(map[*Frame]int)}
+}
+
+func (w *imageWriter) refs(vals []Value) ([]int, error) {
+	result := make([]int, len(vals))
+	for i, val := range vals {
+		r, err := w.ref(val)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = r
+	}
+	return result, nil
+}
+
+// ref - the index of the object for the value, adding it (and what it refers to) if necessary. The index is
+// reserved before the value's contents are added, so that circular references resolve to it.
+func (w *imageWriter) ref(val Value) (int, error) {
+	if i, ok := w.index[val]; ok {
+		return i, nil
+	}
+	i := len(w.objects)
+	w.index[val] = i
+	w.objects = append(w.objects, imageObject{})
+	obj, err := w.object(val)
+	if err != nil {
+		return 0, err
+	}
+	w.objects[i] = obj
+	return i, nil
+}
+
+func (w *imageWriter) object(val Value) (imageObject, error) {
+	var err error
+	switch p := val.(type) {
+	case *NullValue:
+		return imageObject{Kind: imageNull}, nil
+	case *Boolean:
+		return imageObject{Kind: imageBoolean, Flag: p.Value}, nil
+	case *Number:
+		return imageObject{Kind: imageNumber, Number: p.Value}, nil
+	case *String:
+		return imageObject{Kind: imageString, Text: p.Value}, nil
+	case *Character:
+		return imageObject{Kind: imageCharacter, Number: float64(p.Value)}, nil
+	case *Symbol:
+		return imageObject{Kind: imageName, Text: p.Text}, nil
+	case *Keyword:
+		return imageObject{Kind: imageName, Text: p.Text}, nil
+	case *Type:
+		return imageObject{Kind: imageName, Text: p.Text}, nil
+	case *List:
+		if p == EmptyList {
+			return imageObject{Kind: imageEmptyList}, nil
+		}
+		obj := imageObject{Kind: imageList, Refs: make([]int, 2)}
+		if obj.Refs[0], err = w.ref(p.Car); err != nil {
+			return obj, err
+		}
+		obj.Refs[1], err = w.ref(p.Cdr)
+		return obj, err
+	case *Vector:
+		obj := imageObject{Kind: imageVector, Flag: p.IsSynchronized()}
+		obj.Refs, err = w.refs(p.Snapshot())
+		return obj, err
+	case *Struct:
+		obj := imageObject{Kind: imageStruct, Flag: p.IsSynchronized()}
+		var kvs []Value
+		for k, v := range p.Snapshot() {
+			kvs = append(kvs, k.ToValue(), v)
+		}
+		obj.Refs, err = w.refs(kvs)
+		return obj, err
+	case *Instance:
+		obj := imageObject{Kind: imageInstance}
+		obj.Refs, err = w.refs([]Value{p.TypeTag, p.Value})
+		return obj, err
+	case *Error:
+		obj := imageObject{Kind: imageError}
+		obj.Refs, err = w.refs([]Value{p.Data})
+		return obj, err
+	case *Blob:
+		return imageObject{Kind: imageBlob, Bytes: p.Value}, nil
+	case *Code:
+		return w.code(p)
+	case *Function:
+		return w.function(p)
+	}
+	if vt, ok := valueTypes[val.Type()]; ok && vt.Write != nil && vt.Read != nil {
+		obj := imageObject{Kind: imageExtension, Text: vt.Name}
+		obj.Refs, err = w.refs([]Value{vt.Write(val)})
+		return obj, err
+	}
+	return imageObject{}, NewError(ErrorKey, "cannot save ", w.context, ": it refers to a ", val.Type())
+}
+
+// frameRef - the index of the object for the frame, or -1 for none. Only what a closure needs of its frame is
+// saved: the variables, and the frame they are nested in.
+func (w *imageWriter) frameRef(frame *Frame) (int, error) {
+	if frame == nil {
+		return -1, nil
+	}
+	if i, ok := w.frames[frame]; ok {
+		return i, nil
+	}
+	i := len(w.objects)
+	w.frames[frame] = i
+	w.objects = append(w.objects, imageObject{})
+	obj := imageObject{Kind: imageFrame, Refs: []int{-1, -1}}
+	var err error
+	if obj.Refs[0], err = w.frameRef(frame.locals); err != nil {
+		return 0, err
+	}
+	if frame.code != nil {
+		if obj.Refs[1], err = w.ref(frame.code); err != nil {
+			return 0, err
+		}
+	}
+	elements, err := w.refs(frame.elements)
+	if err != nil {
+		return 0, err
+	}
+	obj.Refs = append(obj.Refs, elements...)
+	w.objects[i] = obj
+	return i, nil
+}
+
+// code - the instructions are saved with the operands that index the constants replaced by object indices.
+// Ints holds the argc, the number of defaults and of keys (-1 for none), the frame size, the number of declared
+// argument types (-1 if no types are declared), then the instructions. Refs holds the defaults, the keys, and then if
+// types are declared, the argument types and the result type (null for none).
+func (w *imageWriter) code(code *Code) (imageObject, error) {
+	obj := imageObject{Kind: imageCode, Text: code.name}
+	ndefaults, nkeys := -1, -1
+	if code.defaults != nil {
+		ndefaults = len(code.defaults)
+	}
+	if code.keys != nil {
+		nkeys = len(code.keys)
+	}
+	ntypes := -1
+	if code.argtypes != nil || code.result != nil {
+		ntypes = len(code.argtypes)
+	}
+	obj.Ints = append([]int{code.argc, ndefaults, nkeys, code.frameSize, ntypes}, code.ops...)
+	ops := obj.Ints[5:]
+	for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+		if hasConstantOperand(ops[pc]) {
+			r, err := w.ref(constants[ops[pc+1]])
+			if err != nil {
+				return obj, err
+			}
+			ops[pc+1] = r
+		}
+	}
+	refs := append(append([]Value{}, code.defaults...), code.keys...)
+	if ntypes >= 0 {
+		result := code.result
+		if result == nil {
+			result = Null
+		}
+		refs = append(append(refs, code.argtypes...), result)
+	}
+	var err error
+	obj.Refs, err = w.refs(refs)
+	return obj, err
+}
+
+func (w *imageWriter) function(fun *Function) (imageObject, error) {
+	var err error
+	switch {
+	case fun.code != nil:
+		obj := imageObject{Kind: imageClosure, Refs: make([]int, 2)}
+		if obj.Refs[0], err = w.ref(fun.code); err != nil {
+			return obj, err
+		}
+		obj.Refs[1], err = w.frameRef(fun.frame)
+		return obj, err
+	case fun.parameter != nil:
+		obj := imageObject{Kind: imageParameter}
+		fun.parameter.mutex.Lock()
+		vals := []Value{fun.parameter.value, fun.parameter.converter}
+		fun.parameter.mutex.Unlock()
+		obj.Refs, err = w.refs(vals)
+		return obj, err
+	case fun.continuation != nil:
+		return imageObject{}, NewError(ErrorKey, "cannot save ", w.context, ": it refers to a continuation")
+	}
+	return imageObject{Kind: imageBuiltin, Text: builtinName(fun)}, nil
+}
+
+func builtinName(fun *Function) string {
+	switch {
+	case fun.primitive != nil:
+		return fun.primitive.name
+	case fun.intrinsic != nil:
+		return fun.intrinsic.name
+	case fun == Apply:
+		return "apply"
+	case fun == CallCC:
+		return "callcc"
+	case fun == Spawn:
+		return "spawn"
+	}
+	return ""
+}
+
+// builtinFunctions - the functions defined in Go, by name, which is how images refer to them
+func builtinFunctions() map[string]*Function {
+	builtins := map[string]*Function{"apply": Apply, "callcc": CallCC, "spawn": Spawn}
+	for _, sym := range Globals() {
+		if fun, ok := sym.Value.(*Function); ok && fun.parameter == nil {
+			if name := builtinName(fun); name != "" && builtins[name] == nil {
+				builtins[name] = fun
+			}
+		}
+	}
+	for _, mac := range macroMap {
+		if name := builtinName(mac.expander); name != "" && builtins[name] == nil {
+			builtins[name] = mac.expander
+		}
+	}
+	return builtins
+}
+
+func sortedSymbols(syms []Value) {
+	sort.Slice(syms, func(i, j int) bool { return syms[i].String() < syms[j].String() })
+}
+
+// EncodeImage - the image of the current global environment
+func EncodeImage() ([]byte, error) {
+	w := newImageWriter()
+	img := &imageFile{Magic: imageMagic, Version: imageVersion}
+	var globals []Value
+	for _, sym := range Globals() {
+		if sym != loadPathSymbol {
+			globals = append(globals, sym)
+		}
+	}
+	sortedSymbols(globals)
+	for _, sym := range globals {
+		w.context = "the value of " + sym.String()
+		s, err := w.ref(sym)
+		if err != nil {
+			return nil, err
+		}
+		v, err := w.ref(GetGlobal(sym))
+		if err != nil {
+			return nil, err
+		}
+		img.Globals = append(img.Globals, s, v)
+	}
+	macros := Macros()
+	sortedSymbols(macros)
+	for _, sym := range macros {
+		w.context = "the macro " + sym.String()
+		s, err := w.ref(sym)
+		if err != nil {
+			return nil, err
+		}
+		m, err := w.ref(macroMap[sym].expander)
+		if err != nil {
+			return nil, err
+		}
+		img.Macros = append(img.Macros, s, m)
+	}
+	img.Objects = w.objects
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// imageReader - makes the values back from the objects. Every object is first made as an empty value, and then
+// filled in, so that circular references work. Values of extension types are made from their data when first
+// needed, since their Read function needs it to be complete.
+type imageReader struct {
+	objects  []imageObject
+	values   []Value
+	frames   []*Frame
+	filled   []bool
+	builtins map[string]*Function
+}
+
+func newImageReader(objects []imageObject) (*imageReader, error) {
+	r := &imageReader{
+		objects:  objects,
+		values:   make([]Value, len(objects)),
+		frames:   make([]*Frame, len(objects)),
+		filled:   make([]bool, len(objects)),
+		builtins: builtinFunctions(),
+	}
+	for i, obj := range objects {
+		if err := r.make(i, obj); err != nil {
+			return nil, err
+		}
+	}
+	for i := range objects {
+		if err := r.fill(i); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *imageReader) make(i int, obj imageObject) error {
+	var val Value
+	switch obj.Kind {
+	case imageNull:
+		val = Null
+	case imageBoolean:
+		val = False
+		if obj.Flag {
+			val = True
+		}
+	case imageNumber:
+		val = Float(obj.Number)
+	case imageString:
+		val = NewString(obj.Text)
+	case imageCharacter:
+		val = NewCharacter(rune(obj.Number))
+	case imageName:
+		val = Intern(obj.Text)
+	case imageEmptyList:
+		val = EmptyList
+	case imageList:
+		val = new(List)
+	case imageVector:
+		v := VectorFromElementsNoCopy(make([]Value, len(obj.Refs)))
+		if obj.Flag {
+			v.Synchronize()
+		}
+		val = v
+	case imageStruct:
+		s := NewStruct()
+		if obj.Flag {
+			s.Synchronize()
+		}
+		val = s
+	case imageInstance:
+		val = new(Instance)
+	case imageError:
+		val = new(Error)
+	case imageBlob:
+		val = NewBlob(obj.Bytes)
+	case imageCode:
+		val = new(Code)
+	case imageClosure:
+		val = new(Function)
+	case imageBuiltin:
+		fun, ok := r.builtins[obj.Text]
+		if !ok {
+			return NewError(ErrorKey, "the image refers to an undefined primitive: ", obj.Text)
+		}
+		val = fun
+	case imageParameter:
+		val = NewParameter(Null, Null)
+	case imageFrame:
+		r.frames[i] = new(Frame)
+		return nil
+	case imageExtension:
+		if vt, ok := valueTypes[Intern(obj.Text)]; !ok || vt.Read == nil {
+			return NewError(ErrorKey, "the image contains a value of an undefined type: ", obj.Text)
+		}
+		return nil //made when it is filled in
+	default:
+		return NewError(ErrorKey, "bad object in image: ", obj.Kind)
+	}
+	r.values[i] = val
+	return nil
+}
+
+// badImage - the error for an image whose objects do not fit together, so that a corrupt file cannot crash the
+// reader
+func badImage(what string) error {
+	return NewError(SyntaxErrorKey, "bad ", what, " in image")
+}
+
+// value - the value of the object at the index, which comes from the image and so is checked. A negative index
+// is for no value
+func (r *imageReader) value(i int) (Value, error) {
+	if i < 0 {
+		return nil, nil
+	}
+	if i >= len(r.values) {
+		return nil, badImage("reference")
+	}
+	if r.values[i] == nil && r.objects[i].Kind == imageExtension {
+		if err := r.fill(i); err != nil {
+			return nil, err
+		}
+	}
+	return r.values[i], nil
+}
+
+// object - the value of the object at the index, which must be there
+func (r *imageReader) object(i int) (Value, error) {
+	val, err := r.value(i)
+	if err == nil && val == nil {
+		err = badImage("reference")
+	}
+	return val, err
+}
+
+func (r *imageReader) frame(i int) (*Frame, error) {
+	if i < 0 {
+		return nil, nil
+	}
+	if i >= len(r.frames) || r.frames[i] == nil {
+		return nil, badImage("frame reference")
+	}
+	return r.frames[i], nil
+}
+
+func (r *imageReader) valuesOf(refs []int) ([]Value, error) {
+	vals := make([]Value, len(refs))
+	for j, ref := range refs {
+		val, err := r.value(ref)
+		if err != nil {
+			return nil, err
+		}
+		vals[j] = val
+	}
+	return vals, nil
+}
+
+func (r *imageReader) fill(i int) error {
+	if r.filled[i] {
+		return nil
+	}
+	r.filled[i] = true
+	obj := r.objects[i]
+	switch obj.Kind {
+	case imageFrame:
+		if len(obj.Refs) < 2 {
+			return badImage("frame")
+		}
+		frame := r.frames[i]
+		var err error
+		if frame.locals, err = r.frame(obj.Refs[0]); err != nil {
+			return err
+		}
+		if obj.Refs[1] >= 0 {
+			code, err := r.value(obj.Refs[1])
+			if err != nil {
+				return err
+			}
+			frame.code, _ = code.(*Code)
+		}
+		frame.elements, err = r.valuesOf(obj.Refs[2:])
+		return err
+	case imageClosure:
+		if len(obj.Refs) < 2 {
+			return badImage("function")
+		}
+		fun := r.values[i].(*Function)
+		code, err := r.value(obj.Refs[0])
+		if err != nil {
+			return err
+		}
+		fun.code, _ = code.(*Code)
+		if fun.code == nil {
+			return badImage("function")
+		}
+		fun.frame, err = r.frame(obj.Refs[1])
+		return err
+	}
+	vals, err := r.valuesOf(obj.Refs)
+	if err != nil {
+		return err
+	}
+	switch p := r.values[i].(type) {
+	case *List:
+		if p == EmptyList {
+			return nil
+		}
+		if len(vals) < 2 {
+			return badImage("list")
+		}
+		cdr, ok := vals[1].(*List)
+		if !ok {
+			return badImage("list")
+		}
+		p.Car, p.Cdr = vals[0], cdr
+	case *Vector:
+		copy(p.Elements, vals)
+	case *Struct:
+		for j := 0; j+1 < len(vals); j += 2 {
+			p.Put(vals[j], vals[j+1])
+		}
+	case *Instance:
+		if len(vals) < 2 {
+			return badImage("instance")
+		}
+		p.TypeTag, p.Value = vals[0], vals[1]
+	case *Error:
+		if len(vals) < 1 {
+			return badImage("error")
+		}
+		p.Data = vals[0]
+	case *Code:
+		return r.fillCode(p, obj, vals)
+	case *Function:
+		if obj.Kind == imageParameter {
+			if len(vals) < 2 {
+				return badImage("parameter")
+			}
+			p.parameter.value, p.parameter.converter = vals[0], vals[1]
+		}
+	case nil:
+		if obj.Kind == imageExtension {
+			if len(vals) < 1 {
+				return badImage("value")
+			}
+			val, err := valueTypes[Intern(obj.Text)].Read(vals[0])
+			if err != nil {
+				return err
+			}
+			r.values[i] = val
+		}
+	}
+	return nil
+}
+
+func (r *imageReader) fillCode(code *Code, obj imageObject, vals []Value) error {
+	if len(obj.Ints) < 5 {
+		return badImage("code")
+	}
+	code.name = obj.Text
+	code.argc = obj.Ints[0]
+	ndefaults, nkeys, ntypes := obj.Ints[1], obj.Ints[2], obj.Ints[4]
+	need := 0
+	for _, n := range []int{ndefaults, nkeys, ntypes + 1} {
+		if n > 0 {
+			need += n
+		}
+	}
+	if need > len(vals) {
+		return badImage("code")
+	}
+	if ndefaults >= 0 {
+		code.defaults = vals[:ndefaults]
+		vals = vals[ndefaults:]
+	}
+	if nkeys >= 0 {
+		code.keys = vals[:nkeys]
+		vals = vals[nkeys:]
+	}
+	code.frameSize = obj.Ints[3]
+	if ntypes >= 0 {
+		if ntypes > 0 {
+			code.argtypes = vals[:ntypes]
+		}
+		if vals[ntypes] != Null {
+			code.result = vals[ntypes]
+		}
+	}
+	code.ops = append([]int{}, obj.Ints[5:]...)
+	ops := code.ops
+	for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+		if ops[pc] < 0 || ops[pc] >= opcodeCount || pc+opcodeWidth(ops[pc]) > len(ops) {
+			return badImage("instruction")
+		}
+		if hasConstantOperand(ops[pc]) {
+			val, err := r.object(ops[pc+1])
+			if err != nil {
+				return err
+			}
+			ops[pc+1] = putConstant(val)
+		}
+	}
+	return nil
+}
+
+func decodeImage(data []byte) (*imageFile, error) {
+	img := new(imageFile)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(img); err != nil || img.Magic != imageMagic {
+		return nil, NewError(ErrorKey, "not an ell image")
+	}
+	if img.Version != imageVersion {
+		return nil, NewError(ErrorKey, "the image is version ", img.Version, ", not ", imageVersion)
+	}
+	return img, nil
+}
+
+// DecodeImage - define the global bindings and macros from the image. Bindings not in the image are unchanged.
+func DecodeImage(data []byte) error {
+	img, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+	r, err := newImageReader(img.Objects)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(img.Globals); i += 2 {
+		name, err := r.object(img.Globals[i])
+		if err != nil {
+			return err
+		}
+		val, err := r.object(img.Globals[i+1])
+		if err != nil {
+			return err
+		}
+		sym, ok := name.(*Symbol)
+		if !ok {
+			return badImage("global")
+		}
+		defGlobal(sym, val)
+	}
+	for i := 0; i+1 < len(img.Macros); i += 2 {
+		sym, err := r.object(img.Macros[i])
+		if err != nil {
+			return err
+		}
+		fun, err := r.object(img.Macros[i+1])
+		if err != nil {
+			return err
+		}
+		expander, ok := fun.(*Function)
+		if !ok {
+			return badImage("macro")
+		}
+		defMacro(sym, expander)
+	}
+	return nil
+}
+
+// SaveImage - write the image of the current global environment to the file
+func SaveImage(path string) error {
+	data, err := EncodeImage()
+	if err != nil {
+		return err
+	}
+	return SpitFile(path, string(data))
+}
+
+// LoadImage - define the global bindings and macros saved in the image file
+func LoadImage(path string) error {
+	data, err := SlurpFile(path)
+	if err != nil {
+		return err
+	}
+	return DecodeImage([]byte(data))
+}
+
+func ellSaveImage(vm *vm, argv []Value) (Value, error) {
+	path, err := vm.caps.path(ExpandFilePath(StringValue(argv[0])), true)
+	if err != nil {
+		return nil, err
+	}
+	err = SaveImage(path)
+	if err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+func ellLoadImage(vm *vm, argv []Value) (Value, error) {
+	path, err := vm.caps.path(ExpandFilePath(StringValue(argv[0])), false)
+	if err != nil {
+		return nil, err
+	}
+	err = LoadImage(path)
+	if err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
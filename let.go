@@ -0,0 +1,377 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	. "github.com/boynton/ell/data"
+)
+
+// Compiling let without closures. A let expands to a call of a new function:
+//
+//   (let ((x 1)) body ...)         -> ((fn (x) body ...) 1)
+//   (let loop ((x 1)) body ...)    -> ((fn (loop) (set! loop (fn (x) body ...)) (loop 1)) null)
+//
+// Inside a function, the compiler recognizes these, and binds the variables in extra slots of the function's own
+// frame instead, so that neither a closure nor a frame is made. A named let whose name is only called in tail
+// position becomes a loop: the call stores the new values in the slots and jumps back to the start of the body.
+// The slots are reused by later lets, so this is only done if nothing in the body could capture the frame: the body
+// makes no closures, and calls no function that might capture a continuation of its caller, i.e. only primitives,
+// and functions written in Ell that call nothing but such functions. Otherwise the let is compiled as the call it
+// expands to.
+
+// loop - a named let being compiled as a loop
+type loop struct {
+	name  Value // the name of the let
+	base  int   // the slot of the first variable
+	argc  int   // the number of variables
+	start int   // the location of the start of the body
+}
+
+// letForm - the variables, initial values, and body of an expanded let, if it can be compiled into the frame
+func letForm(env *List, expr *List) (*List, *List, *List, bool) {
+	head, ok := expr.Car.(*List)
+	if !ok || head == EmptyList || head.Car != Intern("fn") || ListLength(head) < 3 {
+		return nil, nil, nil, false
+	}
+	vars, ok := Cadr(head).(*List)
+	if !ok || !isVariableList(vars) || ListLength(vars) != ListLength(expr.Cdr) {
+		return nil, nil, nil, false
+	}
+	body := Cddr(head)
+	if capturesAny(Cons(vars, env), body, nil) {
+		return nil, nil, nil, false
+	}
+	return vars, expr.Cdr, body, true
+}
+
+// loopForm - the name, variables, initial values, and body of an expanded named let, if it can be compiled as a loop
+func loopForm(env *List, expr *List) (Value, *List, *List, *List, bool) {
+	head, ok := expr.Car.(*List)
+	if !ok || head == EmptyList || head.Car != Intern("fn") || ListLength(head) != 4 || ListLength(expr) != 2 || expr.Cdr.Car != Null {
+		return nil, nil, nil, nil, false
+	}
+	outer, ok := Cadr(head).(*List)
+	if !ok || ListLength(outer) != 1 || !IsSymbol(outer.Car) {
+		return nil, nil, nil, nil, false
+	}
+	name := outer.Car
+	set, ok := Caddr(head).(*List)
+	if !ok || ListLength(set) != 3 || set.Car != Intern("set!") || Cadr(set) != name {
+		return nil, nil, nil, nil, false
+	}
+	fn, ok := Caddr(set).(*List)
+	if !ok || ListLength(fn) < 3 || fn.Car != Intern("fn") {
+		return nil, nil, nil, nil, false
+	}
+	vars, ok := Cadr(fn).(*List)
+	if !ok || !isVariableList(vars) || memberOf(name, vars) {
+		return nil, nil, nil, nil, false
+	}
+	call, ok := Cadddr(head).(*List)
+	if !ok || call == EmptyList || call.Car != name || ListLength(call.Cdr) != ListLength(vars) || mentions(call.Cdr, name) {
+		return nil, nil, nil, nil, false
+	}
+	body := Cddr(fn)
+	if capturesAny(Cons(vars, env), body, name) || !onlyLoopsBy(env, body, name, ListLength(vars)) {
+		return nil, nil, nil, nil, false
+	}
+	return name, vars, call.Cdr, body, true
+}
+
+func isVariableList(vars *List) bool {
+	for ; vars != EmptyList; vars = vars.Cdr {
+		if !IsSymbol(vars.Car) || vars.Car == Intern("&") {
+			return false
+		}
+	}
+	return true
+}
+
+func memberOf(val Value, lst *List) bool {
+	for ; lst != EmptyList; lst = lst.Cdr {
+		if lst.Car == val {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions - true if the symbol appears anywhere in the expression outside of quoted data
+func mentions(expr Value, sym Value) bool {
+	switch p := expr.(type) {
+	case *Symbol:
+		return p == sym
+	case *List:
+		if p != EmptyList && p.Car == Intern("quote") {
+			return false
+		}
+		for ; p != EmptyList; p = p.Cdr {
+			if mentions(p.Car, sym) {
+				return true
+			}
+		}
+	case *Vector:
+		for _, e := range p.Elements {
+			if mentions(e, sym) {
+				return true
+			}
+		}
+	case *Struct:
+		for k, v := range p.Bindings {
+			if mentions(k.ToValue(), sym) || mentions(v, sym) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// captures - true if running the expression might capture the current frame: if compiling it would make a closure
+// over the frame, or if it calls a function that might capture a continuation, which refers to the frame too. Calls
+// of the loop, which are jumps, do not.
+func captures(env *List, expr Value, loop Value) bool {
+	switch p := expr.(type) {
+	case *List:
+		if p == EmptyList || p.Car == Intern("quote") {
+			return false
+		}
+		if p.Car == Intern("fn") || p.Car == Intern("code") {
+			return true
+		}
+		if _, ok := p.Car.(*List); ok {
+			if _, _, inits, _, ok := loopForm(env, p); ok {
+				return capturesAny(env, inits, loop)
+			}
+			if _, inits, _, ok := letForm(env, p); ok {
+				return capturesAny(env, inits, loop)
+			}
+		}
+		if p.Car != loop && !knownCall(env, p.Car) {
+			return true
+		}
+		return capturesAny(env, p.Cdr, loop)
+	case *Vector:
+		for _, e := range p.Elements {
+			if captures(env, e, loop) {
+				return true
+			}
+		}
+	case *Struct:
+		for k, v := range p.Bindings {
+			if captures(env, k.ToValue(), loop) || captures(env, v, loop) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capturesAny - true if running any of the expressions might capture the current frame
+func capturesAny(env *List, exprs *List, loop Value) bool {
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		if captures(env, exprs.Car, loop) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownCall - true if the head of a list is a special form, or names a function that cannot capture a continuation
+// of its caller. As for the other calls of globals the compiler relies on, it is the function defined when the call
+// is compiled.
+func knownCall(env *List, fn Value) bool {
+	switch fn {
+	case Intern("do"), Intern("if"), Intern("def"), Intern("undef"), Intern("defmacro"), Intern("set!"), Intern("use"):
+		return true
+	}
+	switch f := fn.(type) {
+	case *Keyword:
+		return true
+	case *Symbol:
+		if _, _, local := calculateLocation(f, env); local {
+			return false
+		}
+		fun, ok := f.Value.(*Function)
+		return ok && cannotCapture(fun, make(map[*Code]bool))
+	}
+	return false
+}
+
+// cannotCapture - true if calling the function cannot capture a continuation of its caller: it is a primitive, or a
+// function written in Ell whose calls are all of such functions. Callcc might, and so might apply, an intrinsic, or
+// a function that is not a global. A function already being checked is assumed not to, as a recursive call adds
+// nothing to what the rest of its calls do.
+func cannotCapture(fun *Function, checking map[*Code]bool) bool {
+	if fun.primitive != nil {
+		return true
+	}
+	if fun.code == nil {
+		return false
+	}
+	if checking[fun.code] {
+		return true
+	}
+	checking[fun.code] = true
+	ops := fun.code.ops
+	for pc := 0; pc < len(ops); pc += opcodeWidth(ops[pc]) {
+		switch ops[pc] {
+		case opcodeCall, opcodeTailCall:
+			return false
+		case opcodeCallGlobal, opcodeTailCallGlobal:
+			callee, ok := constants[ops[pc+1]].(*Symbol).Value.(*Function)
+			if !ok || !cannotCapture(callee, checking) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// onlyLoopsBy - true if the body uses the name only to call it with argc arguments in tail position
+func onlyLoopsBy(env *List, body *List, name Value, argc int) bool {
+	for ; body != EmptyList; body = body.Cdr {
+		if !loopsBy(env, body.Car, name, argc, body.Cdr == EmptyList) {
+			return false
+		}
+	}
+	return true
+}
+
+func loopsBy(env *List, expr Value, name Value, argc int, isTail bool) bool {
+	lst, ok := expr.(*List)
+	if !ok || lst == EmptyList {
+		return !mentions(expr, name)
+	}
+	switch lst.Car {
+	case Intern("quote"):
+		return true
+	case Intern("if"):
+		if lstlen := ListLength(lst); lstlen == 3 || lstlen == 4 {
+			if !loopsBy(env, Cadr(lst), name, argc, false) {
+				return false
+			}
+			for branches := Cddr(lst); branches != EmptyList; branches = branches.Cdr {
+				if !loopsBy(env, branches.Car, name, argc, isTail) {
+					return false
+				}
+			}
+			return true
+		}
+	case Intern("do"):
+		if isTail {
+			return onlyLoopsBy(env, lst.Cdr, name, argc)
+		}
+	case name:
+		if isTail && ListLength(lst.Cdr) == argc {
+			return !mentions(lst.Cdr, name)
+		}
+		return false
+	}
+	if _, ok := lst.Car.(*List); ok {
+		if label, vars, inits, body, ok := loopForm(env, lst); ok {
+			if mentions(inits, name) {
+				return false
+			}
+			return label == name || memberOf(name, vars) || !mentions(body, name)
+		}
+		if vars, inits, body, ok := letForm(env, lst); ok {
+			if mentions(inits, name) {
+				return false
+			}
+			if memberOf(name, vars) {
+				return true
+			}
+			if isTail {
+				return onlyLoopsBy(env, body, name, argc)
+			}
+			return !mentions(body, name)
+		}
+	}
+	return !mentions(expr, name)
+}
+
+// compileLet - compile an expanded let whose variables can be bound in the frame
+func compileLet(target *Code, env *List, vars *List, inits *List, body *List, isTail bool, ignoreResult bool, context string) error {
+	newEnv, _, err := compileBindings(target, env, vars, inits, context)
+	if err != nil {
+		return err
+	}
+	return compileSequence(target, newEnv, body, isTail, ignoreResult, context)
+}
+
+// compileLoop - compile an expanded named let as a loop
+func compileLoop(target *Code, env *List, name Value, vars *List, inits *List, body *List, isTail bool, ignoreResult bool, context string) error {
+	newEnv, base, err := compileBindings(target, env, vars, inits, context)
+	if err != nil {
+		return err
+	}
+	target.loops = append(target.loops, &loop{name: name, base: base, argc: ListLength(vars), start: len(target.ops)})
+	err = compileSequence(target, newEnv, body, isTail, ignoreResult, context)
+	target.loops = target.loops[:len(target.loops)-1]
+	return err
+}
+
+// compileBindings - evaluate the initial values and store them in new slots at the end of the frame. Returns the
+// environment with the variables added, and the slot of the first one.
+func compileBindings(target *Code, env *List, vars *List, inits *List, context string) (*List, int, error) {
+	err := compileArgs(target, env, inits, context)
+	if err != nil {
+		return nil, 0, err
+	}
+	frame := env.Car.(*List)
+	base := ListLength(frame)
+	n := ListLength(vars)
+	for j := 0; j < n; j++ {
+		target.emitSetLocal(0, base+j)
+		target.emitPop()
+	}
+	if base+n > target.frameSize {
+		target.frameSize = base + n
+	}
+	extended, err := Concat(frame, vars)
+	if err != nil {
+		return nil, 0, err
+	}
+	return Cons(extended, env.Cdr), base, nil
+}
+
+// loopFor - the loop a call of the symbol goes back to the start of, if any. A variable bound inside the loop hides it.
+func loopFor(target *Code, env *List, fn Value) *loop {
+	for i := len(target.loops) - 1; i >= 0; i-- {
+		if lp := target.loops[i]; lp.name == fn {
+			if i, j, ok := calculateLocation(fn, env); ok && i == 0 && j >= lp.base+lp.argc {
+				return nil
+			}
+			return lp
+		}
+	}
+	return nil
+}
+
+// compileLoopCall - store the arguments in the loop's variables, and jump back to the start of its body
+func compileLoopCall(target *Code, env *List, lp *loop, args *List, context string) error {
+	err := compileArgs(target, env, args, context)
+	if err != nil {
+		return err
+	}
+	for j := 0; j < lp.argc; j++ {
+		target.emitSetLocal(0, lp.base+j)
+		target.emitPop()
+	}
+	target.emitJump(lp.start - len(target.ops))
+	return nil
+}
@@ -0,0 +1,591 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Compiler warnings. Lint reads a source file, expands its macros, and walks the expanded forms looking for code
+// that compiles but is probably wrong: a reference to a global that is never defined, a call to a known function
+// with the wrong number of arguments, and a function parameter or let binding that is never used. Names starting
+// with an underscore are never reported as unused.
+//
+// To know the macros and functions the file defines, its top level definitions of functions, constants, and macros
+// are compiled as they are read, and the modules it uses are read the same way. Nothing is defined globally, and
+// nothing else in the file is run, except the expanders of its macros, when they are used. A module only available
+// compiled, as a .lvm file or linked into the program, is loaded as using it would.
+
+// Warning - a problem found in a source file
+type Warning struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (w *Warning) String() string {
+	return fmt.Sprintf("%s:%d: %s", w.File, w.Line, w.Message)
+}
+
+// noteExpansion - give the expansion of a list its line, unless it already has one
+func (x *expander) noteExpansion(from *List, to Value) {
+	if x.lines == nil {
+		return
+	}
+	if lst, ok := to.(*List); ok && lst != EmptyList {
+		if _, ok := x.lines[lst]; !ok {
+			if line, ok := x.lines[from]; ok {
+				x.lines[lst] = line
+			}
+		}
+	}
+}
+
+// Lint - the warnings for the source file, in the order of their lines
+func Lint(name string) ([]*Warning, error) {
+	file, exprs, lines, err := readSource(name)
+	if err != nil {
+		return nil, err
+	}
+	x := newSourceExpander(lines)
+	expanded, err := x.expandSource(exprs)
+	if err != nil {
+		return nil, err
+	}
+	l := &linter{report: newReport(file, x), defined: make(map[Value]bool), arities: make(map[Value]arity)}
+	for _, expr := range expanded {
+		l.walk(expr, 0)
+	}
+	l.checkGlobals()
+	return l.sorted(), nil
+}
+
+// readSource - read the forms of the source file, and the line each list was read from
+func readSource(name string) (string, *List, map[*List]int, error) {
+	file, err := FindModuleFile(name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	fileText, err := SlurpFile(file)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	lines := make(map[*List]int)
+	reader := &Reader{
+		Input:    bufio.NewReader(strings.NewReader(fileText)),
+		Position: 0,
+		Lines:    lines,
+	}
+	reader.Extension = &EllReaderExtension{r: reader}
+	exprs, err := reader.ReadAll()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return file, exprs, lines, nil
+}
+
+// newSourceExpander - an expander for a source file, with the line each list was read from
+func newSourceExpander(lines map[*List]int) *expander {
+	return &expander{
+		macros:  make(map[Value]*macro),
+		lines:   lines,
+		globals: make(map[Value]Value),
+		modules: make(map[string]bool),
+	}
+}
+
+// expandSource - expand the macros in each form, noting its definitions before the next is expanded
+func (x *expander) expandSource(exprs *List) ([]Value, error) {
+	var expanded []Value
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		expr, err := x.macroexpandObject(exprs.Car)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.define(expr); err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, expr)
+	}
+	return expanded, nil
+}
+
+// define - note the definitions of globals and macros in the expanded form, and those of the modules it uses. The
+// values of functions and quoted constants are compiled, so that their arities and types are known.
+func (x *expander) define(expr Value) error {
+	lst, ok := expr.(*List)
+	if !ok || lst == EmptyList {
+		return nil
+	}
+	switch lst.Car {
+	case Intern("do"):
+		for body := lst.Cdr; body != EmptyList; body = body.Cdr {
+			if err := x.define(body.Car); err != nil {
+				return err
+			}
+		}
+	case Intern("def"):
+		sym := Cadr(lst)
+		var val Value
+		if form, ok := Caddr(lst).(*List); ok && form != EmptyList && (form.Car == Intern("fn") || form.Car == Intern("quote")) {
+			v, err := compileValueOf(form)
+			if err != nil {
+				return err
+			}
+			val = v
+		}
+		x.globals[sym] = val
+		if x.macro(sym) != nil {
+			x.macros[sym] = nil
+		}
+	case Intern("defmacro"):
+		v, err := compileValueOf(Caddr(lst))
+		if err != nil {
+			return err
+		}
+		expander, ok := v.(*Function)
+		if !ok {
+			return NewError(MacroErrorKey, "Bad macro expander function: ", v)
+		}
+		x.macros[Cadr(lst)] = NewMacro(Cadr(lst), expander)
+	case Intern("use"):
+		if sym, ok := Cadr(lst).(*Symbol); ok {
+			return x.use(sym.Text)
+		}
+	}
+	return nil
+}
+
+// compileValueOf - the value of the expanded expression, which must not refer to any variables
+func compileValueOf(expr Value) (Value, error) {
+	code, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return importCode(code, nil)
+}
+
+// use - note the definitions of the module, unless it has been used already
+func (x *expander) use(name string) error {
+	if x.modules[name] {
+		return nil
+	}
+	x.modules[name] = true
+	if _, ok := findLinkedModule(name); ok || x.load {
+		return Load(name)
+	}
+	file, err := FindModuleFile(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(file, ".lvm") {
+		return Load(name)
+	}
+	text, err := SlurpFile(file)
+	if err != nil {
+		return err
+	}
+	exprs, err := ReadAllFromString(text)
+	if err != nil {
+		return err
+	}
+	_, err = x.expandSource(exprs)
+	return err
+}
+
+// global - the value of the global, as defined by the file and the modules it uses, or else globally. A global
+// the file defines has a nil value if it is not known.
+func (x *expander) global(sym Value) (Value, bool) {
+	if val, ok := x.globals[sym]; ok {
+		return val, true
+	}
+	val := GetGlobal(sym)
+	return val, val != nil
+}
+
+// report - the warnings found in a source file
+type report struct {
+	file     string
+	x        *expander // the expander of the file, which knows its definitions and lines
+	warnings []*Warning
+	seen     map[string]bool
+}
+
+func newReport(file string, x *expander) *report {
+	return &report{file: file, x: x, seen: make(map[string]bool)}
+}
+
+// sourceLine - the line the list, or the one it was expanded from, was read from, or 0 if it is not known
+func (r *report) sourceLine(lst *List) int {
+	return r.x.lines[lst]
+}
+
+// warn - add a warning, unless it has been made already, as it is when a macro repeats part of its form
+func (r *report) warn(line int, args ...interface{}) {
+	w := &Warning{File: r.file, Line: line, Message: fmt.Sprint(args...)}
+	if !r.seen[w.String()] {
+		r.seen[w.String()] = true
+		r.warnings = append(r.warnings, w)
+	}
+}
+
+// sorted - the warnings, in the order of their lines
+func (r *report) sorted() []*Warning {
+	sort.SliceStable(r.warnings, func(i, j int) bool {
+		return r.warnings[i].Line < r.warnings[j].Line
+	})
+	return r.warnings
+}
+
+// arity - the number of arguments a function accepts
+type arity struct {
+	min  int
+	max  int  // -1 if there is no limit
+	keys bool // the arguments after the first min are keyword/value pairs
+}
+
+func (a arity) accepts(argc int) bool {
+	if argc < a.min || (a.max >= 0 && argc > a.max) {
+		return false
+	}
+	return !a.keys || (argc-a.min)%2 == 0
+}
+
+func (a arity) String() string {
+	if a.keys {
+		return fmt.Sprintf("%s followed by keyword/value pairs", argcString(a.min, a.min))
+	}
+	return argcString(a.min, a.max)
+}
+
+// functionArity - the arity of the function, if it is known
+func functionArity(fun *Function) (arity, bool) {
+	if prim := fun.primitive; prim != nil {
+		if prim.argc < 0 {
+			return arity{}, false
+		}
+		switch {
+		case prim.defaults == nil:
+			return arity{prim.argc, prim.argc, false}, true
+		case len(prim.defaults) == 0:
+			return arity{prim.argc, -1, false}, true
+		case prim.keys != nil:
+			return arity{prim.argc, -1, true}, true
+		}
+		return arity{prim.argc, len(prim.args), false}, true
+	}
+	if code := fun.code; code != nil {
+		switch {
+		case code.defaults == nil:
+			return arity{code.argc, code.argc, false}, true
+		case len(code.defaults) == 0:
+			return arity{code.argc, -1, false}, true
+		case code.keys != nil:
+			return arity{code.argc, -1, true}, true
+		}
+		return arity{code.argc, code.argc + len(code.defaults), false}, true
+	}
+	return arity{}, false
+}
+
+// fnArity - the arity of a function with the parameters of a fn form
+func fnArity(args Value) arity {
+	lst, ok := args.(*List)
+	if !ok {
+		return arity{0, -1, false}
+	}
+	argc := 0
+	for ; lst != EmptyList; lst = lst.Cdr {
+		switch p := lst.Car.(type) {
+		case *Vector:
+			return arity{argc, argc + len(p.Elements), false}
+		case *Struct:
+			return arity{argc, -1, true}
+		}
+		if lst.Car == Intern("&") {
+			return arity{argc, -1, false}
+		}
+		argc++
+	}
+	return arity{argc, argc, false}
+}
+
+// fnParameters - the variables bound by the parameters of a fn form
+func fnParameters(args Value) []Value {
+	syms, _ := fnParameterTypes(args)
+	return syms
+}
+
+// fnParameterTypes - the variables bound by the parameters of a fn form, and the types of their values: the declared
+// type of a required parameter, <list> for the rest of the arguments, and <any> otherwise
+func fnParameterTypes(args Value) ([]Value, []Value) {
+	if IsSymbol(args) {
+		return []Value{args}, []Value{ListType}
+	}
+	if vec, ok := args.(*Vector); ok {
+		args, _ = ToList(vec)
+	}
+	lst, ok := args.(*List)
+	if !ok {
+		return nil, nil
+	}
+	var syms, types []Value
+	rest := false
+	for ; lst != EmptyList; lst = lst.Cdr {
+		switch p := lst.Car.(type) {
+		case *Vector:
+			for _, sym := range p.Elements {
+				if l, ok := sym.(*List); ok && l != EmptyList {
+					sym = l.Car
+				}
+				syms = append(syms, sym)
+				types = append(types, AnyType)
+			}
+		case *Struct:
+			for k := range p.Bindings {
+				sym := k.ToValue()
+				if IsList(sym) && Car(sym) == Intern("quote") && Cdr(sym) != EmptyList {
+					sym = Cadr(sym)
+				} else if s, err := Unkeyworded(sym); err == nil {
+					sym = s
+				}
+				syms = append(syms, sym)
+				types = append(types, AnyType)
+			}
+		case *List:
+			if p != EmptyList {
+				// a parameter with a declared type
+				t := AnyType
+				if IsType(Cadr(p)) {
+					t = Cadr(p)
+				}
+				syms = append(syms, p.Car)
+				types = append(types, t)
+			}
+		default:
+			if lst.Car == Intern("&") {
+				rest = true
+			} else if rest {
+				syms = append(syms, lst.Car)
+				types = append(types, ListType)
+			} else {
+				syms = append(syms, lst.Car)
+				types = append(types, AnyType)
+			}
+		}
+	}
+	return syms, types
+}
+
+type linter struct {
+	*report
+	scopes  []*lintScope    // the local variables, innermost last
+	defined map[Value]bool  // the globals defined in the file
+	arities map[Value]arity // the arities of the functions defined in the file
+	globals []*globalRef    // the references to globals, checked when the whole file has been seen
+}
+
+type lintScope struct {
+	kind string // "parameter" or "let binding"
+	line int
+	vars []*lintVar
+}
+
+type lintVar struct {
+	sym  Value
+	used bool
+}
+
+// globalRef - a reference to a global. If it is called, argc is the number of arguments, otherwise -1.
+type globalRef struct {
+	sym  *Symbol
+	argc int
+	line int
+}
+
+// lookup - the local variable the symbol refers to, if any
+func (l *linter) lookup(sym Value) *lintVar {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		vars := l.scopes[i].vars
+		for j := len(vars) - 1; j >= 0; j-- {
+			if vars[j].sym == sym {
+				return vars[j]
+			}
+		}
+	}
+	return nil
+}
+
+func (l *linter) push(kind string, line int, syms []Value) {
+	scope := &lintScope{kind: kind, line: line}
+	for _, sym := range syms {
+		scope.vars = append(scope.vars, &lintVar{sym: sym})
+	}
+	l.scopes = append(l.scopes, scope)
+}
+
+func (l *linter) pop() {
+	scope := l.scopes[len(l.scopes)-1]
+	l.scopes = l.scopes[:len(l.scopes)-1]
+	for _, v := range scope.vars {
+		if sym, ok := v.sym.(*Symbol); ok && !v.used && !strings.HasPrefix(sym.Text, "_") {
+			l.warn(scope.line, "unused ", scope.kind, ": ", sym)
+		}
+	}
+}
+
+func (l *linter) reference(sym *Symbol, argc int, line int) {
+	if v := l.lookup(sym); v != nil {
+		v.used = true
+	} else {
+		l.globals = append(l.globals, &globalRef{sym, argc, line})
+	}
+}
+
+func (l *linter) walkSequence(lst *List, line int) {
+	for ; lst != EmptyList; lst = lst.Cdr {
+		l.walk(lst.Car, line)
+	}
+}
+
+// walk - note the variables the expanded expression uses. The line is that of the nearest enclosing list read from
+// the source.
+func (l *linter) walk(expr Value, line int) {
+	switch p := expr.(type) {
+	case *Symbol:
+		l.reference(p, -1, line)
+	case *Vector:
+		for _, e := range p.Elements {
+			l.walk(e, line)
+		}
+	case *Struct:
+		for k, v := range p.Bindings {
+			l.walk(k.ToValue(), line)
+			l.walk(v, line)
+		}
+	case *List:
+		if p == EmptyList {
+			return
+		}
+		if n := l.sourceLine(p); n > 0 {
+			line = n
+		}
+		l.walkList(p, line)
+	}
+}
+
+func (l *linter) walkList(lst *List, line int) {
+	switch lst.Car {
+	case Intern("quote"), Intern("code"), Intern("use"), Intern("undef"):
+		return
+	case Intern("do"), Intern("if"):
+		l.walkSequence(lst.Cdr, line)
+		return
+	case Intern("def"):
+		name := Cadr(lst)
+		if len(l.scopes) == 0 {
+			l.defined[name] = true
+			if fn, ok := Caddr(lst).(*List); ok && fn != EmptyList && fn.Car == Intern("fn") {
+				l.arities[name] = fnArity(Cadr(fn))
+			} else {
+				delete(l.arities, name)
+			}
+		} else if v := l.lookup(name); v == nil {
+			l.defined[name] = true
+		}
+		l.walkSequence(Cddr(lst), line)
+		return
+	case Intern("defmacro"):
+		l.walkSequence(Cddr(lst), line)
+		return
+	case Intern("fn"):
+		if ListLength(lst) >= 3 {
+			l.walkFn(Cadr(lst), Cddr(lst), "parameter", line)
+		}
+		return
+	case Intern("set!"):
+		if sym, ok := Cadr(lst).(*Symbol); ok && l.lookup(sym) == nil {
+			l.globals = append(l.globals, &globalRef{sym, -1, line})
+		}
+		l.walkSequence(Cddr(lst), line)
+		return
+	}
+	if head, ok := lst.Car.(*List); ok && head != EmptyList && head.Car == Intern("fn") && ListLength(head) >= 3 {
+		if vars, ok := Cadr(head).(*List); ok && isVariableList(vars) && ListLength(vars) == ListLength(lst.Cdr) {
+			// a let, letrec, or named let
+			l.walkSequence(lst.Cdr, line)
+			l.walkLet(vars, Cddr(head), line)
+			return
+		}
+	}
+	if sym, ok := lst.Car.(*Symbol); ok {
+		l.reference(sym, ListLength(lst.Cdr), line)
+	} else {
+		l.walk(lst.Car, line)
+	}
+	l.walkSequence(lst.Cdr, line)
+}
+
+func (l *linter) walkFn(args Value, body *List, kind string, line int) {
+	l.push(kind, line, fnParameters(args))
+	l.walkSequence(body, line)
+	l.pop()
+}
+
+// walkLet - walk the body of an expanded let. For a named let, the parameters of the function it binds are the
+// variables of the let.
+func (l *linter) walkLet(vars *List, body *List, line int) {
+	l.push("let binding", line, ListToVector(vars).Elements)
+	if ListLength(vars) == 1 && ListLength(body) == 2 {
+		set, ok := body.Car.(*List)
+		if ok && ListLength(set) == 3 && set.Car == Intern("set!") && Cadr(set) == vars.Car {
+			fn, ok := Caddr(set).(*List)
+			if ok && ListLength(fn) >= 3 && fn.Car == Intern("fn") {
+				l.walkFn(Cadr(fn), Cddr(fn), "let binding", line)
+				l.walk(Cadr(body), line)
+				l.pop()
+				return
+			}
+		}
+	}
+	l.walkSequence(body, line)
+	l.pop()
+}
+
+// checkGlobals - warn about references to globals that are not defined, and calls with the wrong number of arguments
+func (l *linter) checkGlobals() {
+	for _, ref := range l.globals {
+		var a arity
+		known := false
+		if l.defined[ref.sym] {
+			a, known = l.arities[ref.sym]
+		} else if val, defined := l.x.global(ref.sym); !defined && l.x.macro(ref.sym) == nil {
+			l.warn(ref.line, "undefined symbol: ", ref.sym)
+			continue
+		} else if fun, ok := val.(*Function); ok {
+			a, known = functionArity(fun)
+		}
+		if known && ref.argc >= 0 && !a.accepts(ref.argc) {
+			l.warn(ref.line, "wrong number of arguments to ", ref.sym, ": expected ", a, ", got ", ref.argc)
+		}
+	}
+}
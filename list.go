@@ -115,7 +115,7 @@ func ToList(obj Value) (*List, error) {
 	case *List:
 		return p, nil
 	case *Vector:
-		return ListFromValues(p.Elements), nil
+		return ListFromValues(p.Snapshot()), nil
 	case *Struct:
 		return StructToList(p)
 	case *String:
@@ -0,0 +1,187 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Compiled modules. When a module is loaded from foo.ell, the code compiled for each of its top level forms is
+// saved to foo.lvm next to it, with a key for what it was compiled from. The next load of foo.ell runs that code
+// instead of compiling it again, as long as the key still matches. The key is a hash of the source, the compiler
+// flags, the library, and the sources of the modules it uses (those named by (use name) forms at its top level, and
+// the ones they use in turn), since macros from them are expanded when the module is compiled. The constants the
+// code refers to are saved with it, in the same object format as images.
+
+const moduleMagic = "ell module"
+
+type moduleFile struct {
+	Magic      string
+	Version    int
+	SourceHash string        // the module key
+	Objects    []imageObject // the constant pool
+	Thunks     []int         // the code for each top level form, in order
+}
+
+func sourceHash(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// moduleKey - the key of a module with the given source, which changes whenever its compiled code might
+func moduleKey(fileText string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "optimize=%v\n", optimize)
+	if lib, err := SlurpFile("@/ell.ell"); err == nil {
+		h.Write([]byte(lib))
+	}
+	hashModuleSource(h, fileText, map[string]bool{})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashModuleSource - add the source, and those of the modules it uses, to the hash. Each module is only added once
+func hashModuleSource(h hash.Hash, fileText string, seen map[string]bool) {
+	h.Write([]byte(fileText))
+	exprs, err := ReadAllFromString(fileText)
+	if err != nil {
+		return
+	}
+	for ; exprs != EmptyList; exprs = exprs.Cdr {
+		form, ok := exprs.Car.(*List)
+		if !ok || form == EmptyList || form.Car != Intern("use") || form.Cdr == EmptyList {
+			continue
+		}
+		name, ok := form.Cdr.Car.(*Symbol)
+		if !ok || seen[name.Text] {
+			continue
+		}
+		seen[name.Text] = true
+		fmt.Fprintf(h, "\n(use %s)\n", name.Text)
+		if _, ok := findLinkedModule(name.Text); ok {
+			continue
+		}
+		file, err := FindModuleFile(name.Text)
+		if err != nil {
+			continue
+		}
+		text, err := SlurpFile(file)
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(file, ".lvm") {
+			h.Write([]byte(text))
+			continue
+		}
+		hashModuleSource(h, text, seen)
+	}
+}
+
+// compiledModulePath - where the compiled form of the source file is kept, or "" if it is not kept
+func compiledModulePath(file string) string {
+	if strings.HasPrefix(file, "@/") || !strings.HasSuffix(file, ".ell") {
+		return ""
+	}
+	return file[:len(file)-4] + ".lvm"
+}
+
+func encodeModule(hash string, thunks []*Code) ([]byte, error) {
+	w := newImageWriter()
+	w.context = "the module"
+	mod := &moduleFile{Magic: moduleMagic, Version: imageVersion, SourceHash: hash}
+	for _, thunk := range thunks {
+		i, err := w.ref(thunk)
+		if err != nil {
+			return nil, err
+		}
+		mod.Thunks = append(mod.Thunks, i)
+	}
+	mod.Objects = w.objects
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(mod); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeModule - the code for the module's top level forms. If the hash is not empty, it must match the one the
+// module was compiled from.
+func decodeModule(data []byte, hash string) ([]*Code, error) {
+	mod := new(moduleFile)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(mod); err != nil || mod.Magic != moduleMagic {
+		return nil, NewError(ErrorKey, "not a compiled ell module")
+	}
+	if mod.Version != imageVersion {
+		return nil, NewError(ErrorKey, "the compiled module is version ", mod.Version, ", not ", imageVersion)
+	}
+	if hash != "" && mod.SourceHash != hash {
+		return nil, NewError(ErrorKey, "the compiled module is out of date")
+	}
+	r, err := newImageReader(mod.Objects)
+	if err != nil {
+		return nil, err
+	}
+	thunks := make([]*Code, len(mod.Thunks))
+	for i, ref := range mod.Thunks {
+		val, err := r.object(ref)
+		if err != nil {
+			return nil, err
+		}
+		thunk, ok := val.(*Code)
+		if !ok {
+			return nil, NewError(ErrorKey, "bad compiled module")
+		}
+		thunks[i] = thunk
+	}
+	return thunks, nil
+}
+
+func writeCompiledModule(path string, hash string, thunks []*Code) error {
+	data, err := encodeModule(hash, thunks)
+	if err != nil {
+		return err
+	}
+	return SpitFile(path, string(data))
+}
+
+func readCompiledModule(path string, hash string) ([]*Code, error) {
+	if !IsFileReadable(path) {
+		return nil, NewError(IOErrorKey, "Cannot read file: ", path)
+	}
+	data, err := SlurpFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeModule([]byte(data), hash)
+}
+
+// runThunks - run the top level code of a module with the capabilities, as importCode does
+func runThunks(thunks []*Code, caps *Capabilities) error {
+	for _, thunk := range thunks {
+		if _, err := importCode(thunk, caps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
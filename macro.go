@@ -25,12 +25,40 @@ var MacroErrorKey = Intern("macro-error:")
 
 type macro struct {
 	name     Value
-	expander *Function //a function of one argument
+	expander *Function                                    //a function of one argument
+	builtin  func(x *expander, expr Value) (Value, error) //if set, a macro written in Go, expanding with the same expander
+}
+
+// expander - expands the macros in forms. Code being compiled is expanded with the global macros. Lint and check
+// expand a file with the macros it defines too, and note the line each expansion comes from, so that nothing in the
+// file has to be defined globally.
+type expander struct {
+	macros  map[Value]*macro // the macros defined by the file. A nil macro is a global the file defines, hiding a macro
+	lines   map[*List]int    // if not nil, the line each list was read from. The expansion of a list gets the same line
+	globals map[Value]Value  // the globals defined by the file and the modules it uses, and their expanded values
+	modules map[string]bool  // the modules used so far
+	load    bool             // if true, used modules are loaded, not just read
+}
+
+// defineExpanderMacro - define a macro written in Go, which expands the forms inside it with the same expander
+func defineExpanderMacro(name string, expand func(x *expander, expr Value) (Value, error)) {
+	DefineMacro(name, func(argv []Value) (Value, error) {
+		return expand(&expander{}, argv[0])
+	})
+	GetMacro(Intern(name)).builtin = expand
+}
+
+// macro - the macro the symbol names, if any
+func (x *expander) macro(sym Value) *macro {
+	if mac, ok := x.macros[sym]; ok {
+		return mac
+	}
+	return GetMacro(sym)
 }
 
 // Macro - create a new Macro
 func NewMacro(name Value, expander *Function) *macro {
-	return &macro{name, expander}
+	return &macro{name: name, expander: expander}
 }
 
 func (mac *macro) String() string {
@@ -43,15 +71,19 @@ func Macroexpand(expr Value) (Value, error) {
 }
 
 func macroexpandObject(expr Value) (Value, error) {
+	return (&expander{}).macroexpandObject(expr)
+}
+
+func (x *expander) macroexpandObject(expr Value) (Value, error) {
 	if lst, ok := expr.(*List); ok {
 		if lst != EmptyList {
-			return macroexpandList(lst)
+			return x.macroexpandList(lst)
 		}
 	}
 	return expr, nil
 }
 
-func macroexpandList(expr *List) (Value, error) {
+func (x *expander) macroexpandList(expr *List) (Value, error) {
 	if expr == nil {
 		panic("whoops")
 	}
@@ -62,36 +94,46 @@ func macroexpandList(expr *List) (Value, error) {
 	fn := Car(lst)
 	head := fn
 	if IsSymbol(fn) {
-		result, err := expandPrimitive(fn, lst)
+		result, err := x.expandPrimitive(fn, lst)
 		if err != nil {
 			return nil, err
 		}
 		if result != nil {
+			x.noteExpansion(expr, result)
 			return result, nil
 		}
 		head = fn
 	} else if lst, ok := fn.(*List); ok {
 		//panic("non-primitive macro")
-		expanded, err := macroexpandList(lst)
+		expanded, err := x.macroexpandList(lst)
 		if err != nil {
 			return nil, err
 		}
 		head = expanded
 	}
-	tail, err := expandSequence(Cdr(expr))
+	tail, err := x.expandSequence(Cdr(expr))
 	if err != nil {
 		return nil, err
 	}
-	return Cons(head, tail), nil
+	result := Cons(head, tail)
+	x.noteExpansion(expr, result)
+	return result, nil
 }
 
-func (mac *macro) expand(expr Value) (Value, error) {
+func (mac *macro) expand(x *expander, expr Value) (Value, error) {
+	if mac.builtin != nil {
+		expanded, err := mac.builtin(x, expr)
+		if err == nil {
+			return x.macroexpandObject(expanded)
+		}
+		return nil, err
+	}
 	if mac.expander.code != nil {
 		if mac.expander.code.argc == 1 {
 			expanded, err := execCompileTime(mac.expander.code, expr)
 			if err == nil {
 				if IsList(expanded) {
-					return macroexpandObject(expanded)
+					return x.macroexpandObject(expanded)
 				}
 				return expanded, err
 			}
@@ -101,14 +143,14 @@ func (mac *macro) expand(expr Value) (Value, error) {
 		args := []Value{expr}
 		expanded, err := mac.expander.primitive.fun(args)
 		if err == nil {
-			return macroexpandObject(expanded)
+			return x.macroexpandObject(expanded)
 		}
 		return nil, err
 	}
 	return nil, NewError(MacroErrorKey, "Bad macro expander function: ", mac.expander)
 }
 
-func expandSequence(seq Value) (*List, error) {
+func (x *expander) expandSequence(seq Value) (*List, error) {
 	var result []Value
 	if seq == nil {
 		panic("Whoops: should be (), not nil!")
@@ -116,7 +158,7 @@ func expandSequence(seq Value) (*List, error) {
 	for seq != EmptyList {
 		item := Car(seq)
 		if lst, ok := item.(*List); ok {
-			expanded, err := macroexpandList(lst)
+			expanded, err := x.macroexpandList(lst)
 			if err != nil {
 				return nil, err
 			}
@@ -134,17 +176,17 @@ func expandSequence(seq Value) (*List, error) {
 	return lst, nil
 }
 
-func expandIf(expr Value) (Value, error) {
+func (x *expander) expandIf(expr Value) (Value, error) {
 	i := ListLength(expr)
 	if i == 4 {
-		tmp, err := expandSequence(Cdr(expr))
+		tmp, err := x.expandSequence(Cdr(expr))
 		if err != nil {
 			return nil, err
 		}
 		return Cons(Car(expr), tmp), nil
 	} else if i == 3 {
 		tmp := NewList(Cadr(expr), Caddr(expr), Null)
-		tmp, err := expandSequence(tmp)
+		tmp, err := x.expandSequence(tmp)
 		if err != nil {
 			return nil, err
 		}
@@ -154,7 +196,7 @@ func expandIf(expr Value) (Value, error) {
 	}
 }
 
-func expandUndef(expr Value) (Value, error) {
+func (x *expander) expandUndef(expr Value) (Value, error) {
 	if ListLength(expr) != 2 || !IsSymbol(Cadr(expr)) {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
@@ -166,17 +208,17 @@ func expandUndef(expr Value) (Value, error) {
 //	->
 //
 // (def f (fn (x) (+ 1 x)))
-func expandDefn(expr Value) (Value, error) {
+func (x *expander) expandDefn(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
 	if exprLen >= 4 {
 		name := Cadr(expr)
 		if IsSymbol(name) {
 			args := Caddr(expr)
-			body, err := expandSequence(Cdddr(expr))
+			body, err := x.expandSequence(Cdddr(expr))
 			if err != nil {
 				return nil, err
 			}
-			tmp, err := expandFn(Cons(Intern("fn"), Cons(args, body)))
+			tmp, err := x.expandFn(Cons(Intern("fn"), Cons(args, body)))
 			if err != nil {
 				return nil, err
 			}
@@ -186,23 +228,23 @@ func expandDefn(expr Value) (Value, error) {
 	return nil, NewError(SyntaxErrorKey, expr)
 }
 
-func expandDefmacro(expr Value) (Value, error) {
+func (x *expander) expandDefmacro(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
 	if exprLen >= 4 {
 		name := Cadr(expr)
 		if IsSymbol(name) {
 			args := Caddr(expr)
-			body, err := expandSequence(Cdddr(expr))
+			body, err := x.expandSequence(Cdddr(expr))
 			if err != nil {
 				return nil, err
 			}
 			//(fn (expr) (apply xxx
-			tmp, err := expandFn(Cons(Intern("fn"), Cons(args, body))) //this is the expander with special args\
+			tmp, err := x.expandFn(Cons(Intern("fn"), Cons(args, body))) //this is the expander with special args\
 			if err != nil {
 				return nil, err
 			}
 			sym := Intern("expr")
-			tmp, err = expandFn(NewList(Intern("fn"), NewList(sym), NewList(Intern("apply"), tmp, NewList(Intern("cdr"), sym))))
+			tmp, err = x.expandFn(NewList(Intern("fn"), NewList(sym), NewList(Intern("apply"), tmp, NewList(Intern("cdr"), sym))))
 			if err != nil {
 				return nil, err
 			}
@@ -215,7 +257,7 @@ func expandDefmacro(expr Value) (Value, error) {
 //(defmacro (defmacro expr)
 //  `(defmacro ~(cadr expr) (fn (expr) (apply (fn ~(caddr expr) ~@(cdddr expr)) (cdr expr)))))
 
-func expandDef(expr Value) (Value, error) {
+func (x *expander) expandDef(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
 	if exprLen != 3 {
 		return nil, NewError(SyntaxErrorKey, expr)
@@ -229,7 +271,7 @@ func expandDef(expr Value) (Value, error) {
 	}
 	body := Caddr(expr)
 	if lst, ok := body.(*List); ok {
-		val, err := macroexpandList(lst)
+		val, err := x.macroexpandList(lst)
 		if err != nil {
 			return nil, err
 		}
@@ -238,12 +280,19 @@ func expandDef(expr Value) (Value, error) {
 	return expr, nil
 }
 
-func expandFn(expr Value) (Value, error) {
+func (x *expander) expandFn(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
 	if exprLen < 3 {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	body, err := expandSequence(Cddr(expr))
+	forms := Cddr(expr)
+	var result Value
+	if ListLength(forms) > 1 && IsType(Car(forms)) {
+		//the declared type of the result
+		result = Car(forms)
+		forms = Cdr(forms)
+	}
+	body, err := x.expandSequence(forms)
 	if err != nil {
 		return nil, err
 	}
@@ -256,7 +305,7 @@ func expandFn(expr Value) (Value, error) {
 				if Caar(tmp) == Intern("defmacro") {
 					return nil, NewError(MacroErrorKey, "macros can only be defined at top level")
 				}
-				def, err := expandDef(Car(tmp))
+				def, err := x.expandDef(Car(tmp))
 				if err != nil {
 					return nil, err
 				}
@@ -265,22 +314,32 @@ func expandFn(expr Value) (Value, error) {
 			}
 			bindings = Reverse(bindings)
 			tmp = Cons(Intern("letrec"), Cons(bindings, tmp)) //scheme specifies letrec*
-			tmp2, err := macroexpandList(tmp)
-			return NewList(Car(expr), Cadr(expr), tmp2), err
+			tmp2, err := x.macroexpandList(tmp)
+			if err != nil {
+				return nil, err
+			}
+			body = NewList(tmp2)
+			if result != nil {
+				body = Cons(result, body)
+			}
+			return Cons(Car(expr), Cons(Cadr(expr), body)), nil
 		}
 	}
+	if result != nil {
+		body = Cons(result, body)
+	}
 	args := Cadr(expr)
 	return Cons(Car(expr), Cons(args, body)), nil
 }
 
-func expandSetBang(expr Value) (Value, error) {
+func (x *expander) expandSetBang(expr Value) (Value, error) {
 	exprLen := ListLength(expr)
 	if exprLen != 3 {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
 	var val = Caddr(expr)
 	if lst, ok := val.(*List); ok {
-		v, err := macroexpandList(lst)
+		v, err := x.macroexpandList(lst)
 		if err != nil {
 			return nil, err
 		}
@@ -289,34 +348,34 @@ func expandSetBang(expr Value) (Value, error) {
 	return NewList(Car(expr), Cadr(expr), val), nil
 }
 
-func expandPrimitive(fn Value, expr Value) (Value, error) {
+func (x *expander) expandPrimitive(fn Value, expr Value) (Value, error) {
 	switch fn {
 	case Intern("quote"):
 		return expr, nil
 	case Intern("do"):
-		return expandSequence(expr)
+		return x.expandSequence(expr)
 	case Intern("if"):
-		return expandIf(expr)
+		return x.expandIf(expr)
 	case Intern("def"):
-		return expandDef(expr)
+		return x.expandDef(expr)
 	case Intern("undef"):
-		return expandUndef(expr)
+		return x.expandUndef(expr)
 	case Intern("defn"):
-		return expandDefn(expr)
+		return x.expandDefn(expr)
 	case Intern("defmacro"):
-		return expandDefmacro(expr)
+		return x.expandDefmacro(expr)
 	case Intern("fn"):
-		return expandFn(expr)
+		return x.expandFn(expr)
 	case Intern("set!"):
-		return expandSetBang(expr)
+		return x.expandSetBang(expr)
 	case Intern("lap"):
 		return expr, nil
 	case Intern("use"):
 		return expr, nil
 	default:
-		macro := GetMacro(fn)
+		macro := x.macro(fn)
 		if macro != nil {
-			tmp, err := macro.expand(expr)
+			tmp, err := macro.expand(x, expr)
 			return tmp, err
 		}
 		return nil, nil
@@ -359,7 +418,7 @@ func crackLetrecBindings(bindings Value, tail *List) (*List, *List, bool) {
 	return ListFromValues(names), head, true
 }
 
-func expandLetrec(expr Value) (Value, error) {
+func (x *expander) expandLetrec(expr Value) (Value, error) {
 	// (letrec () expr ...) -> (do expr ...)
 	// (letrec ((x 1) (y 2)) expr ...) -> ((fn (x y) (set! x 1) (set! y 2) expr ...) nil nil)
 	body := Cddr(expr)
@@ -374,7 +433,7 @@ func expandLetrec(expr Value) (Value, error) {
 	if !ok {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	code, err := macroexpandList(Cons(Intern("fn"), Cons(names, body)))
+	code, err := x.macroexpandList(Cons(Intern("fn"), Cons(names, body)))
 	if err != nil {
 		return nil, err
 	}
@@ -382,7 +441,7 @@ func expandLetrec(expr Value) (Value, error) {
 	return Cons(code, values), nil
 }
 
-func crackLetBindings(bindings Value) (*List, *List, bool) {
+func (x *expander) crackLetBindings(bindings Value) (*List, *List, bool) {
 	var names []Value
 	var values []Value
 	for bindings != EmptyList {
@@ -393,7 +452,7 @@ func crackLetBindings(bindings Value) (*List, *List, bool) {
 				names = append(names, name)
 				tmp2 := Cdr(tmp)
 				if tmp2 != EmptyList {
-					val, err := macroexpandObject(Car(tmp2))
+					val, err := x.macroexpandObject(Car(tmp2))
 					if err == nil {
 						values = append(values, val)
 						bindings = Cdr(bindings)
@@ -407,19 +466,19 @@ func crackLetBindings(bindings Value) (*List, *List, bool) {
 	return ListFromValues(names), ListFromValues(values), true
 }
 
-func expandLet(expr Value) (Value, error) {
+func (x *expander) expandLet(expr Value) (Value, error) {
 	// (let () expr ...) -> (do expr ...)
 	// (let ((x 1) (y 2)) expr ...) -> ((fn (x y) expr ...) 1 2)
 	// (let label ((x 1) (y 2)) expr ...) -> (fn (label) expr
 	if IsSymbol(Cadr(expr)) {
 		//return ell_expand_named_let(argv, argc)
-		return expandNamedLet(expr)
+		return x.expandNamedLet(expr)
 	}
 	bindings := Cadr(expr)
 	if !IsList(bindings) {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	names, values, ok := crackLetBindings(bindings)
+	names, values, ok := x.crackLetBindings(bindings)
 	if !ok {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
@@ -427,29 +486,29 @@ func expandLet(expr Value) (Value, error) {
 	if body == EmptyList {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	code, err := macroexpandList(Cons(Intern("fn"), Cons(names, body)))
+	code, err := x.macroexpandList(Cons(Intern("fn"), Cons(names, body)))
 	if err != nil {
 		return nil, err
 	}
 	return Cons(code, values), nil
 }
 
-func expandNamedLet(expr Value) (Value, error) {
+func (x *expander) expandNamedLet(expr Value) (Value, error) {
 	name := Cadr(expr)
 	bindings := Caddr(expr)
 	if !IsList(bindings) {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	names, values, ok := crackLetBindings(bindings)
+	names, values, ok := x.crackLetBindings(bindings)
 	if !ok {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
 	body := Cdddr(expr)
 	tmp := NewList(Intern("letrec"), NewList(NewList(name, Cons(Intern("fn"), Cons(names, body)))), Cons(name, values))
-	return macroexpandList(tmp)
+	return x.macroexpandList(tmp)
 }
 
-func nextCondClause(expr Value, clauses Value, count int) (Value, error) {
+func (x *expander) nextCondClause(expr Value, clauses Value, count int) (Value, error) {
 	var result Value
 	var err error
 	tmpsym := Intern("__tmp__")
@@ -494,7 +553,7 @@ func nextCondClause(expr Value, clauses Value, count int) (Value, error) {
 			}
 		}
 	} else {
-		result, err = nextCondClause(expr, next, count-1)
+		result, err = x.nextCondClause(expr, next, count-1)
 		if err != nil {
 			return nil, err
 		}
@@ -507,10 +566,10 @@ func nextCondClause(expr Value, clauses Value, count int) (Value, error) {
 			result = NewList(ifsym, Car(clause0), Cons(dosym, Cdr(clause0)), result)
 		}
 	}
-	return macroexpandObject(result)
+	return x.macroexpandObject(result)
 }
 
-func expandCond(expr Value) (Value, error) {
+func (x *expander) expandCond(expr Value) (Value, error) {
 	i := ListLength(expr)
 	if i < 2 {
 		return nil, NewError(SyntaxErrorKey, expr)
@@ -522,20 +581,20 @@ func expandCond(expr Value) (Value, error) {
 			expr = Cons(Intern("do"), Cdr(tmp))
 			tmp = NewList(Intern("if"), Car(tmp), expr)
 		}
-		return macroexpandObject(tmp)
+		return x.macroexpandObject(tmp)
 	} else {
-		return nextCondClause(expr, Cdr(expr), i-1)
+		return x.nextCondClause(expr, Cdr(expr), i-1)
 	}
 }
 
-func expandQuasiquote(expr Value) (Value, error) {
+func (x *expander) expandQuasiquote(expr Value) (Value, error) {
 	if ListLength(expr) != 2 {
 		return nil, NewError(SyntaxErrorKey, expr)
 	}
-	return expandQQ(Cadr(expr))
+	return x.expandQQ(Cadr(expr))
 }
 
-func expandQQ(expr Value) (Value, error) {
+func (x *expander) expandQQ(expr Value) (Value, error) {
 	switch p := expr.(type) {
 	case *List:
 		if p == EmptyList {
@@ -546,16 +605,16 @@ func expandQQ(expr Value) (Value, error) {
 				if p.Cdr.Cdr != EmptyList {
 					return nil, NewError(SyntaxErrorKey, expr)
 				}
-				return macroexpandObject(p.Cdr.Car)
+				return x.macroexpandObject(p.Cdr.Car)
 			} else if p.Car == UnquoteSymbolSplicing {
 				return nil, NewError(MacroErrorKey, "unquote-splicing can only occur in the context of a list ")
 			}
 		}
-		tmp, err := expandQQList(p)
+		tmp, err := x.expandQQList(p)
 		if err != nil {
 			return nil, err
 		}
-		return macroexpandObject(tmp)
+		return x.macroexpandObject(tmp)
 	case *Symbol:
 		return NewList(Intern("quote"), expr), nil
 	default: //all other objects evaluate to themselves
@@ -563,7 +622,7 @@ func expandQQ(expr Value) (Value, error) {
 	}
 }
 
-func expandQQList(lst *List) (*List, error) {
+func (x *expander) expandQQList(lst *List) (*List, error) {
 	var tmp Value
 	var err error
 	result := NewList(Intern("concat"))
@@ -574,7 +633,7 @@ func expandQQList(lst *List) (*List, error) {
 				return nil, NewError(MacroErrorKey, "nested quasiquote not supported")
 			}
 			if item.Car == UnquoteSymbol && item.Length() == 2 {
-				tmp, err = macroexpandObject(Cadr(item))
+				tmp, err = x.macroexpandObject(Cadr(item))
 				tmp = NewList(Intern("list"), tmp)
 				if err != nil {
 					return nil, err
@@ -582,14 +641,14 @@ func expandQQList(lst *List) (*List, error) {
 				tail.Cdr = NewList(tmp)
 				tail = tail.Cdr
 			} else if item.Car == UnquoteSymbolSplicing && item.Length() == 2 {
-				tmp, err = macroexpandObject(Cadr(item))
+				tmp, err = x.macroexpandObject(Cadr(item))
 				if err != nil {
 					return nil, err
 				}
 				tail.Cdr = NewList(tmp)
 				tail = tail.Cdr
 			} else {
-				tmp, err = expandQQList(item)
+				tmp, err = x.expandQQList(item)
 				if err != nil {
 					return nil, err
 				}
@@ -94,6 +94,11 @@ func DefineFunctionKeyArgs(name string, fun PrimitiveFunction, result Value, arg
 	definePrimitive(name, prim)
 }
 
+// Register an intrinsic (a primitive with access to the calling VM) to the specified global name
+func defineIntrinsic(name string, fun intrinsicFunction, signature string) {
+	definePrimitive(name, newIntrinsic(name, fun, signature))
+}
+
 // Register a primitive macro with the specified name.
 func DefineMacro(name string, fun PrimitiveFunction) {
 	sym := Intern(name)
@@ -174,7 +179,11 @@ func GetMacro(sym Value) *macro {
 }
 
 func defMacro(sym Value, val *Function) {
-	macroMap[sym] = NewMacro(sym, val)
+	mac := NewMacro(sym, val)
+	if old, ok := macroMap[sym]; ok && old.expander == val {
+		mac.builtin = old.builtin
+	}
+	macroMap[sym] = mac
 }
 
 // note: unlike java, we cannot use maps or arrays as keys (they are not comparable).
@@ -193,9 +202,10 @@ func Use(sym *Symbol) error {
 	return Load(sym.Text)
 }
 
-func importCode(thunk *Code) (Value, error) {
+// importCode - run the top level code with the capabilities, or, if they are nil, those of a new evaluation
+func importCode(thunk *Code, caps *Capabilities) (Value, error) {
 	var args []Value
-	result, err := exec(thunk, args)
+	result, err := exec(thunk, args, caps)
 	if err != nil {
 		return nil, err
 	}
@@ -205,6 +215,12 @@ func importCode(thunk *Code) (Value, error) {
 var loadPathSymbol = Intern("*load-path*")
 
 func FindModuleByName(moduleName string) (string, error) {
+	return findModuleByName(moduleName, nil)
+}
+
+// findModuleByName - find the file of the module on the load path. With capabilities, the load path is in the
+// filesystem they give access to, and the file returned is the real one it maps to.
+func findModuleByName(moduleName string, caps *Capabilities) (string, error) {
 	if moduleName == "ell" || moduleName == "ell.ell" {
 		return "@/ell.ell", nil
 	}
@@ -216,61 +232,139 @@ func FindModuleByName(moduleName string) (string, error) {
 	name := moduleName
 	var lname string
 	if strings.HasSuffix(name, ".ell") {
-		lname = name[:len(name)-3] + ".lvm"
+		lname = name[:len(name)-4] + ".lvm"
 	} else {
 		lname = name + ".lvm"
 		name = name + ".ell"
 	}
 	for _, dirname := range path {
-		filename := filepath.Join(dirname, lname)
-		if IsFileReadable(filename) {
+		if filename, err := readableFile(filepath.Join(dirname, name), caps); err == nil {
 			return filename, nil
 		}
-		filename = filepath.Join(dirname, name)
-		if IsFileReadable(filename) {
+		if filename, err := readableFile(filepath.Join(dirname, lname), caps); err == nil {
 			return filename, nil
 		}
 	}
+	if caps != nil && caps.Filesystem == FilesystemNone {
+		return "", permissionError("no filesystem access: ", moduleName)
+	}
 	return "", NewError(IOErrorKey, "Module not found: ", moduleName)
 }
 
+// readableFile - the file, mapped by the capabilities if there are any, or an error if it cannot be read
+func readableFile(filename string, caps *Capabilities) (string, error) {
+	if caps != nil {
+		mapped, err := caps.path(filename, false)
+		if err != nil {
+			return "", err
+		}
+		filename = mapped
+	}
+	if !IsFileReadable(filename) {
+		return "", NewError(IOErrorKey, "Cannot read file: ", filename)
+	}
+	return filename, nil
+}
+
 func Load(name string) error {
+	return loadModule(name, nil)
+}
+
+// loadModule - load the module for an evaluation with the capabilities, which its file must be accessible with,
+// and which it runs with. If they are nil, the module may be in any file, and runs with those of a new evaluation.
+func loadModule(name string, caps *Capabilities) error {
 	if verbose {
 		fmt.Println("; [loading " + name + "]")
 	}
-	file, err := FindModuleFile(name)
+	if mod, ok := findLinkedModule(name); ok {
+		return mod.load(caps)
+	}
+	file, err := findModuleFile(name, caps)
 	if err != nil {
 		return err
 	}
-	return LoadFile(file)
+	thunks, err := loadFile(file, true, caps)
+	if err == nil && bundling != nil {
+		bundling[strings.TrimSuffix(name, ".ell")] = thunks
+	}
+	return err
 }
 
+// LoadFile - load the source (.ell) or compiled (.lvm) file. The code compiled from a source file is saved next to
+// it, and used instead of the source the next time, until the source changes.
 func LoadFile(file string) error {
+	_, err := loadFile(file, true, nil)
+	return err
+}
+
+// loadFile - load the file, running its code with the capabilities, and return the code compiled from its forms
+func loadFile(file string, cache bool, caps *Capabilities) ([]*Code, error) {
 	if verbose {
 		println("; loadFile: " + file)
 	} else if interactive {
 		println("[loading " + file + "]")
 	}
+	if strings.HasSuffix(file, ".lvm") {
+		thunks, err := readCompiledModule(file, "")
+		if err != nil {
+			return nil, err
+		}
+		return thunks, runThunks(thunks, caps)
+	}
 	fileText, err := SlurpFile(file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	compiled := ""
+	if cache {
+		compiled = compiledModulePath(file)
+	}
+	hash := ""
+	if compiled != "" {
+		hash = moduleKey(fileText)
+		if thunks, err := readCompiledModule(compiled, hash); err == nil {
+			if verbose {
+				println("; [using compiled module " + compiled + "]")
+			}
+			return thunks, runThunks(thunks, caps)
+		}
 	}
 	exprs, err := ReadAllFromString(fileText)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var thunks []*Code
 	for exprs != EmptyList {
-		expr := Car(exprs)
-		_, err = Eval(expr)
+		thunk, err := compileForm(Car(exprs))
+		if err != nil {
+			return nil, err
+		}
+		_, err = importCode(thunk, caps)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		thunks = append(thunks, thunk)
 		exprs = Cdr(exprs)
 	}
-	return nil
+	if compiled != "" {
+		err = writeCompiledModule(compiled, hash, thunks)
+		if err != nil && verbose {
+			println("; [cannot save compiled module " + compiled + ": " + err.Error() + "]")
+		}
+	}
+	return thunks, nil
 }
 
 func Eval(expr Value) (Value, error) {
+	code, err := compileForm(expr)
+	if err != nil {
+		return nil, err
+	}
+	return importCode(code, nil)
+}
+
+// compileForm - expand the macros in the top level form, and compile the result
+func compileForm(expr Value) (*Code, error) {
 	if debug {
 		println("; eval: ", Write(expr))
 	}
@@ -289,22 +383,34 @@ func Eval(expr Value) (Value, error) {
 		val := strings.Replace(Write(code), "\n", "\n; ", -1)
 		println("; compiled to:\n;  ", val)
 	}
-	return importCode(code)
+	return code, nil
+}
+
+// Call - call the function (a closure, primitive, continuation, or keyword) with the arguments, in a new VM.
+// Calls may be made from any goroutine.
+func Call(fn Value, args ...Value) (Value, error) {
+	return VM(defaultStackSize).call(fn, args)
+}
+
+// CallGlobal - call the function defined globally with the given name
+func CallGlobal(name string, args ...Value) (Value, error) {
+	fn := GetGlobal(Intern(name))
+	if fn == nil {
+		return nil, NewError(ErrorKey, "Undefined symbol: ", name)
+	}
+	return Call(fn, args...)
 }
 
 func FindModuleFile(name string) (string, error) {
+	return findModuleFile(name, nil)
+}
+
+func findModuleFile(name string, caps *Capabilities) (string, error) {
 	i := strings.Index(name, ".")
 	if i < 0 {
-		file, err := FindModuleByName(name)
-		if err != nil {
-			return "", err
-		}
-		return file, nil
-	}
-	if !IsFileReadable(name) {
-		return "", NewError(IOErrorKey, "Cannot read file: ", name)
+		return findModuleByName(name, caps)
 	}
-	return name, nil
+	return readableFile(name, caps)
 }
 
 func compileValue(expr Value) (string, error) {
@@ -360,14 +466,6 @@ func CompileFile(name string) (Value, error) {
 	return NewString(result), nil
 }
 
-type Extension interface {
-	Init() error
-	Cleanup()
-	String() string
-}
-
-var extensions []Extension
-
 func AddEllDirectory(dirname string) {
 	loadPath := dirname
 	tmp := GetGlobal(loadPathSymbol)
@@ -377,8 +475,25 @@ func AddEllDirectory(dirname string) {
 	DefineGlobal(StringValue(loadPathSymbol), NewString(loadPath))
 }
 
+// Init - define the primitives, load the ell module, and initialize the extensions
 func Init(extns ...Extension) {
-	extensions = extns
+	initPrimitives()
+	if err := Load("ell"); err != nil {
+		Fatal("*** ", err)
+	}
+	initExtensions(extns)
+}
+
+// InitFromImage - like Init, but the global environment is restored from an image saved with SaveImage instead of
+// loading the ell module. The extensions are initialized before the image is loaded, so that it can refer to their
+// primitives.
+func InitFromImage(image string, extns ...Extension) error {
+	initPrimitives()
+	initExtensions(extns)
+	return LoadImage(image)
+}
+
+func initPrimitives() {
 	loadPath := os.Getenv("ELL_PATH")
 	home := os.Getenv("HOME")
 	if loadPath == "" {
@@ -392,6 +507,10 @@ func Init(extns ...Extension) {
 	loadPath += ":@/"
 	DefineGlobal(StringValue(loadPathSymbol), NewString(loadPath))
 	InitPrimitives()
+}
+
+func initExtensions(extns []Extension) {
+	extensions = extns
 	for _, ext := range extensions {
 		err := ext.Init()
 		if err != nil {
@@ -406,9 +525,13 @@ func Cleanup() {
 	}
 }
 
+// Run - load the files. Unlike the modules they use, they are not saved compiled.
 func Run(args ...string) {
 	for _, filename := range args {
-		err := Load(filename)
+		file, err := FindModuleFile(filename)
+		if err == nil {
+			_, err = loadFile(file, false, nil)
+		}
 		if err != nil {
 			Fatal("*** ", err.Error())
 		}
@@ -416,16 +539,43 @@ func Run(args ...string) {
 }
 
 func Main(extns ...Extension) {
-	var help, compile, optimize, verbose, debug, trace, noInit bool
+	if b, err := executableBundle(); err != nil {
+		Fatal("*** ", err)
+	} else if b != nil {
+		Init(extns...)
+		if err := runBundle(b, os.Args[1:]); err != nil {
+			Fatal("*** ", err)
+		}
+		Cleanup()
+		return
+	}
+	var help, compile, lint, check, optimize, verbose, debug, trace, noInit bool
+	var deterministic, noNet, noEnv bool
+	var seed, maxAlloc int
+	var filesystem, fsRoot, image, output string
+	var buildGo, bundle bool
 	var path string
 	cmd := cli.New("ell", "The Ell Language compiler, VM, and runtime")
 	cmd.BoolOption(&help, "help", false, "Show help")
 	cmd.BoolOption(&compile, "compile", false, "compile the file and output lap")
+	cmd.BoolOption(&lint, "lint", false, "check the files for undefined globals, wrong argument counts, and unused variables")
+	cmd.BoolOption(&check, "check", false, "check the files for type errors")
+	cmd.BoolOption(&buildGo, "build-go", false, "compile the module to a Go package that links it into a program")
+	cmd.BoolOption(&bundle, "bundle", false, "make an executable that runs the script, with the modules it uses compiled into it")
+	cmd.StringOption(&output, "output", "", "where --build-go or --bundle writes its result, by default named after the module")
 	cmd.BoolOption(&optimize, "optimize", false, "optimize execution speed, should work for correct code, relax some checks")
 	cmd.BoolOption(&verbose, "verbose", false, "verbose mode, print extra information")
 	cmd.BoolOption(&debug, "debug", false, "debug mode, print extra information about compilation")
 	cmd.BoolOption(&trace, "trace", false, "trace VM instructions as they get executed")
 	cmd.BoolOption(&noInit, "noinit", false, "disable initialization from the $HOME/.ell file")
+	cmd.StringOption(&image, "image", "", "start with the environment saved in this image, instead of loading the ell module")
+	cmd.BoolOption(&deterministic, "deterministic", false, "run tasks one at a time in virtual time, in an order determined by the seed")
+	cmd.IntOption(&seed, "seed", 0, "the random seed for deterministic mode")
+	cmd.StringOption(&filesystem, "fs", "full", "filesystem access for ell code: full, read-only, or none")
+	cmd.StringOption(&fsRoot, "fsroot", "", "restrict file access to this directory, treated as the root")
+	cmd.BoolOption(&noNet, "nonet", false, "disable network access")
+	cmd.BoolOption(&noEnv, "noenv", false, "disable access to environment variables")
+	cmd.IntOption(&maxAlloc, "maxalloc", 0, "limit the bytes each evaluation may allocate")
 	var prof string
 	cmd.StringOption(&prof, "profile", "", "profile the code to the specified file")
 	cmd.StringOption(&path, "path", "", "add directories to ell load path")
@@ -436,7 +586,16 @@ func Main(extns ...Extension) {
 	}
 	interactive := len(args) == 0
 	SetFlags(optimize, verbose, debug, trace, interactive)
-	Init(extns...)
+	if deterministic {
+		SetDeterministic(int64(seed))
+	}
+	if image != "" {
+		if err := InitFromImage(image, extns...); err != nil {
+			Fatal("*** ", err)
+		}
+	} else {
+		Init(extns...)
+	}
 	if path != "" {
 		for _, p := range strings.Split(path, ":") {
 			expandedPath := ExpandFilePath(p)
@@ -450,7 +609,24 @@ func Main(extns ...Extension) {
 			}
 		}
 	}
+	caps := AllCapabilities
+	switch filesystem {
+	case "full":
+	case "read-only":
+		caps.Filesystem = FilesystemReadOnly
+	case "none":
+		caps.Filesystem = FilesystemNone
+	default:
+		Fatal("*** -fs must be full, read-only, or none, not ", filesystem)
+	}
+	caps.Root = fsRoot
+	caps.Network = !noNet
+	caps.Environment = !noEnv
 	if len(args) > 0 {
+		if err := SetCapabilities(caps); err != nil {
+			Fatal("*** ", err)
+		}
+		SetAllocationLimit(int64(maxAlloc))
 		if compile {
 			SetFlags(optimize, verbose, debug, trace, interactive)
 			//just compile and print LVM code
@@ -461,6 +637,44 @@ func Main(extns ...Extension) {
 				}
 				Println(lap)
 			}
+		} else if buildGo {
+			for _, filename := range args {
+				notes, err := BuildGoPackage(filename, output)
+				if err != nil {
+					Fatal("*** ", err)
+				}
+				for _, note := range notes {
+					Println("; ", note)
+				}
+			}
+		} else if bundle {
+			if len(args) != 1 {
+				Fatal("*** --bundle takes one script")
+			}
+			if err := Bundle(args[0], output); err != nil {
+				Fatal("*** ", err)
+			}
+		} else if lint || check {
+			count := 0
+			for _, filename := range args {
+				var warnings []*Warning
+				var err error
+				if lint {
+					warnings, err = Lint(filename)
+				} else {
+					warnings, err = Check(filename)
+				}
+				if err != nil {
+					Fatal("*** ", err)
+				}
+				for _, w := range warnings {
+					Println(w)
+				}
+				count += len(warnings)
+			}
+			if count > 0 {
+				os.Exit(1)
+			}
 		} else {
 			if prof != "" {
 				f, err := os.Create(prof)
@@ -485,6 +699,10 @@ func Main(extns ...Extension) {
 				}
 			}
 		}
+		if err := SetCapabilities(caps); err != nil {
+			Fatal("*** ", err)
+		}
+		SetAllocationLimit(int64(maxAlloc))
 		SetFlags(optimize, verbose, debug, trace, interactive)
 		ReadEvalPrintLoop()
 	}
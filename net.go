@@ -32,6 +32,23 @@ import (
 
 var HTTPErrorKey = Intern("http-error:")
 
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http:") || strings.HasPrefix(name, "https:")
+}
+
+// readBody - read the body of a response, failing with a resource-error if it is bigger than the allocation limit
+func readBody(body io.Reader) ([]byte, error) {
+	limit := AllocationLimit()
+	if limit <= 0 {
+		return ioutil.ReadAll(body)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err == nil && int64(len(b)) > limit {
+		return nil, NewError(ResourceErrorKey, "allocation limit of ", limit, " bytes exceeded")
+	}
+	return b, err
+}
+
 func httpClientOperation(method string, url string, headers *Struct, data *String) (*Struct, error) {
 	client := &http.Client{}
 	var bodyReader io.Reader
@@ -67,7 +84,8 @@ func httpClientOperation(method string, url string, headers *Struct, data *Strin
 	}
 	res, err := client.Do(req)
 	if err == nil {
-		bodyBytes, err := ioutil.ReadAll(res.Body)
+		var bodyBytes []byte
+		bodyBytes, err = readBody(res.Body)
 		res.Body.Close()
 		if err == nil {
 			s := NewStruct()
@@ -93,7 +111,7 @@ func httpClientOperation(method string, url string, headers *Struct, data *Strin
 	return nil, err
 }
 
-func httpServer(port int, handler *Function) (Value, error) {
+func httpServer(port int, handler *Function, caps *Capabilities) (Value, error) {
 	glue := func(w http.ResponseWriter, r *http.Request) {
 		headers := NewStruct()
 		for k, v := range r.Header {
@@ -134,7 +152,7 @@ func httpServer(port int, handler *Function) (Value, error) {
 			Put(req, Intern("query:"), NewString(r.URL.RawQuery))
 		}
 		args := []Value{req}
-		res, err := exec(handler.code, args)
+		res, err := exec(handler.code, args, caps)
 		if err != nil {
 			w.WriteHeader(500)
 			w.Write([]byte(err.Error()))
@@ -208,20 +226,28 @@ func headerString(obj Value) string {
 var ConnectionType = Intern("<connection>")
 
 type Connection struct {
-	Name string
-	In   *Channel
-	Out  *Channel
-	Con  net.Conn
+	Name     string
+	In       *Channel
+	Out      *Channel
+	Con      net.Conn
+	endpoint string // the address connected to, or listened on
+	remote   string
 }
 
 func (c *Connection) Type() Value {
 	return ConnectionType
 }
+
+// Equals - connections are equal if they are to the same endpoint from the same remote address
 func (c *Connection) Equals(another Value) bool {
+	if c2, ok := another.(*Connection); ok {
+		return c.endpoint == c2.endpoint && c.remote == c2.remote
+	}
 	return false
 }
+
 func (c *Connection) String() string {
-	return "#[Connection]"
+	return "#<connection>" + Write(connectionData(c))
 }
 
 func NewConnection(con net.Conn, endpoint string) Value {
@@ -231,13 +257,51 @@ func NewConnection(con net.Conn, endpoint string) Value {
 	go tcpWriter(con, outchan)
 	name := fmt.Sprintf("connection on %s", endpoint)
 	return &Connection{
-		Name: name,
-		In:   inchan,
-		Out:  outchan,
-		Con:  con,
+		Name:     name,
+		In:       inchan,
+		Out:      outchan,
+		Con:      con,
+		endpoint: endpoint,
+		remote:   con.RemoteAddr().String(),
 	}
 }
 
+// Connect - open a connection to the endpoint, i.e. "localhost:8080"
+func Connect(endpoint string) (Value, error) {
+	if err := notDeterministic("connect"); err != nil {
+		return nil, err
+	}
+	con, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return NewConnection(con, endpoint), nil
+}
+
+var endpointKey = Intern("endpoint:")
+var remoteKey = Intern("remote:")
+
+// connectionData - a connection is written as #<connection>{endpoint: "localhost:8080" remote: "127.0.0.1:8080"}
+func connectionData(val Value) Value {
+	c := val.(*Connection)
+	return NewStruct().Put(endpointKey, NewString(c.endpoint)).Put(remoteKey, NewString(c.remote))
+}
+
+// readConnection - reading a connection makes one that is not connected. Reading never does any I/O: the
+// connection must be passed to connect to open a new one to the same endpoint
+func readConnection(data Value) (Value, error) {
+	if s, ok := data.(*Struct); ok {
+		if endpoint, ok := s.Get(endpointKey).(*String); ok {
+			remote := ""
+			if r, ok := s.Get(remoteKey).(*String); ok {
+				remote = r.Value
+			}
+			return &Connection{Name: fmt.Sprintf("connection on %s", endpoint.Value), endpoint: endpoint.Value, remote: remote}, nil
+		}
+	}
+	return nil, NewError(SyntaxErrorKey, "Bad connection: #<connection>", data)
+}
+
 func closeConnection(obj Value) {
 	if p, ok := obj.(*Connection); ok {
 		if p.Con != nil {
@@ -280,21 +344,16 @@ func tcpReader(conn net.Conn, inchan Value) {
 			cur = buf[offset:]
 		}
 		packet := NewBlob(buf)
-		ch := ChannelValue(inchan)
-		if ch != nil {
-			ch <- packet
+		if !SendChannel(inchan, packet, -1) {
+			return
 		}
 	}
 }
 
 func tcpWriter(con net.Conn, outchan Value) {
 	for {
-		var packet Value
-		ch := ChannelValue(outchan)
-		if ch != nil {
-			packet = <-ch
-		}
-		if packet == nil {
+		packet, ok := ReceiveChannel(outchan, -1)
+		if !ok {
 			return
 		}
 		if p, ok := packet.(*String); ok {
@@ -322,9 +381,9 @@ func tcpListener(listener net.Listener, acceptChannel Value, endpoint string) (V
 		if err != nil {
 			return nil, err
 		}
-		ch := ChannelValue(acceptChannel)
-		if ch != nil {
-			ch <- NewConnection(con, endpoint)
+		c := NewConnection(con, endpoint)
+		if !SendChannel(acceptChannel, c, -1) {
+			closeConnection(c)
 		}
 	}
 }
@@ -97,8 +97,7 @@ func SlurpFile(path string) (string, error) {
 
 // SpitFile - write the string to the file.
 func SpitFile(path string, data string) error {
-	path = ExpandFilePath(path)
-	return ioutil.WriteFile(path, []byte(data), 0644)
+	return ioutil.WriteFile(ExpandFilePath(path), []byte(data), 0644)
 }
 
 func ReadFromString(s string) (Value, error) {
@@ -173,6 +172,13 @@ func (ext *EllReaderExtension) HandleReaderMacro(c byte) (Value, error, bool) {
 	case '!': //to handle shell scripts, handle #! as a comment
 		err := dr.DecodeComment()
 		return Null, err, true
+	case '<':
+		val, err := readInstance(dr)
+		return val, err, true
+	}
+	if macro, ok := readerMacros[c]; ok {
+		val, err := macro(dr)
+		return val, err, true
 	}
 	return Null, nil, false
 }
@@ -275,6 +281,9 @@ func (ext *EllWriterExtension) writeAll(lst *List) string {
 }
 
 func (ext *EllWriterExtension) HandleValue(val Value) (string, error, bool) {
+	if s, err, ok := writeValue(ext.writer, val); ok {
+		return s, err, true
+	}
 	switch p := val.(type) {
 	case *List:
 		if p.Cdr != EmptyList {
@@ -0,0 +1,297 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/boynton/ell/data"
+)
+
+// parallelMap - call the function on each element, on up to workers goroutines, each with its own VM. The results
+// are in the same order as the elements. If any call fails, no more are started, and the error for the earliest
+// element is returned.
+func (vm *vm) parallelMap(fun Value, elements []Value, workers int) ([]Value, error) {
+	count := len(elements)
+	results := make([]Value, count)
+	errs := make([]error, count)
+	if workers > count {
+		workers = count
+	}
+	params := vm.parameterSnapshot()
+	next := int32(-1)
+	failed := int32(0)
+	work := func() {
+		wvm := VM(vm.stackSize)
+		wvm.winders = params
+		wvm.budget = vm.budget
+		wvm.caps = vm.caps
+		for atomic.LoadInt32(&failed) == 0 {
+			i := int(atomic.AddInt32(&next, 1))
+			if i >= count {
+				return
+			}
+			val, err := wvm.callRecover(fun, []Value{elements[i]})
+			if err != nil {
+				errs[i] = err
+				atomic.StoreInt32(&failed, 1)
+				return
+			}
+			results[i] = val
+		}
+	}
+	if virtual != nil {
+		running := workers
+		for w := 0; w < workers; w++ {
+			virtual.spawn(func() {
+				work()
+				running--
+			})
+		}
+		virtual.block(func() bool { return running == 0 }, -1)
+	} else {
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				work()
+			}()
+		}
+		wg.Wait()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// callRecover - like call, but a Go panic is returned as an error, for goroutines that have nobody else to report to
+func (vm *vm) callRecover(fun Value, args []Value) (result Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, NewError(ErrorKey, "panic in ", fun, ": ", fmt.Sprint(r))
+		}
+	}()
+	return vm.call(fun, args)
+}
+
+func parallelArgs(name string, argv []Value) (Value, []Value, int, error) {
+	argc := len(argv)
+	if argc < 2 || argc > 3 {
+		return nil, nil, 0, argcError(name, 2, 3, argc)
+	}
+	fun := argv[0]
+	if fun.Type() != FunctionType {
+		return nil, nil, 0, NewError(ArgumentErrorKey, name, " expected a <function> for argument 1, got a ", TypeNameOf(fun))
+	}
+	var elements []Value
+	switch p := argv[1].(type) {
+	case *List:
+		elements = ListToVector(p).Elements
+	case *Vector:
+		p.RLock()
+		elements = make([]Value, len(p.Elements))
+		copy(elements, p.Elements)
+		p.RUnlock()
+	default:
+		return nil, nil, 0, NewError(ArgumentErrorKey, name, " expected a <list> or <vector> for argument 2, got a ", TypeNameOf(p))
+	}
+	workers := runtime.NumCPU()
+	if argc == 3 {
+		if argv[2].Type() != NumberType || IntValue(argv[2]) < 1 {
+			return nil, nil, 0, NewError(ArgumentErrorKey, name, " expected a positive <number> of workers for argument 3, got ", argv[2])
+		}
+		workers = IntValue(argv[2])
+	}
+	return fun, elements, workers, nil
+}
+
+func ellPmap(vm *vm, argv []Value) (Value, error) {
+	fun, elements, workers, err := parallelArgs("pmap", argv)
+	if err != nil {
+		return nil, err
+	}
+	results, err := vm.parallelMap(fun, elements, workers)
+	if err != nil {
+		return nil, err
+	}
+	if argv[1].Type() == VectorType {
+		return VectorFromElementsNoCopy(results), nil
+	}
+	return ListFromValues(results), nil
+}
+
+func ellPforEach(vm *vm, argv []Value) (Value, error) {
+	fun, elements, workers, err := parallelArgs("pfor-each", argv)
+	if err != nil {
+		return nil, err
+	}
+	_, err = vm.parallelMap(fun, elements, workers)
+	if err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+// WorkerPoolType - the type of a bounded pool of worker goroutines
+var WorkerPoolType Value = Intern("<worker-pool>")
+
+// WorkerPool - a fixed number of goroutines, each with its own VM, that run submitted functions in turn.
+// Submitting waits until a worker is free to take the job.
+type WorkerPool struct {
+	size   int
+	jobs   chan *poolJob
+	done   chan struct{} // closed by Close, so that workers and waiting submitters stop
+	mutex  sync.RWMutex
+	closed bool
+	active int // the number of jobs running, under the deterministic scheduler
+}
+
+type poolJob struct {
+	task   *Task
+	fun    *Function
+	args   []Value
+	params *winder
+}
+
+func NewWorkerPool(size int) *WorkerPool {
+	pool := &WorkerPool{size: size, jobs: make(chan *poolJob), done: make(chan struct{})}
+	if virtual != nil {
+		return pool
+	}
+	for i := 0; i < size; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-pool.jobs:
+					job.task.run(job.fun, nil, job.args, job.params)
+				case <-pool.done:
+					return
+				}
+			}
+		}()
+	}
+	return pool
+}
+
+func (pool *WorkerPool) Type() Value {
+	return WorkerPoolType
+}
+
+func (pool *WorkerPool) String() string {
+	s := fmt.Sprintf("#[worker-pool %d", pool.size)
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+	if pool.closed {
+		s += " CLOSED"
+	}
+	return s + "]"
+}
+
+func (pool1 *WorkerPool) Equals(another Value) bool {
+	if pool2, ok := another.(*WorkerPool); ok {
+		return pool1 == pool2
+	}
+	return false
+}
+
+// Close - stop accepting jobs. The workers exit once the jobs already submitted are done.
+func (pool *WorkerPool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.done)
+	}
+}
+
+// submit - run the function on one of the pool's workers, with the dynamic state, budget, and capabilities of the VM
+func (pool *WorkerPool) submit(vm *vm, fun *Function, args []Value) (*Task, error) {
+	params := vm.parameterSnapshot()
+	if virtual != nil {
+		virtual.block(func() bool { return pool.closed || pool.active < pool.size }, -1)
+		if pool.closed {
+			return nil, NewError(ErrorKey, "submit: the worker pool is closed")
+		}
+		pool.active++
+		task := newTask(taskName(fun))
+		task.budget = vm.budget
+		task.caps = vm.caps
+		virtual.spawn(func() {
+			task.run(fun, nil, args, params)
+			pool.active--
+		})
+		return task, nil
+	}
+	select {
+	case <-pool.done:
+		return nil, NewError(ErrorKey, "submit: the worker pool is closed")
+	default:
+	}
+	task := newTask(taskName(fun))
+	task.budget = vm.budget
+	task.caps = vm.caps
+	// the send is not made under the mutex, so that Close is not held up by a submitter waiting for a worker
+	select {
+	case pool.jobs <- &poolJob{task: task, fun: fun, args: args, params: params}:
+		return task, nil
+	case <-pool.done:
+		err := NewError(ErrorKey, "submit: the worker pool is closed")
+		task.finish(nil, err)
+		return nil, err
+	}
+}
+
+func ellWorkerPool(argv []Value) (Value, error) {
+	size := IntValue(argv[0])
+	if size < 1 {
+		return nil, NewError(ArgumentErrorKey, "worker-pool expected a positive number of workers, got ", argv[0])
+	}
+	return NewWorkerPool(size), nil
+}
+
+func ellWorkerPoolP(argv []Value) (Value, error) {
+	if argv[0].Type() == WorkerPoolType {
+		return True, nil
+	}
+	return False, nil
+}
+
+// submit runs the function with the arguments on one of the pool's workers, returning a <task> for it
+func ellSubmit(vm *vm, argv []Value) (Value, error) {
+	argc := len(argv)
+	if argc < 2 {
+		return nil, argcError("submit", 2, -1, argc)
+	}
+	pool, ok := argv[0].(*WorkerPool)
+	if !ok {
+		return nil, NewError(ArgumentErrorKey, "submit expected a <worker-pool> for argument 1, got a ", TypeNameOf(argv[0]))
+	}
+	fun, ok := argv[1].(*Function)
+	if !ok || (fun.code == nil && fun.primitive == nil && fun.intrinsic == nil) {
+		return nil, NewError(ArgumentErrorKey, "Bad function for submit: ", argv[1])
+	}
+	args := make([]Value, argc-2)
+	copy(args, argv[2:])
+	return pool.submit(vm, fun, args)
+}
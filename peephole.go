@@ -0,0 +1,197 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+// The peephole optimizer. Compiled code is rewritten to use fewer instructions:
+//
+//   (global f) (call n)         -> (callglobal f n)
+//   (global f) (tailcall n)     -> (tailcallglobal f n)
+//   (call n) (return)           -> (tailcall n), and likewise for callglobal, in function bodies
+//   (local i j) (jumpfalse L)   -> (localjumpfalse i j L)
+//   (jump L) ... L: (jump M)    -> (jump M), and likewise for the conditional jumps
+//   (jump L) ... L: (return)    -> (return)
+//   (jump L) (pop)              -> (jump L), when nothing jumps to the (pop), and likewise after any return
+//
+// The instructions are decoded into a list in which jumps point at the instruction they go to, so that the code
+// can be rearranged and the offsets computed again afterwards. Two instructions are only fused if no jump goes to
+// the second one. Calls at the top level of a thunk are left alone, since a continuation captured by a tail call
+// from there would have nowhere to return to.
+
+type instruction struct {
+	op       int
+	operands []int        // not including a jump's offset
+	target   *instruction // for jumps, where to, or nil for the end of the code
+	label    bool         // true if a jump goes to this instruction
+}
+
+func isJump(op int) bool {
+	return op == opcodeJump || op == opcodeJumpFalse || op == opcodeLocalJumpFalse
+}
+
+func decodeInstructions(ops []int) []*instruction {
+	var instrs []*instruction
+	at := make(map[int]*instruction)
+	var offsets []int
+	for pc := 0; pc < len(ops); {
+		op := ops[pc]
+		width := opcodeWidth(op)
+		instr := &instruction{op: op, operands: append([]int{}, ops[pc+1:pc+width]...)}
+		if isJump(op) {
+			last := len(instr.operands) - 1
+			offsets = append(offsets, pc+instr.operands[last])
+			instr.operands = instr.operands[:last]
+		}
+		at[pc] = instr
+		instrs = append(instrs, instr)
+		pc += width
+	}
+	i := 0
+	for _, instr := range instrs {
+		if isJump(instr.op) {
+			instr.target = at[offsets[i]]
+			i++
+		}
+	}
+	return instrs
+}
+
+func encodeInstructions(instrs []*instruction) []int {
+	pcs := make(map[*instruction]int, len(instrs))
+	pc := 0
+	for _, instr := range instrs {
+		pcs[instr] = pc
+		pc += opcodeWidth(instr.op)
+	}
+	end := pc
+	ops := make([]int, 0, end)
+	for _, instr := range instrs {
+		ops = append(ops, instr.op)
+		ops = append(ops, instr.operands...)
+		if isJump(instr.op) {
+			to := end
+			if instr.target != nil {
+				to = pcs[instr.target]
+			}
+			ops = append(ops, to-pcs[instr])
+		}
+	}
+	return ops
+}
+
+// threadJumps - make jumps go directly to where a chain of unconditional jumps ends up
+func threadJumps(instrs []*instruction) bool {
+	changed := false
+	for _, instr := range instrs {
+		if !isJump(instr.op) {
+			continue
+		}
+		for hops := 0; instr.target != nil && instr.target.op == opcodeJump && instr.target != instr && hops < len(instrs); hops++ {
+			instr.target = instr.target.target
+			changed = true
+		}
+		if instr.op == opcodeJump && instr.target != nil && instr.target.op == opcodeReturn {
+			instr.op = opcodeReturn
+			instr.target = nil
+			changed = true
+		}
+	}
+	return changed
+}
+
+func markLabels(instrs []*instruction) {
+	for _, instr := range instrs {
+		instr.label = false
+	}
+	for _, instr := range instrs {
+		if instr.target != nil {
+			instr.target.label = true
+		}
+	}
+}
+
+// dropUnreachable - remove the instructions that follow a jump or a return, up to the next one that is jumped to
+func dropUnreachable(instrs []*instruction) ([]*instruction, bool) {
+	markLabels(instrs)
+	result := make([]*instruction, 0, len(instrs))
+	reachable := true
+	for _, instr := range instrs {
+		if instr.label {
+			reachable = true
+		}
+		if reachable {
+			result = append(result, instr)
+		}
+		switch instr.op {
+		case opcodeJump, opcodeReturn, opcodeTailCall, opcodeTailCallGlobal:
+			reachable = false
+		}
+	}
+	return result, len(result) != len(instrs)
+}
+
+// fuse - combine pairs of instructions into superinstructions
+func fuse(instrs []*instruction, inFunction bool) ([]*instruction, bool) {
+	markLabels(instrs)
+	changed := false
+	result := make([]*instruction, 0, len(instrs))
+	for i := 0; i < len(instrs); i++ {
+		instr := instrs[i]
+		if i+1 < len(instrs) && !instrs[i+1].label {
+			next := instrs[i+1]
+			fused := true
+			switch {
+			case instr.op == opcodeGlobal && next.op == opcodeCall:
+				instr.op = opcodeCallGlobal
+				instr.operands = append(instr.operands, next.operands[0])
+			case instr.op == opcodeGlobal && next.op == opcodeTailCall:
+				instr.op = opcodeTailCallGlobal
+				instr.operands = append(instr.operands, next.operands[0])
+			case inFunction && instr.op == opcodeCall && next.op == opcodeReturn:
+				instr.op = opcodeTailCall
+			case inFunction && instr.op == opcodeCallGlobal && next.op == opcodeReturn:
+				instr.op = opcodeTailCallGlobal
+			case instr.op == opcodeLocal && next.op == opcodeJumpFalse:
+				instr.op = opcodeLocalJumpFalse
+				instr.target = next.target
+			default:
+				fused = false
+			}
+			if fused {
+				i++
+				changed = true
+			}
+		}
+		result = append(result, instr)
+	}
+	return result, changed
+}
+
+// optimizeOps - apply the peephole optimizations to the code, until there is nothing more to do. The code is a
+// function body if inFunction is true, otherwise a top level thunk.
+func (code *Code) optimizeOps(inFunction bool) {
+	instrs := decodeInstructions(code.ops)
+	for {
+		threaded := threadJumps(instrs)
+		var dropped, fused bool
+		instrs, dropped = dropUnreachable(instrs)
+		instrs, fused = fuse(instrs, inFunction)
+		if !threaded && !dropped && !fused {
+			break
+		}
+	}
+	code.ops = encodeInstructions(instrs)
+}
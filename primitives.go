@@ -23,6 +23,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 
@@ -33,10 +34,10 @@ import (
 
 // InitEnvironment - defines the global functions/variables/macros for the top level environment
 func InitPrimitives() {
-	DefineMacro("let", ellLet)
-	DefineMacro("letrec", ellLetrec)
-	DefineMacro("cond", ellCond)
-	DefineMacro("quasiquote", ellQuasiquote)
+	defineExpanderMacro("let", (*expander).expandLet)
+	defineExpanderMacro("letrec", (*expander).expandLetrec)
+	defineExpanderMacro("cond", (*expander).expandCond)
+	defineExpanderMacro("quasiquote", (*expander).expandQuasiquote)
 
 	DefineGlobal("null", Null)
 	DefineGlobal("true", True)
@@ -46,6 +47,54 @@ func InitPrimitives() {
 	DefineGlobal("callcc", CallCC)
 	DefineGlobal("spawn", Spawn)
 
+	defineIntrinsic("push-winder", ellPushWinder, "(<function> <function>) <null>")
+	defineIntrinsic("pop-winder", ellPopWinder, "() <null>")
+	defineIntrinsic("make-parameter", ellMakeParameter, "(<any> <function>*) <function>")
+	defineIntrinsic("push-parameters", ellPushParameters, "(<any>*) <null>")
+	DefineFunction("parameter?", ellParameterP, BooleanType, AnyType)
+
+	DefineFunction("task?", ellTaskP, BooleanType, AnyType)
+	DefineFunction("task-status", ellTaskStatus, KeywordType, TaskType)
+	DefineFunctionOptionalArgs("task-wait", ellTaskWait, BooleanType, []Value{TaskType, NumberType}, MinusOne)
+	DefineFunction("task-result", ellTaskResult, AnyType, TaskType)
+	DefineFunction("task-error", ellTaskError, AnyType, TaskType)
+	DefineFunction("task-cancel", ellTaskCancel, BooleanType, TaskType)
+	DefineFunction("task-cancelled?", ellTaskCancelledP, BooleanType, TaskType)
+	defineIntrinsic("current-task", ellCurrentTask, "() <any>")
+	DefineFunction("tasks", ellTasks, ListType)
+
+	DefineFunction("atom", ellAtom, AtomType, AnyType)
+	DefineFunction("atom?", ellAtomP, BooleanType, AnyType)
+	DefineFunction("deref", ellDeref, AnyType, AtomType)
+	DefineFunction("reset!", ellResetBang, AnyType, AtomType, AnyType)
+	DefineFunction("compare-and-set!", ellCompareAndSetBang, BooleanType, AtomType, AnyType, AnyType)
+	defineIntrinsic("swap!", ellSwapBang, "(<atom> <function> <any>*) <any>")
+	DefineFunction("mutex", ellMutex, MutexType)
+	DefineFunction("lock", ellLock, NullType, MutexType)
+	DefineFunction("unlock", ellUnlock, NullType, MutexType)
+	DefineFunction("wait-group", ellWaitGroup, WaitGroupType)
+	DefineFunction("wait-group-add", ellWaitGroupAdd, NullType, WaitGroupType, NumberType)
+	DefineFunction("wait-group-done", ellWaitGroupDone, NullType, WaitGroupType)
+	DefineFunctionOptionalArgs("wait-group-wait", ellWaitGroupWait, BooleanType, []Value{WaitGroupType, NumberType}, MinusOne)
+	DefineFunction("synchronize!", ellSynchronizeBang, AnyType, AnyType)
+	DefineFunction("synchronized?", ellSynchronizedP, BooleanType, AnyType)
+
+	defineIntrinsic("pmap", ellPmap, "(<function> <any> <number>*) <any>")
+	defineIntrinsic("pfor-each", ellPforEach, "(<function> <any> <number>*) <null>")
+	DefineFunction("worker-pool", ellWorkerPool, WorkerPoolType, NumberType)
+	DefineFunction("worker-pool?", ellWorkerPoolP, BooleanType, AnyType)
+	defineIntrinsic("submit", ellSubmit, "(<worker-pool> <function> <any>*) <task>")
+
+	defineIntrinsic("spawn-actor", ellSpawnActor, "(<function> <any>*) <actor>")
+	DefineFunction("actor?", ellActorP, BooleanType, AnyType)
+	DefineFunction("actor-task", ellActorTask, TaskType, ActorType)
+	defineIntrinsic("self", ellSelf, "() <any>")
+	DefineFunction("tell", ellTell, BooleanType, ActorType, AnyType)
+	defineIntrinsic("receive", ellReceiveMessage, "(<number>*) <any>")
+	defineIntrinsic("receive-if", ellReceiveIf, "(<function> <number>*) <any>")
+	defineIntrinsic("link", ellLink, "(<actor>) <null>")
+	defineIntrinsic("monitor", ellMonitor, "(<actor>) <null>")
+
 	DefineFunction("version", ellVersion, StringType)
 	DefineFunction("boolean?", ellBooleanP, BooleanType, AnyType)
 	DefineFunction("not", ellNot, BooleanType, AnyType)
@@ -59,6 +108,7 @@ func InitPrimitives() {
 	DefineFunction("instance", ellInstance, AnyType, TypeType, AnyType)
 
 	DefineFunction("type?", ellTypeP, BooleanType, AnyType)
+	DefineFunction("conforms?", ellConformsP, BooleanType, AnyType, TypeType)
 	DefineFunction("type-name", ellTypeName, SymbolType, TypeType)
 	DefineFunction("keyword?", ellKeywordP, BooleanType, AnyType)
 	DefineFunction("keyword-name", ellKeywordName, SymbolType, KeywordType)
@@ -71,7 +121,7 @@ func InitPrimitives() {
 	DefineFunction("to-string", ellToString, StringType, AnyType)
 	DefineFunction("string-length", ellStringLength, NumberType, StringType)
 	DefineFunction("split", ellSplit, ListType, StringType, StringType)
-	DefineFunction("join", ellJoin, ListType, ListType, StringType) // <list|vector> for both arg1 and result could work
+	DefineFunction("join", ellJoin, StringType, Intern("<list|vector>"), StringType)
 	DefineFunction("character?", ellCharacterP, BooleanType, AnyType)
 	DefineFunction("to-character", ellToCharacter, CharacterType, AnyType)
 	DefineFunction("substring", ellSubstring, StringType, StringType, NumberType, NumberType)
@@ -143,7 +193,7 @@ func InitPrimitives() {
 	DefineFunctionRestArgs("struct", ellStruct, StructType, AnyType)
 	DefineFunction("make-struct", ellMakeStruct, StructType, NumberType)
 	DefineFunction("struct-length", ellStructLength, NumberType, StructType)
-	DefineFunction("has?", ellHasP, BooleanType, StructType, AnyType) // key is <symbol|keyword|type|string>
+	DefineFunction("has?", ellHasP, BooleanType, StructType, Intern("<symbol|keyword|type|string>"))
 	DefineFunction("get", ellGet, AnyType, StructType, AnyType)
 	DefineFunction("put!", ellPutBang, NullType, StructType, AnyType, AnyType)
 	DefineFunction("unput!", ellUnputBang, NullType, StructType, AnyType)
@@ -153,12 +203,12 @@ func InitPrimitives() {
 	DefineFunction("function?", ellFunctionP, BooleanType, AnyType)
 	DefineFunction("function-signature", ellFunctionSignature, StringType, FunctionType)
 	DefineFunctionRestArgs("validate-keyword-arg-list", ellValidateKeywordArgList, ListType, KeywordType, ListType)
-	DefineFunction("slurp", ellSlurp, StringType, StringType)
+	DefineFunction("slurp", nil, StringType, StringType)
 	DefineFunction("read", ellRead, AnyType, StringType)
 	DefineFunction("read-all", ellReadAll, AnyType, StringType)
-	DefineFunction("spit", ellSpit, NullType, StringType, StringType)
-	DefineFunctionKeyArgs("write", ellWrite, NullType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
-	DefineFunctionKeyArgs("write-all", ellWriteAll, NullType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
+	DefineFunction("spit", nil, NullType, StringType, StringType)
+	DefineFunctionKeyArgs("write", ellWrite, StringType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
+	DefineFunctionKeyArgs("write-all", ellWriteAll, StringType, []Value{AnyType, StringType}, []Value{EmptyString}, []Value{Intern("indent:")})
 	DefineFunctionRestArgs("print", ellPrint, NullType, AnyType)
 	DefineFunctionRestArgs("println", ellPrintln, NullType, AnyType)
 	DefineFunction("macroexpand", ellMacroexpand, AnyType, AnyType)
@@ -177,10 +227,19 @@ func InitPrimitives() {
 	DefineFunction("now", ellNow, NumberType)
 	DefineFunction("since", ellSince, NumberType, NumberType)
 	DefineFunction("sleep", ellSleep, NumberType, NumberType)
+	DefineFunction("after", ellAfter, ChannelType, NumberType)
+	DefineFunction("ticker", ellTicker, ChannelType, NumberType)
+	DefineFunction("stop-timer", ellStopTimer, BooleanType, ChannelType)
+	DefineFunction("deterministic?", ellDeterministicP, BooleanType)
 
 	DefineFunctionKeyArgs("channel", ellChannel, ChannelType, []Value{StringType, NumberType}, []Value{EmptyString, Zero}, []Value{Intern("name:"), Intern("bufsize:")})
 	DefineFunctionOptionalArgs("send", ellSend, NullType, []Value{ChannelType, AnyType, NumberType}, MinusOne)
 	DefineFunctionOptionalArgs("recv", ellReceive, AnyType, []Value{ChannelType, NumberType}, MinusOne)
+	DefineFunctionOptionalArgs("recv-ok", ellReceiveOk, ListType, []Value{ChannelType, NumberType}, MinusOne)
+	DefineFunction("closed?", ellClosedP, BooleanType, ChannelType)
+	DefineFunction("channel-length", ellChannelLength, NumberType, ChannelType)
+	DefineFunction("channel-capacity", ellChannelCapacity, NumberType, ChannelType)
+	DefineFunctionOptionalArgs("channel-select", ellChannelSelect, ListType, []Value{ListType, NumberType}, MinusOne)
 	DefineFunction("close", ellClose, NullType, AnyType)
 
 	DefineFunction("set-random-seed!", ellSetRandomSeedBang, NullType, NumberType)
@@ -190,46 +249,30 @@ func InitPrimitives() {
 	DefineFunctionRestArgs("uuid", ellUUIDFromTime, StringType, StringType)
 	DefineFunction("timestamp", ellTimestamp, StringType)
 
-	DefineFunction("listen", ellListen, ChannelType, NumberType)
-	DefineFunction("connect", ellConnect, AnyType, StringType, NumberType)
+	DefineFunction("listen", nil, ChannelType, NumberType)
+	DefineFunctionOptionalArgs("connect", nil, AnyType, []Value{AnyType, NumberType}, Zero)
+	DefineType(&ValueType{Name: "<connection>", Read: readConnection, Write: connectionData})
 
-	DefineFunction("serve", ellHTTPServer, AnyType, NumberType, FunctionType)
-	DefineFunctionKeyArgs("http", ellHTTPClient, StructType,
+	DefineFunction("serve", nil, AnyType, NumberType, FunctionType)
+	DefineFunctionKeyArgs("http", nil, StructType,
 		[]Value{StringType, StringType, StructType, BlobType}, //(http "url" method: "PUT" headers: {} body: #[blob])
 		[]Value{NewString("GET"), EmptyStruct, EmptyBlob},
 		[]Value{Intern("method:"), Intern("headers:"), Intern("body:")})
 
-	DefineFunction("getenv", ellGetenv, StringType, StringType)
-	DefineFunction("load", ellLoad, StringType, AnyType)
-
-	if true {
-		err := Load("ell")
-		if err != nil {
-			Fatal("*** ", err)
-		}
-	}
+	DefineFunction("getenv", nil, Intern("<string?>"), StringType)
+	DefineFunction("capabilities", nil, StructType)
+	DefineFunction("load", nil, StringType, AnyType)
+	DefineFunction("save-image", nil, NullType, StringType)
+	DefineFunction("load-image", nil, NullType, StringType)
+	setRestrictedPrimitives() // the primitives defined without a function above
+	setAllocationCosts()
+	setPurePrimitives()
 }
 
 //
 //expanders - these only gets called from the macro expander itself, so we know the single arg is an *LList
 //
 
-func ellLetrec(argv []Value) (Value, error) {
-	return expandLetrec(argv[0])
-}
-
-func ellLet(argv []Value) (Value, error) {
-	return expandLet(argv[0])
-}
-
-func ellCond(argv []Value) (Value, error) {
-	return expandCond(argv[0])
-}
-
-func ellQuasiquote(argv []Value) (Value, error) {
-	return expandQuasiquote(argv[0])
-}
-
 // functions
 
 func ellVersion(_ []Value) (Value, error) {
@@ -256,9 +299,12 @@ func ellDefinedP(argv []Value) (Value, error) {
 	return False, nil
 }
 
-func ellSlurp(argv []Value) (Value, error) {
+func ellSlurp(vm *vm, argv []Value) (Value, error) {
 	url := StringValue(argv[0])
-	if strings.HasPrefix(url, "http:") || strings.HasPrefix(url, "https:") {
+	if isURL(url) {
+		if err := vm.caps.checkNetwork("slurp"); err != nil {
+			return nil, err
+		}
 		res, err := httpClientOperation("GET", url, nil, nil)
 		if err != nil {
 			return nil, err
@@ -270,17 +316,27 @@ func ellSlurp(argv []Value) (Value, error) {
 		s, _ := ToString(res.Get(Intern("body:")))
 		return s, nil
 	}
-	s, err := SlurpFile(StringValue(argv[0]))
+	path, err := vm.caps.path(ExpandFilePath(url), false)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.allocate(fileSize(path)); err != nil {
+		return nil, err
+	}
+	s, err := SlurpFile(path)
 	if err != nil {
 		return nil, err
 	}
 	return NewString(s), nil
 }
 
-func ellSpit(argv []Value) (Value, error) {
-	url := StringValue(argv[0])
+func ellSpit(vm *vm, argv []Value) (Value, error) {
+	path, err := vm.caps.path(ExpandFilePath(StringValue(argv[0])), true)
+	if err != nil {
+		return nil, err
+	}
 	data := StringValue(argv[1])
-	err := SpitFile(url, data)
+	err = SpitFile(path, data)
 	if err != nil {
 		return nil, err
 	}
@@ -307,8 +363,8 @@ func ellCompile(argv []Value) (Value, error) {
 	return Compile(expanded)
 }
 
-func ellLoad(argv []Value) (Value, error) {
-	err := Load(StringValue(argv[0]))
+func ellLoad(vm *vm, argv []Value) (Value, error) {
+	err := loadModule(StringValue(argv[0]), vm.caps)
 	return argv[0], err
 }
 
@@ -666,11 +722,15 @@ func ellVectorP(argv []Value) (Value, error) {
 
 func ellVectorLength(argv []Value) (Value, error) {
 	vec, _ := argv[0].(*Vector)
+	vec.RLock()
+	defer vec.RUnlock()
 	return Integer(len(vec.Elements)), nil
 }
 
 func ellVectorRef(argv []Value) (Value, error) {
 	vec, _ := argv[0].(*Vector)
+	vec.RLock()
+	defer vec.RUnlock()
 	el := vec.Elements
 	idx := IntValue(argv[1])
 	if idx < 0 || idx >= len(el) {
@@ -681,6 +741,8 @@ func ellVectorRef(argv []Value) (Value, error) {
 
 func ellVectorSetBang(argv []Value) (Value, error) {
 	vec, _ := argv[0].(*Vector)
+	vec.Lock()
+	defer vec.Unlock()
 	el := vec.Elements
 	idx := IntValue(argv[1])
 	if idx < 0 || idx > len(el) {
@@ -748,7 +810,17 @@ func ellToKeyword(argv []Value) (Value, error) {
 }
 
 func ellTypeP(argv []Value) (Value, error) {
-	if IsType(argv[0]) {
+	if isTypeExpression(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellConformsP(argv []Value) (Value, error) {
+	if _, err := typeExpression(argv[1]); err != nil {
+		return nil, err
+	}
+	if conforms(argv[0], argv[1]) {
 		return True, nil
 	}
 	return False, nil
@@ -882,8 +954,7 @@ func ellGet(argv []Value) (Value, error) {
 }
 
 func ellStructLength(argv []Value) (Value, error) {
-	s := argv[0].(*Struct)
-	return Integer(len(s.Bindings)), nil
+	return Integer(StructLength(argv[0].(*Struct))), nil
 }
 
 func ellHasP(argv []Value) (Value, error) {
@@ -962,67 +1033,119 @@ func ellClose(argv []Value) (Value, error) {
 		CloseChannel(p)
 	case *Connection:
 		closeConnection(p)
+	case *WorkerPool:
+		p.Close()
 	default:
-		return nil, NewError(ArgumentErrorKey, "close expected a channel or connection")
+		return nil, NewError(ArgumentErrorKey, "close expected a channel, connection, or worker pool")
 	}
 	return Null, nil
 }
 
 func ellSend(argv []Value) (Value, error) {
-	ch := ChannelValue(argv[0])
-	if ch != nil { //not closed
-		val := argv[1]
-		timeout := Float64Value(argv[2]) //FIX: timeouts in seconds, floating point
-		if NumberEqual(timeout, 0.0) {   //non-blocking
-			select {
-			case ch <- val:
-				return True, nil
-			default:
-			}
-		} else if timeout > 0 { //with timeout
-			dur := time.Millisecond * time.Duration(timeout*1000.0)
-			select {
-			case ch <- val:
-				return True, nil
-			case <-time.After(dur):
-			}
-		} else { //block forever
-			ch <- val
-			return True, nil
-		}
+	if SendChannel(argv[0], argv[1], Float64Value(argv[2])) {
+		return True, nil
 	}
 	return False, nil
 }
 
 func ellReceive(argv []Value) (Value, error) {
-	ch := ChannelValue(argv[0])
-	if ch != nil { //not closed
-		timeout := Float64Value(argv[1])
-		if NumberEqual(timeout, 0.0) { //non-blocking
-			select {
-			case val, ok := <-ch:
-				if ok && val != nil {
-					return val, nil
-				}
-			default:
-			}
-		} else if timeout > 0 { //with timeout
-			dur := time.Millisecond * time.Duration(timeout*1000.0)
-			select {
-			case val, ok := <-ch:
-				if ok && val != nil {
-					return val, nil
-				}
-			case <-time.After(dur):
+	val, _ := ReceiveChannel(argv[0], Float64Value(argv[1]))
+	return val, nil
+}
+
+func ellReceiveOk(argv []Value) (Value, error) {
+	val, ok := ReceiveChannel(argv[0], Float64Value(argv[1]))
+	if ok {
+		return NewList(val, True), nil
+	}
+	return NewList(Null, False), nil
+}
+
+func ellClosedP(argv []Value) (Value, error) {
+	if argv[0].(*Channel).IsClosed() {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellChannelLength(argv []Value) (Value, error) {
+	ch := argv[0].(*Channel)
+	if virtual != nil {
+		return Integer(len(ch.buffer)), nil
+	}
+	return Integer(len(ch.channel)), nil
+}
+
+func ellChannelCapacity(argv []Value) (Value, error) {
+	return Integer(cap(argv[0].(*Channel).channel)), nil
+}
+
+// channel-select waits on several channel operations at once. Each case is either a <channel> to receive from,
+// or a list of a <channel> and a value to send on it. The result is a list of the index of the case that fired,
+// the value received (null for sends), and whether a value was actually received (false if the channel
+// was closed). Sends to closed channels never fire. If the timeout expires first, the index is -1.
+func ellChannelSelect(argv []Value) (result Value, err error) {
+	var selected []selectCase
+	for lst := argv[0].(*List); lst != EmptyList; lst = lst.Cdr {
+		switch p := lst.Car.(type) {
+		case *Channel:
+			selected = append(selected, selectCase{channel: p})
+		case *List:
+			if ch, ok := Car(p).(*Channel); ok && ListLength(p) == 2 {
+				selected = append(selected, selectCase{channel: ch, send: true, value: p.Cdr.Car})
+				continue
 			}
-		} else { //block forever
-			val := <-ch
-			if val != nil {
-				return val, nil
+			return nil, NewError(ArgumentErrorKey, "channel-select expected a (<channel> <any>) send case, got ", p)
+		default:
+			return nil, NewError(ArgumentErrorKey, "channel-select expected a <channel> or a send case, got a ", TypeNameOf(p))
+		}
+	}
+	timeout := Float64Value(argv[1])
+	if virtual != nil {
+		chosen, val, ok := virtual.selectChannels(selected, timeout)
+		if ok {
+			return NewList(Integer(chosen), val, True), nil
+		}
+		return NewList(Integer(chosen), Null, False), nil
+	}
+	var cases []reflect.SelectCase
+	for i := range selected {
+		c := &selected[i]
+		if c.send {
+			ch := c.channel.channel
+			if c.channel.IsClosed() {
+				ch = nil //a nil channel is never ready
 			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch), Send: reflect.ValueOf(&c.value).Elem()})
+		} else {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.channel.channel)})
 		}
 	}
-	return Null, nil
+	ncases := len(cases)
+	if NumberEqual(timeout, 0.0) { //non-blocking
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	} else if timeout > 0 { //with timeout
+		dur := time.Millisecond * time.Duration(timeout*1000.0)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(dur))})
+	}
+	defer func() {
+		if recover() != nil { //a channel was closed while we were waiting to send on it
+			result, err = nil, NewError(ErrorKey, "channel-select: send on a channel that was closed")
+		}
+	}()
+	chosen, recv, ok := reflect.Select(cases)
+	if chosen >= ncases {
+		return NewList(MinusOne, Null, False), nil
+	}
+	if cases[chosen].Dir == reflect.SelectSend {
+		return NewList(Integer(chosen), Null, True), nil
+	}
+	if ok {
+		if v, _ := recv.Interface().(Value); v != nil {
+			return NewList(Integer(chosen), v, True), nil
+		}
+	}
+	return NewList(Integer(chosen), Null, False), nil
 }
 
 func ellSetRandomSeedBang(argv []Value) (Value, error) {
@@ -1126,7 +1249,13 @@ func ellBlobRef(argv []Value) (Value, error) {
 	return Integer(int(el[idx])), nil
 }
 
-func ellListen(argv []Value) (Value, error) {
+func ellListen(vm *vm, argv []Value) (Value, error) {
+	if err := vm.caps.checkNetwork("listen"); err != nil {
+		return nil, err
+	}
+	if err := notDeterministic("listen"); err != nil {
+		return nil, err
+	}
 	port := fmt.Sprintf(":%d", IntValue(argv[0]))
 	listener, err := net.Listen("tcp", port)
 	if err != nil {
@@ -1137,7 +1266,17 @@ func ellListen(argv []Value) (Value, error) {
 	return acceptChan, nil
 }
 
-func ellConnect(argv []Value) (Value, error) {
+func ellConnect(vm *vm, argv []Value) (Value, error) {
+	if err := vm.caps.checkNetwork("connect"); err != nil {
+		return nil, err
+	}
+	if c, ok := argv[0].(*Connection); ok {
+		// a connection that was read, or closed: open a new one to the same endpoint
+		return Connect(c.endpoint)
+	}
+	if _, ok := argv[0].(*String); !ok {
+		return nil, NewError(ArgumentErrorKey, "connect expected a string or connection, got ", argv[0])
+	}
 	host := StringValue(argv[0])
 	port := IntValue(argv[1])
 	var endpoint string
@@ -1148,23 +1287,28 @@ func ellConnect(argv []Value) (Value, error) {
 		// IPv4 address
 		endpoint = fmt.Sprintf("%s:%d", host, port)
 	}
-	con, err := net.Dial("tcp", endpoint)
-	if err != nil {
-		return nil, err
-	}
-	return NewConnection(con, endpoint), nil
+	return Connect(endpoint)
 }
 
-func ellHTTPServer(argv []Value) (Value, error) {
+func ellHTTPServer(vm *vm, argv []Value) (Value, error) {
+	if err := vm.caps.checkNetwork("serve"); err != nil {
+		return nil, err
+	}
+	if err := notDeterministic("serve"); err != nil {
+		return nil, err
+	}
 	port := IntValue(argv[0])
 	handler := argv[1].(*Function) // a function of one <struct> argument
 	if handler.code == nil || handler.code.argc != 1 {
 		return nil, NewError(ArgumentErrorKey, "Cannot use this function as a handler: ", handler)
 	}
-	return httpServer(port, handler)
+	return httpServer(port, handler, vm.caps)
 }
 
-func ellHTTPClient(argv []Value) (Value, error) {
+func ellHTTPClient(vm *vm, argv []Value) (Value, error) {
+	if err := vm.caps.checkNetwork("http"); err != nil {
+		return nil, err
+	}
 	url := StringValue(argv[0])
 	method := strings.ToUpper(StringValue(argv[1]))
 	headers := argv[2].(*Struct)
@@ -1179,6 +1323,9 @@ func ellHTTPClient(argv []Value) (Value, error) {
 }
 
 func Now() float64 {
+	if virtual != nil {
+		return virtual.now
+	}
 	now := time.Now()
 	return float64(now.UnixNano()) / float64(time.Second)
 }
@@ -1194,6 +1341,10 @@ func ellSince(argv []Value) (Value, error) {
 }
 
 func Sleep(delayInSeconds float64) {
+	if virtual != nil {
+		virtual.sleep(delayInSeconds)
+		return
+	}
 	dur := time.Duration(delayInSeconds * float64(time.Second))
 	time.Sleep(dur) //!! this is not interruptable, fairly risky in a REPL
 }
@@ -1203,7 +1354,29 @@ func ellSleep(argv []Value) (Value, error) {
 	return Float(Now()), nil
 }
 
-func ellGetenv(argv []Value) (Value, error) {
+func ellAfter(argv []Value) (Value, error) {
+	return NewTimerChannel(Float64Value(argv[0])), nil
+}
+
+func ellTicker(argv []Value) (Value, error) {
+	interval := Float64Value(argv[0])
+	if interval <= 0 {
+		return nil, NewError(ArgumentErrorKey, "ticker expected a positive interval, got ", argv[0])
+	}
+	return NewTickerChannel(interval), nil
+}
+
+func ellStopTimer(argv []Value) (Value, error) {
+	if StopTimer(argv[0]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellGetenv(vm *vm, argv []Value) (Value, error) {
+	if err := vm.caps.checkEnvironment("getenv"); err != nil {
+		return nil, err
+	}
 	s := os.Getenv(StringValue(argv[0]))
 	if s == "" {
 		return Null, nil
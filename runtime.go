@@ -78,9 +78,10 @@ func Fatal(args ...interface{}) {
 
 // Continuation -
 type Continuation struct {
-	ops   []int
-	stack []Value
-	pc    int
+	ops     []int
+	stack   []Value
+	pc      int
+	winders *winder
 }
 
 func Closure(code *Code, frame *Frame) *Function {
@@ -90,12 +91,13 @@ func Closure(code *Code, frame *Frame) *Function {
 	}
 }
 
-func NewContinuation(frame *Frame, ops []int, pc int, stack []Value) *Function {
+func NewContinuation(frame *Frame, ops []int, pc int, stack []Value, winders *winder) *Function {
 	cont := new(Continuation)
 	cont.ops = ops
 	cont.stack = make([]Value, len(stack))
 	copy(cont.stack, stack)
 	cont.pc = pc
+	cont.winders = winders
 	return &Function{
 		frame:        frame,
 		continuation: cont,
@@ -107,10 +109,14 @@ const defaultStackSize = 1000
 // VM - the Ell VM
 type vm struct {
 	stackSize int
+	winders   *winder       // the dynamic extents currently entered, innermost first
+	task      *Task         // the task this VM is running, if it was spawned
+	budget    *budget       // the allocation budget of the evaluation, if it is limited
+	caps      *Capabilities // what the evaluation may do outside of the process
 }
 
 func VM(stackSize int) *vm {
-	return &vm{stackSize}
+	return &vm{stackSize: stackSize, budget: newBudget(), caps: currentCapabilities()}
 }
 
 var FunctionType Value = Intern("<function>")
@@ -120,6 +126,8 @@ type Function struct {
 	code         *Code
 	frame        *Frame
 	primitive    *Primitive
+	intrinsic    *Intrinsic
+	parameter    *Parameter
 	continuation *Continuation
 }
 
@@ -139,6 +147,9 @@ func (f *Function) String() string {
 	if f.primitive != nil {
 		return "#[function " + f.primitive.name + "]"
 	}
+	if f.intrinsic != nil {
+		return "#[function " + f.intrinsic.name + "]"
+	}
 	if f.code != nil {
 		n := f.code.name
 		if n == "" {
@@ -174,6 +185,9 @@ func functionSignature(f *Function) string {
 	if f.primitive != nil {
 		return f.primitive.signature
 	}
+	if f.intrinsic != nil {
+		return f.intrinsic.signature
+	}
 	if f.code != nil {
 		return f.code.signature()
 	}
@@ -187,7 +201,7 @@ func functionSignature(f *Function) string {
 		return "(<function>) <any>"
 	}
 	if f == Spawn {
-		return "(<function> <any>*) <null>"
+		return "(<function> <any>*) <task>"
 	}
 	panic("Bad function")
 }
@@ -201,18 +215,23 @@ type Primitive struct { // <function>
 	fun       PrimitiveFunction
 	signature string
 	//	idx       int
-	argc     int     // -1 means the primitive itself checks the args (legacy mode)
-	result   Value   // if set the type of the result
-	args     []Value // if set, the length must be for total args (both required and optional). The type (or <any>) for each
-	rest     Value   // if set, then any number of this type can follow the normal args. Mutually incompatible with defaults/keys
-	defaults []Value // if set, then that many optional args beyond argc have these default values
-	keys     []Value // if set, then it must match the size of defaults, and these are the keys
+	argc     int                                  // -1 means the primitive itself checks the args (legacy mode)
+	result   Value                                // if set the type of the result
+	args     []Value                              // if set, the length must be for total args (both required and optional). The type (or <any>) for each
+	rest     Value                                // if set, then any number of this type can follow the normal args. Mutually incompatible with defaults/keys
+	defaults []Value                              // if set, then that many optional args beyond argc have these default values
+	keys     []Value                              // if set, then it must match the size of defaults, and these are the keys
+	cost     func(argv []Value) int               // if set, the approximate number of bytes a call allocates
+	size     func(argv []Value, result Value) int // if set, the bytes a call allocated, when it cannot be known until it is made
+	pure     bool                                 // if true, a call with constant arguments can be made when it is compiled
+	tail     intrinsicFunction                    // for a function compiled to Go, the Go function, which may return tail calls
+	vmfun    intrinsicFunction                    // if set, called instead of fun, with the calling VM
 }
 
 func functionSignatureFromTypes(result Value, args []Value, rest Value) string {
 	sig := "("
 	for i, t := range args {
-		if !IsType(t) {
+		if !isTypeExpression(t) {
 			panic("not a type: " + t.String())
 		}
 		if i > 0 {
@@ -221,7 +240,7 @@ func functionSignatureFromTypes(result Value, args []Value, rest Value) string {
 		sig += t.String()
 	}
 	if rest != nil {
-		if !IsType(rest) {
+		if !isTypeExpression(rest) {
 			panic("not a type: " + rest.String())
 		}
 		if sig != "(" {
@@ -230,7 +249,7 @@ func functionSignatureFromTypes(result Value, args []Value, rest Value) string {
 		sig += rest.String() + "*"
 	}
 	sig += ") "
-	if !IsType(result) {
+	if !isTypeExpression(result) {
 		panic("not a type: " + result.String())
 	}
 	sig += result.String()
@@ -255,7 +274,7 @@ func NewPrimitive(name string, fun PrimitiveFunction, result Value, args []Value
 		argc = argc - defc
 		for i := 0; i < defc; i++ {
 			t := args[argc+i]
-			if t != AnyType && defaults[i].Type() != t {
+			if !conforms(defaults[i], t) {
 				panic("argument default's type (" + TypeNameOf(defaults[i]) + ") doesn't match declared type (" + t.String() + ")")
 			}
 		}
@@ -265,11 +284,25 @@ func NewPrimitive(name string, fun PrimitiveFunction, result Value, args []Value
 		}
 	}
 	signature := functionSignatureFromTypes(result, args, rest)
-	prim := &Primitive{name, fun, signature, argc, result, args, rest, defaults, keys}
+	prim := &Primitive{name, fun, signature, argc, result, args, rest, defaults, keys, nil, nil, false, nil, nil}
 	primitives = append(primitives, prim)
 	return &Function{primitive: prim}
 }
 
+// intrinsicFunction is the native go function signature for primitives that need the calling VM's state
+type intrinsicFunction func(vm *vm, argv []Value) (Value, error)
+
+// Intrinsic - a primitive function that operates on the VM's dynamic state. It checks its own arguments.
+type Intrinsic struct { // <function>
+	name      string
+	fun       intrinsicFunction
+	signature string
+}
+
+func newIntrinsic(name string, fun intrinsicFunction, signature string) *Function {
+	return &Function{intrinsic: &Intrinsic{name, fun, signature}}
+}
+
 type Frame struct {
 	locals    *Frame
 	previous  *Frame
@@ -278,6 +311,38 @@ type Frame struct {
 	elements  []Value
 	firstfive [5]Value
 	pc        int
+	results   *resultCheck // if not nil, the declared result types the value returned from the frame must have
+}
+
+// resultCheck - a declared result type to check the value returned from a frame against. The frame of a function
+// called in tail position also checks the results of the functions that tail called it, which have no frames left.
+type resultCheck struct {
+	code *Code
+	next *resultCheck
+}
+
+// checkResult - the error for a value returned from the frame that is not of one of its declared result types
+func (frame *Frame) checkResult(val Value) error {
+	for c := frame.results; c != nil; c = c.next {
+		if !conforms(val, c.code.result) {
+			return resultTypeError(c.code, c.code.result, val)
+		}
+	}
+	return nil
+}
+
+// tailResults - the result checks for the frame of a function called in tail position from a frame with the checks.
+// Each function is only checked once, so tail calls between functions with declared results use no more space.
+func tailResults(results *resultCheck, code *Code) *resultCheck {
+	if code.result == nil {
+		return results
+	}
+	for c := results; c != nil; c = c.next {
+		if c.code == code {
+			return results
+		}
+	}
+	return &resultCheck{code, results}
 }
 
 func (frame *Frame) String() string {
@@ -297,7 +362,34 @@ func (frame *Frame) String() string {
 	return buf.String()
 }
 
+func codeName(code *Code) string {
+	if code.name == "" {
+		return "anonymous function"
+	}
+	return code.name
+}
+
+// checkArgTypes - an error if one of the arguments is not of the type declared for it
+func checkArgTypes(code *Code, args []Value) error {
+	for i, t := range code.argtypes {
+		if i < len(args) && !conforms(args[i], t) {
+			return NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", codeName(code), t.String(), i+1, typeMismatch(args[i], t)))
+		}
+	}
+	return nil
+}
+
+// resultTypeError - the error for a function returning a value that is not of its declared result type
+func resultTypeError(code *Code, t Value, val Value) error {
+	return NewError(ErrorKey, fmt.Sprintf("%s expected to return a %s, got a %s", codeName(code), t.String(), typeMismatch(val, t)))
+}
+
 func buildFrame(env *Frame, pc int, ops []int, fun *Function, argc int, stack []Value, sp int) (*Frame, error) {
+	if fun.code.argtypes != nil {
+		if err := checkArgTypes(fun.code, stack[sp:sp+argc]); err != nil {
+			return nil, err
+		}
+	}
 	f := &Frame{
 		previous: env,
 		pc:       pc,
@@ -305,16 +397,23 @@ func buildFrame(env *Frame, pc int, ops []int, fun *Function, argc int, stack []
 		locals:   fun.frame,
 		code:     fun.code,
 	}
+	if fun.code.result != nil {
+		f.results = &resultCheck{code: fun.code}
+	}
 	expectedArgc := fun.code.argc
 	defaults := fun.code.defaults
 	if defaults == nil {
 		if argc != expectedArgc {
 			return nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
 		}
-		if argc <= 5 {
+		size := argc
+		if fun.code.frameSize > size {
+			size = fun.code.frameSize
+		}
+		if size <= 5 {
 			f.elements = f.firstfive[:]
 		} else {
-			f.elements = make([]Value, argc)
+			f.elements = make([]Value, size)
 		}
 		copy(f.elements, stack[sp:sp+argc])
 		return f, nil
@@ -333,7 +432,11 @@ func buildFrame(env *Frame, pc int, ops []int, fun *Function, argc int, stack []
 		return nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
 	}
 	totalArgc := expectedArgc + extra
-	el := make([]Value, totalArgc)
+	size := totalArgc
+	if fun.code.frameSize > size {
+		size = fun.code.frameSize
+	}
+	el := make([]Value, size)
 	end := sp + expectedArgc
 	if rest {
 		copy(el, stack[sp:end])
@@ -390,6 +493,17 @@ func addContext(env *Frame, err error) error {
 	return err
 }
 
+// loopback - a backward jump is another iteration of a loop, which must yield and can be cancelled like a call
+func (vm *vm) loopback(env *Frame) error {
+	if virtual != nil {
+		virtual.tick()
+	}
+	if vm.task != nil && vm.task.cancelRequested() {
+		return addContext(env, NewError(CancelledKey, "task ", vm.task.id, " was cancelled")) //not catchable
+	}
+	return nil
+}
+
 func (vm *vm) keywordCall(fun *Keyword, argc int, pc int, stack []Value, sp int) (int, int, error) {
 	if argc != 1 {
 		return 0, 0, NewError(ArgumentErrorKey, fun.Text, " expected 1 argument, got ", argc)
@@ -403,34 +517,53 @@ func (vm *vm) keywordCall(fun *Keyword, argc int, pc int, stack []Value, sp int)
 }
 
 func argcError(name string, min int, max int, provided int) error {
-	s := "1 argument"
+	return NewError(ArgumentErrorKey, fmt.Sprintf("%s expected %s, got %d", name, argcString(min, max), provided))
+}
+
+// argcString - a description of the number of arguments expected. A max of -1 means there is no limit.
+func argcString(min int, max int) string {
 	if min == max {
 		if min != 1 {
-			s = fmt.Sprintf("%d arguments", min)
+			return fmt.Sprintf("%d arguments", min)
 		}
+		return "1 argument"
 	} else if max < 0 {
-		s = fmt.Sprintf("%d or more arguments", min)
-	} else {
-		s = fmt.Sprintf("%d to %d arguments", min, max)
+		return fmt.Sprintf("%d or more arguments", min)
+	}
+	return fmt.Sprintf("%d to %d arguments", min, max)
+}
+
+// notCallableGlobal - the error for calling a global that is not a function
+func notCallableGlobal(sym *Symbol) error {
+	if sym.Value == nil {
+		return NewError(ErrorKey, "Undefined symbol: ", sym)
 	}
-	return NewError(ArgumentErrorKey, fmt.Sprintf("%s expected %s, got %d", name, s, provided))
+	return NewError(ArgumentErrorKey, "Not callable: ", sym.Value)
 }
 
 func (vm *vm) callPrimitive(prim *Primitive, argv []Value) (Value, error) {
 	if prim.defaults != nil {
 		return vm.callPrimitiveWithDefaults(prim, argv)
 	}
+	if err := checkArguments(prim, argv); err != nil {
+		return nil, err
+	}
+	return vm.invokePrimitive(prim, argv)
+}
+
+// checkArguments - the error for arguments that do not match those of the primitive, which has no optional ones
+func checkArguments(prim *Primitive, argv []Value) error {
 	argc := len(argv)
 	if argc != prim.argc {
-		return nil, argcError(prim.name, prim.argc, prim.argc, argc)
+		return argcError(prim.name, prim.argc, prim.argc, argc)
 	}
 	for i, arg := range argv {
 		t := prim.args[i]
-		if t != AnyType && arg.Type() != t {
-			return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].String(), i+1, TypeNameOf(argv[i])))
+		if t != AnyType && arg.Type() != t && !conforms(arg, t) {
+			return NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, t.String(), i+1, typeMismatch(arg, t)))
 		}
 	}
-	return prim.fun(argv)
+	return nil
 }
 
 func (vm *vm) callPrimitiveWithDefaults(prim *Primitive, argv []Value) (Value, error) {
@@ -444,19 +577,19 @@ func (vm *vm) callPrimitiveWithDefaults(prim *Primitive, argv []Value) (Value, e
 		for i := 0; i < minargc; i++ {
 			t := prim.args[i]
 			arg := argv[i]
-			if t != AnyType && arg.Type() != t {
-				return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].String(), i+1, TypeNameOf(argv[i])))
+			if t != AnyType && arg.Type() != t && !conforms(arg, t) {
+				return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, t.String(), i+1, typeMismatch(arg, t)))
 			}
 		}
 		if rest != AnyType {
 			for i := minargc; i < provided; i++ {
 				arg := argv[i]
-				if arg.Type() != rest {
-					return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, rest.String(), i+1, TypeNameOf(argv[i])))
+				if arg.Type() != rest && !conforms(arg, rest) {
+					return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, rest.String(), i+1, typeMismatch(arg, rest)))
 				}
 			}
 		}
-		return prim.fun(argv)
+		return vm.invokePrimitive(prim, argv)
 	}
 	maxargc := len(prim.args)
 	if provided < minargc {
@@ -509,11 +642,11 @@ func (vm *vm) callPrimitiveWithDefaults(prim *Primitive, argv []Value) (Value, e
 	}
 	for i, arg := range argv {
 		t := prim.args[i]
-		if t != AnyType && arg.Type() != t {
-			return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].String(), i+1, TypeNameOf(argv[i])))
+		if t != AnyType && arg.Type() != t && !conforms(arg, t) {
+			return nil, NewError(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, t.String(), i+1, typeMismatch(arg, t)))
 		}
 	}
-	return prim.fun(argv)
+	return vm.invokePrimitive(prim, argv)
 }
 
 func (vm *vm) funcall(callable Value, argc int, ops []int, savedPc int, stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
@@ -523,7 +656,18 @@ opcodeCallAgain:
 			if interrupted || checkInterrupt() {
 				return nil, 0, 0, nil, addContext(env, NewError(InterruptKey)) //not catchable
 			}
-			if fun.code.defaults == nil {
+			if virtual != nil {
+				virtual.tick()
+			}
+			if vm.task != nil && vm.task.cancelRequested() {
+				return nil, 0, 0, nil, addContext(env, NewError(CancelledKey, "task ", vm.task.id, " was cancelled")) //not catchable
+			}
+			if vm.budget != nil {
+				if err := vm.allocate(frameCost(argc)); err != nil {
+					return nil, 0, 0, nil, addContext(env, err) //not catchable
+				}
+			}
+			if fun.code.defaults == nil && fun.code.argtypes == nil {
 				f := new(Frame)
 				f.previous = env
 				f.pc = savedPc
@@ -534,10 +678,14 @@ opcodeCallAgain:
 				if argc != expectedArgc {
 					return nil, 0, 0, nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
 				}
-				if argc <= 5 {
-					f.elements = f.firstfive[:argc]
+				size := argc
+				if fun.code.frameSize > size {
+					size = fun.code.frameSize
+				}
+				if size <= 5 {
+					f.elements = f.firstfive[:size]
 				} else {
-					f.elements = make([]Value, argc)
+					f.elements = make([]Value, size)
 				}
 				endSp := sp + argc
 				copy(f.elements, stack[sp:endSp])
@@ -561,6 +709,15 @@ opcodeCallAgain:
 			stack[sp] = val
 			return ops, savedPc, sp, env, err
 		}
+		if fun.intrinsic != nil {
+			val, err := fun.intrinsic.fun(vm, stack[sp:sp+argc])
+			if err != nil {
+				return vm.catch(err, stack, env)
+			}
+			sp = sp + argc - 1
+			stack[sp] = val
+			return ops, savedPc, sp, env, err
+		}
 		if fun == Apply {
 			if argc < 2 {
 				err := NewError(ArgumentErrorKey, "apply expected at least 2 arguments, got ", argc)
@@ -593,7 +750,7 @@ opcodeCallAgain:
 				return vm.catch(err, stack, env)
 			}
 			callable = stack[sp]
-			stack[sp] = NewContinuation(env, ops, savedPc, stack[sp+1:])
+			stack[sp] = NewContinuation(env, ops, savedPc, stack[sp+1:], vm.winders)
 			goto opcodeCallAgain
 		}
 		if fun.continuation != nil {
@@ -602,6 +759,10 @@ opcodeCallAgain:
 				return vm.catch(err, stack, env)
 			}
 			arg := stack[sp]
+			err := vm.rewind(fun.continuation.winders)
+			if err != nil {
+				return vm.catch(err, stack, env)
+			}
 			sp = len(stack) - len(fun.continuation.stack)
 			segment := stack[sp:]
 			copy(segment, fun.continuation.stack)
@@ -610,12 +771,12 @@ opcodeCallAgain:
 			return fun.continuation.ops, fun.continuation.pc, sp, fun.frame, nil
 		}
 		if fun == Spawn {
-			err := vm.spawn(stack[sp], argc-1, stack, sp+1)
+			task, err := vm.spawn(stack[sp], argc-1, stack, sp+1)
 			if err != nil {
 				return vm.catch(err, stack, env)
 			}
 			sp = sp + argc - 1
-			stack[sp] = Null
+			stack[sp] = task
 			return ops, savedPc, sp, env, err
 		}
 		panic("unsupported instruction")
@@ -640,7 +801,13 @@ func (vm *vm) tailcall(callable Value, argc int, stack []Value, sp int, env *Fra
 opcodeTailCallAgain:
 	if fun, ok := callable.(*Function); ok {
 		if fun.code != nil {
-			if fun.code.defaults == nil && fun.code == env.code { //self-tail-call - we can reuse the frame.
+			if virtual != nil {
+				virtual.tick()
+			}
+			if vm.task != nil && vm.task.cancelRequested() {
+				return nil, 0, 0, nil, addContext(env, NewError(CancelledKey, "task ", vm.task.id, " was cancelled")) //not catchable
+			}
+			if fun.code.defaults == nil && fun.code.argtypes == nil && fun.code == env.code { //self-tail-call - we can reuse the frame.
 				expectedArgc := fun.code.argc
 				if argc != expectedArgc {
 					return nil, 0, 0, nil, NewError(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
@@ -649,10 +816,16 @@ opcodeTailCallAgain:
 				copy(env.elements, stack[sp:endSp])
 				return fun.code.ops, 0, endSp, env, nil
 			}
+			if vm.budget != nil {
+				if err := vm.allocate(frameCost(argc)); err != nil {
+					return nil, 0, 0, nil, addContext(env, err) //not catchable
+				}
+			}
 			f, err := buildFrame(env.previous, env.pc, env.ops, fun, argc, stack, sp)
 			if err != nil {
 				return vm.catch(err, stack, env)
 			}
+			f.results = tailResults(env.results, fun.code)
 			sp += argc
 			return fun.code.ops, 0, sp, f, nil
 		}
@@ -663,7 +836,16 @@ opcodeTailCallAgain:
 			}
 			sp = sp + argc - 1
 			stack[sp] = val
-			return env.ops, env.pc, sp, env.previous, nil
+			return vm.tailReturn(stack, sp, env)
+		}
+		if fun.intrinsic != nil {
+			val, err := fun.intrinsic.fun(vm, stack[sp:sp+argc])
+			if err != nil {
+				return vm.catch(err, stack, env)
+			}
+			sp = sp + argc - 1
+			stack[sp] = val
+			return vm.tailReturn(stack, sp, env)
 		}
 		if fun == Apply {
 			if argc < 2 {
@@ -697,6 +879,10 @@ opcodeTailCallAgain:
 				return vm.catch(err, stack, env)
 			}
 			arg := stack[sp]
+			err := vm.rewind(fun.continuation.winders)
+			if err != nil {
+				return vm.catch(err, stack, env)
+			}
 			sp = len(stack) - len(fun.continuation.stack)
 			segment := stack[sp:]
 			copy(segment, fun.continuation.stack)
@@ -710,17 +896,17 @@ opcodeTailCallAgain:
 				return vm.catch(err, stack, env)
 			}
 			callable = stack[sp]
-			stack[sp] = NewContinuation(env.previous, env.ops, env.pc, stack[sp:])
+			stack[sp] = NewContinuation(env.previous, env.ops, env.pc, stack[sp:], vm.winders)
 			goto opcodeTailCallAgain
 		}
 		if fun == Spawn {
-			err := vm.spawn(stack[sp], argc-1, stack, sp+1)
+			task, err := vm.spawn(stack[sp], argc-1, stack, sp+1)
 			if err != nil {
 				return vm.catch(err, stack, env)
 			}
 			sp = sp + argc - 1
-			stack[sp] = Null
-			return env.ops, env.pc, sp, env.previous, nil
+			stack[sp] = task
+			return vm.tailReturn(stack, sp, env)
 		}
 		panic("Bad function")
 	}
@@ -734,7 +920,7 @@ opcodeTailCallAgain:
 			return vm.catch(err, stack, env)
 		}
 		stack[sp] = v
-		return env.ops, env.pc, sp, env.previous, nil
+		return vm.tailReturn(stack, sp, env)
 	}
 	err := NewError(ArgumentErrorKey, "Not callable:", callable)
 	return vm.catch(err, stack, env)
@@ -750,6 +936,16 @@ func (vm *vm) keywordTailcall(fun *Keyword, argc int, stack []Value, sp int, env
 		return vm.catch(err, stack, env)
 	}
 	stack[sp] = v
+	return vm.tailReturn(stack, sp, env)
+}
+
+// tailReturn - return the value on top of the stack from the frame, as the result of a call in tail position
+func (vm *vm) tailReturn(stack []Value, sp int, env *Frame) ([]int, int, int, *Frame, error) {
+	if env.results != nil {
+		if err := env.checkResult(stack[sp]); err != nil {
+			return vm.catch(err, stack, env)
+		}
+	}
 	return env.ops, env.pc, sp, env.previous, nil
 }
 
@@ -757,17 +953,20 @@ func execCompileTime(code *Code, arg Value) (Value, error) {
 	args := []Value{arg}
 	prev := verbose
 	verbose = false
-	res, err := exec(code, args)
+	res, err := exec(code, args, nil)
 	verbose = prev
 	return res, err
 }
 
 func (vm *vm) catch(err error, stack []Value, env *Frame) ([]int, int, int, *Frame, error) {
+	if vm.budget != nil && vm.budget.exhausted() || vm.task != nil && vm.task.cancelHandled() {
+		return nil, 0, 0, nil, addContext(env, err) //not catchable
+	}
 	errobj, ok := err.(Value)
 	if !ok {
 		errobj = MakeError(ErrorKey, NewString(err.Error()))
 	}
-	ghandler := GetGlobal(Intern("*top-handler*"))
+	ghandler := vm.globalValue(topHandlerSymbol)
 	if ghandler != nil {
 		if handler, ok := ghandler.(*Function); ok {
 			if handler.code != nil {
@@ -782,37 +981,66 @@ func (vm *vm) catch(err error, stack []Value, env *Frame) ([]int, int, int, *Fra
 	return nil, 0, 0, nil, addContext(env, err)
 }
 
-func (vm *vm) spawn(callable Value, argc int, stack []Value, sp int) error {
+func (vm *vm) spawn(callable Value, argc int, stack []Value, sp int) (Value, error) {
+	task, err := vm.startTask(callable, argc, stack, sp, nil)
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// startTask - run the function with the arguments on the stack in a new task. If the task is for an actor, it is
+// attached before the task starts.
+func (vm *vm) startTask(callable Value, argc int, stack []Value, sp int, actor *Actor) (*Task, error) {
 	if fun, ok := callable.(*Function); ok {
 		if fun.code != nil {
 			env, err := buildFrame(nil, 0, nil, fun, argc, stack, sp)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			go func(code *Code, env *Frame) {
-				vm := VM(defaultStackSize)
-				_, err := vm.exec(code, env)
-				if err != nil {
-					println("; [*** error in spawned function '", code.name, "': ", err, "]")
-				} else if verbose {
-					println("; [spawned function '", code.name, "' exited cleanly]")
-				}
-			}(fun.code, env)
-			return nil
+			task := newTask(taskName(fun))
+			task.actor = actor
+			task.budget = vm.budget
+			task.caps = vm.caps
+			if actor != nil {
+				actor.task = task
+			}
+			task.start(fun, env, nil, vm.parameterSnapshot())
+			return task, nil
+		}
+		if fun.primitive != nil || fun.intrinsic != nil {
+			args := make([]Value, argc)
+			copy(args, stack[sp:sp+argc])
+			task := newTask(taskName(fun))
+			task.actor = actor
+			task.budget = vm.budget
+			task.caps = vm.caps
+			if actor != nil {
+				actor.task = task
+			}
+			task.start(fun, nil, args, vm.parameterSnapshot())
+			return task, nil
 		}
 		// spawning callcc, apply, and spawn instructions not supported.
-		//? spawning primitives not supported. Is that important?
 	}
-	return NewError(ArgumentErrorKey, "Bad function for spawn: ", callable)
+	return nil, NewError(ArgumentErrorKey, "Bad function for spawn: ", callable)
 }
 
-func exec(code *Code, args []Value) (Value, error) {
+// exec - run the code in a new VM, with the capabilities, or, if they are nil, those of a new evaluation
+func exec(code *Code, args []Value, caps *Capabilities) (Value, error) {
 	vm := VM(defaultStackSize)
+	if caps != nil {
+		vm.caps = caps
+	}
 	if len(args) != code.argc {
 		return nil, NewError(ArgumentErrorKey, "Wrong number of arguments")
 	}
 	env := new(Frame)
-	env.elements = make([]Value, len(args))
+	size := len(args)
+	if code.frameSize > size {
+		size = code.frameSize
+	}
+	env.elements = make([]Value, size)
 	copy(env.elements, args)
 	env.code = code
 	startTime := time.Now()
@@ -833,10 +1061,65 @@ func exec(code *Code, args []Value) (Value, error) {
 	return result, err
 }
 
+// call - run the function to completion in a nested execution that shares this VM's dynamic state.
+func (vm *vm) call(fn Value, args []Value) (Value, error) {
+	if fun, ok := fn.(*Function); ok {
+		if fun.code != nil {
+			env, err := buildFrame(nil, 0, nil, fun, len(args), args, 0)
+			if err != nil {
+				return nil, err
+			}
+			return vm.exec(fun.code, env)
+		}
+		if fun.primitive != nil {
+			return vm.callPrimitive(fun.primitive, args)
+		}
+		if fun.intrinsic != nil {
+			return fun.intrinsic.fun(vm, args)
+		}
+	}
+	if fn.Type() == FunctionType || fn.Type() == KeywordType {
+		//continuations, apply, callcc, spawn, and keywords: let funcall sort them out
+		thunk := callThunk(len(args))
+		env := new(Frame)
+		env.elements = make([]Value, len(args)+1)
+		env.elements[0] = fn
+		copy(env.elements[1:], args)
+		env.code = thunk
+		return vm.exec(thunk, env)
+	}
+	return nil, NewError(ArgumentErrorKey, "Not callable: ", fn)
+}
+
+// callThunk - code that calls its first argument with the rest of its arguments, i.e. (fn (f a b) (f a b))
+func callThunk(argc int) *Code {
+	code := MakeCode(argc+1, nil, nil, "")
+	for i := argc; i > 0; i-- {
+		code.emitLocal(0, i)
+	}
+	code.emitLocal(0, 0)
+	code.emitCall(argc)
+	code.emitReturn()
+	return code
+}
+
 func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
+	winders := vm.winders
+	var result Value
+	var err error
 	if !optimize || verbose || trace {
-		return vm.instrumentedExec(code, env)
+		result, err = vm.instrumentedExec(code, env)
+	} else {
+		result, err = vm.optimizedExec(code, env)
+	}
+	if err != nil && vm.winders != winders {
+		//the error escapes this execution, so leave any dynamic extents entered during it
+		vm.unwind(winders)
 	}
+	return result, err
+}
+
+func (vm *vm) optimizedExec(code *Code, env *Frame) (Value, error) {
 	stack := make([]Value, vm.stackSize)
 	sp := vm.stackSize
 	ops := code.ops
@@ -845,7 +1128,120 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 	var err error
 	for {
 		op := ops[pc]
-		if op == opcodeCall {
+		if op == opcodeCallGlobal {
+			sym := constants[ops[pc+1]].(*Symbol)
+			argc := ops[pc+2]
+			if fun, ok := sym.Value.(*Function); ok {
+				if fun.primitive != nil {
+					nextSp := sp + argc - 1
+					prim := fun.primitive
+					argv := stack[sp : nextSp+1]
+					if prim.defaults != nil {
+						val, err = vm.callPrimitiveWithDefaults(prim, argv)
+					} else {
+						val, err = vm.invokePrimitive(prim, argv)
+					}
+					if err != nil {
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
+						if err != nil {
+							return nil, err
+						}
+					} else {
+						stack[nextSp] = val
+						sp = nextSp
+						pc += 3
+					}
+				} else {
+					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, pc+3, stack, sp, env)
+					if err != nil {
+						return nil, err
+					}
+				}
+			} else if kw, ok := sym.Value.(*Keyword); ok {
+				pc, sp, err = vm.keywordCall(kw, argc, pc+3, stack, sp)
+				if err != nil {
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+				}
+			} else {
+				ops, pc, sp, env, err = vm.catch(notCallableGlobal(sym), stack, env)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else if op == opcodeTailCallGlobal {
+			sym := constants[ops[pc+1]].(*Symbol)
+			argc := ops[pc+2]
+			if fun, ok := sym.Value.(*Function); ok {
+				if fun.primitive != nil {
+					nextSp := sp + argc - 1
+					prim := fun.primitive
+					argv := stack[sp : nextSp+1]
+					if prim.defaults != nil {
+						val, err = vm.callPrimitiveWithDefaults(prim, argv)
+					} else {
+						val, err = vm.invokePrimitive(prim, argv)
+					}
+					if err == nil && env.results != nil {
+						err = env.checkResult(val)
+					}
+					if err != nil {
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
+						if err != nil {
+							return nil, err
+						}
+					} else {
+						stack[nextSp] = val
+						sp = nextSp
+						ops = env.ops
+						pc = env.pc
+						env = env.previous
+						if env == nil {
+							return stack[sp], nil
+						}
+					}
+				} else {
+					ops, pc, sp, env, err = vm.tailcall(fun, argc, stack, sp, env)
+					if err != nil {
+						return nil, err
+					}
+					if env == nil {
+						return stack[sp], nil
+					}
+				}
+			} else if kw, ok := sym.Value.(*Keyword); ok {
+				ops, pc, sp, env, err = vm.keywordTailcall(kw, argc, stack, sp, env)
+				if err != nil {
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					if env == nil {
+						return stack[sp], nil
+					}
+				}
+			} else {
+				ops, pc, sp, env, err = vm.catch(notCallableGlobal(sym), stack, env)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else if op == opcodeLocalJumpFalse {
+			tmpEnv := env
+			i := ops[pc+1]
+			for i > 0 {
+				tmpEnv = tmpEnv.locals
+				i--
+			}
+			if tmpEnv.elements[ops[pc+2]] == False {
+				pc += ops[pc+3]
+			} else {
+				pc += 4
+			}
+		} else if op == opcodeCall {
 			argc := ops[pc+1]
 			callable := stack[sp]
 			if fun, ok := callable.(*Function); ok {
@@ -856,17 +1252,18 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 					if prim.defaults != nil {
 						val, err = vm.callPrimitiveWithDefaults(prim, argv)
 					} else {
-						val, err = prim.fun(argv)
+						val, err = vm.invokePrimitive(prim, argv)
 					}
 					if err != nil {
-						ops, pc, _, env, err = vm.catch(err, stack, env)
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
 						if err != nil {
 							return nil, err
 						}
+					} else {
+						stack[nextSp] = val
+						sp = nextSp
+						pc += 2
 					}
-					stack[nextSp] = val
-					sp = nextSp
-					pc += 2
 				} else {
 					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, pc+2, stack, sp+1, env)
 					if err != nil {
@@ -926,21 +1323,25 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 					if prim.defaults != nil {
 						val, err = vm.callPrimitiveWithDefaults(prim, argv)
 					} else {
-						val, err = prim.fun(argv)
+						val, err = vm.invokePrimitive(prim, argv)
+					}
+					if err == nil && env.results != nil {
+						err = env.checkResult(val)
 					}
 					if err != nil {
-						_, _, _, env, err = vm.catch(err, stack, env)
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
 						if err != nil {
 							return nil, err
 						}
-					}
-					stack[nextSp] = val
-					sp = nextSp
-					ops = env.ops
-					pc = env.pc
-					env = env.previous
-					if env == nil {
-						return stack[sp], nil
+					} else {
+						stack[nextSp] = val
+						sp = nextSp
+						ops = env.ops
+						pc = env.pc
+						env = env.previous
+						if env == nil {
+							return stack[sp], nil
+						}
 					}
 				} else {
 					ops, pc, sp, env, err = vm.tailcall(fun, argc, stack, sp+1, env)
@@ -984,10 +1385,24 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			tmpEnv.elements[j] = stack[sp]
 			pc += 3
 		} else if op == opcodeClosure {
+			if vm.budget != nil {
+				if err := vm.allocate(closureSize); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+			}
 			sp--
 			stack[sp] = Closure(constants[ops[pc+1]].(*Code), env)
 			pc = pc + 2
 		} else if op == opcodeReturn {
+			if env.results != nil {
+				if err := env.checkResult(stack[sp]); err != nil {
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
 			if env.previous == nil {
 				return stack[sp], nil
 			}
@@ -995,6 +1410,11 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			pc = env.pc
 			env = env.previous
 		} else if op == opcodeJump {
+			if ops[pc+1] < 0 {
+				if err = vm.loopback(env); err != nil {
+					return nil, err
+				}
+			}
 			pc += ops[pc+1]
 		} else if op == opcodeDefGlobal {
 			sym := constants[ops[pc+1]].(*Symbol)
@@ -1011,7 +1431,7 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			pc += 2
 		} else if op == opcodeUse {
 			sym := constants[ops[pc+1]].(*Symbol)
-			err := Use(sym)
+			err := loadModule(sym.Text, vm.caps)
 			if err != nil {
 				ops, pc, sp, env, err = vm.catch(err, stack, env)
 				if err != nil {
@@ -1024,12 +1444,22 @@ func (vm *vm) exec(code *Code, env *Frame) (Value, error) {
 			}
 		} else if op == opcodeVector {
 			vlen := ops[pc+1]
+			if vm.budget != nil {
+				if err := vm.allocate(vectorCost(vlen)); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+			}
 			v := NewVector(stack[sp : sp+vlen]...)
 			sp = sp + vlen - 1
 			stack[sp] = v
 			pc += 2
 		} else if op == opcodeStruct {
 			vlen := ops[pc+1]
+			if vm.budget != nil {
+				if err := vm.allocate(structCost(vlen / 2)); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+			}
 			v, _ := MakeStruct(stack[sp : sp+vlen])
 			sp = sp + vlen - 1
 			stack[sp] = v
@@ -1120,7 +1550,120 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 	var err, err2 error
 	for {
 		op := ops[pc]
-		if op == opcodeCall { // CALL
+		if op == opcodeCallGlobal {
+			sym := constants[ops[pc+1]].(*Symbol)
+			argc := ops[pc+2]
+			if trace {
+				showInstruction(pc, op, fmt.Sprintf("%s, %d", sym.Text, argc), stack, sp)
+			}
+			if fun, ok := sym.Value.(*Function); ok {
+				if fun.primitive != nil {
+					nextSp := sp + argc - 1
+					val, err := vm.callPrimitive(fun.primitive, stack[sp:nextSp+1])
+					if err != nil {
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
+						if err != nil {
+							return nil, err
+						}
+					} else {
+						stack[nextSp] = val
+						sp = nextSp
+						pc += 3
+					}
+				} else {
+					ops, pc, sp, env, err = vm.funcall(fun, argc, ops, pc+3, stack, sp, env)
+					if err != nil {
+						return nil, err
+					}
+				}
+			} else if kw, ok := sym.Value.(*Keyword); ok {
+				pc, sp, err = vm.keywordCall(kw, argc, pc+3, stack, sp)
+				if err != nil {
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+				}
+			} else {
+				ops, pc, sp, env, err2 = vm.catch(notCallableGlobal(sym), stack, env)
+				if err2 != nil {
+					return nil, err2
+				}
+			}
+		} else if op == opcodeTailCallGlobal {
+			if interrupted || checkInterrupt() {
+				return nil, addContext(env, NewError(InterruptKey)) //not catchable
+			}
+			sym := constants[ops[pc+1]].(*Symbol)
+			argc := ops[pc+2]
+			if trace {
+				showInstruction(pc, op, fmt.Sprintf("%s, %d", sym.Text, argc), stack, sp)
+			}
+			if fun, ok := sym.Value.(*Function); ok {
+				if fun.primitive != nil {
+					nextSp := sp + argc - 1
+					val, err := vm.callPrimitive(fun.primitive, stack[sp:nextSp+1])
+					if err == nil && env.results != nil {
+						err = env.checkResult(val)
+					}
+					if err != nil {
+						ops, pc, sp, env, err = vm.catch(err, stack, env)
+						if err != nil {
+							return nil, err
+						}
+					} else {
+						stack[nextSp] = val
+						sp = nextSp
+						ops = env.ops
+						pc = env.pc
+						env = env.previous
+						if env == nil {
+							return stack[sp], nil
+						}
+					}
+				} else {
+					ops, pc, sp, env, err = vm.tailcall(fun, argc, stack, sp, env)
+					if err != nil {
+						return nil, err
+					}
+					if env == nil {
+						return stack[sp], nil
+					}
+				}
+			} else if kw, ok := sym.Value.(*Keyword); ok {
+				ops, pc, sp, env, err = vm.keywordTailcall(kw, argc, stack, sp, env)
+				if err != nil {
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					if env == nil {
+						return stack[sp], nil
+					}
+				}
+			} else {
+				ops, pc, sp, env, err = vm.catch(notCallableGlobal(sym), stack, env)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else if op == opcodeLocalJumpFalse {
+			if trace {
+				showInstruction(pc, op, fmt.Sprintf("%d, %d, %d", ops[pc+1], ops[pc+2], pc+ops[pc+3]), stack, sp)
+			}
+			tmpEnv := env
+			i := ops[pc+1]
+			for i > 0 {
+				tmpEnv = tmpEnv.locals
+				i--
+			}
+			if tmpEnv.elements[ops[pc+2]] == False {
+				pc += ops[pc+3]
+			} else {
+				pc += 4
+			}
+		} else if op == opcodeCall { // CALL
 			if trace {
 				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
 			}
@@ -1222,6 +1765,9 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 				if fun.primitive != nil {
 					nextSp := sp + argc
 					val, err := vm.callPrimitive(fun.primitive, stack[sp+1:nextSp+1])
+					if err == nil && env.results != nil {
+						err = env.checkResult(val)
+					}
 					if err != nil {
 						ops, pc, sp, env, err = vm.catch(err, stack, env)
 						if err != nil {
@@ -1249,13 +1795,20 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			} else if kw, ok := callable.(*Keyword); ok {
 				ops, pc, sp, env, err = vm.keywordTailcall(kw, argc, stack, sp+1, env)
 				if err != nil {
-					return nil, err
-				}
-				if env.previous == nil {
-					return stack[sp], nil
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					if env == nil {
+						return stack[sp], nil
+					}
 				}
 			} else {
-				return nil, addContext(env, NewError(ArgumentErrorKey, "Not callable: ", fun))
+				ops, pc, sp, env, err = vm.catch(NewError(ArgumentErrorKey, "Not callable: ", fun), stack, env)
+				if err != nil {
+					return nil, err
+				}
 			}
 		} else if op == opcodeLiteral {
 			if trace {
@@ -1281,6 +1834,11 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			if trace {
 				showInstruction(pc, op, "", stack, sp)
 			}
+			if vm.budget != nil {
+				if err := vm.allocate(closureSize); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+			}
 			sp--
 			stack[sp] = Closure((constants[ops[pc+1]].(*Code)), env)
 			pc = pc + 2
@@ -1291,6 +1849,15 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			if trace {
 				showInstruction(pc, op, "", stack, sp)
 			}
+			if env.results != nil {
+				if err := env.checkResult(stack[sp]); err != nil {
+					ops, pc, sp, env, err = vm.catch(err, stack, env)
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
 			if env.previous == nil {
 				return stack[sp], nil
 			}
@@ -1301,6 +1868,14 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			if trace {
 				showInstruction(pc, op, fmt.Sprintf("%d", pc+ops[pc+1]), stack, sp)
 			}
+			if ops[pc+1] < 0 {
+				if interrupted || checkInterrupt() {
+					return nil, addContext(env, NewError(InterruptKey)) //not catchable
+				}
+				if err = vm.loopback(env); err != nil {
+					return nil, err
+				}
+			}
 			pc += ops[pc+1]
 		} else if op == opcodeDefGlobal {
 			sym := constants[ops[pc+1]].(*Symbol)
@@ -1330,7 +1905,7 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 			if trace {
 				showInstruction(pc, op, sym.Text, stack, sp)
 			}
-			err := Use(sym)
+			err := loadModule(sym.Text, vm.caps)
 			if err != nil {
 				ops, pc, sp, env, err = vm.catch(err, stack, env)
 				if err != nil {
@@ -1345,6 +1920,11 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
 			}
 			vlen := ops[pc+1]
+			if vm.budget != nil {
+				if err := vm.allocate(vectorCost(vlen)); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+			}
 			v := NewVector(stack[sp : sp+vlen]...)
 			sp = sp + vlen - 1
 			stack[sp] = v
@@ -1354,6 +1934,11 @@ func (vm *vm) instrumentedExec(code *Code, env *Frame) (Value, error) {
 				showInstruction(pc, op, fmt.Sprintf("%d", ops[pc+1]), stack, sp)
 			}
 			vlen := ops[pc+1]
+			if vm.budget != nil {
+				if err := vm.allocate(structCost(vlen / 2)); err != nil {
+					return nil, addContext(env, err) //not catchable
+				}
+			}
 			v, _ := MakeStruct(stack[sp : sp+vlen])
 			sp = sp + vlen - 1
 			stack[sp] = v
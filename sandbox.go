@@ -0,0 +1,198 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/boynton/ell/data"
+)
+
+var PermissionErrorKey = Intern("permission-error:")
+
+// the levels of filesystem access
+const (
+	FilesystemFull = iota
+	FilesystemReadOnly
+	FilesystemNone
+)
+
+// Capabilities - what Ell code may do outside of its own process. Each evaluation has the capabilities that were
+// set when it started, and the tasks it spawns and the modules it uses have them, too. Since all Ell code shares
+// its global environment, to run untrusted code restrict them after loading the trusted code. The modules built
+// into ell (i.e. ell and actor) can always be used. The capabilities only restrict the Ell primitives: Go code
+// calling the package's functions, such as SlurpFile or SaveImage, is not restricted.
+type Capabilities struct {
+	Filesystem  int    // FilesystemFull, FilesystemReadOnly, or FilesystemNone
+	Root        string // if not empty, files are only accessible within this directory, which is treated as "/"
+	Network     bool
+	Environment bool // getenv
+}
+
+// AllCapabilities - the default, unrestricted capabilities
+var AllCapabilities = Capabilities{Filesystem: FilesystemFull, Network: true, Environment: true}
+
+var defaultCapabilities atomic.Pointer[Capabilities]
+
+// SetCapabilities - restrict (or restore) what Ell code may do in the evaluations started after it. A restricted
+// operation fails with a permission-error.
+func SetCapabilities(caps Capabilities) error {
+	if caps.Root != "" {
+		root, err := filepath.Abs(ExpandFilePath(caps.Root))
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return NewError(IOErrorKey, "Not a directory: ", caps.Root)
+		}
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		caps.Root = root
+	}
+	defaultCapabilities.Store(&caps)
+	return nil
+}
+
+// CurrentCapabilities - the capabilities that new evaluations have
+func CurrentCapabilities() Capabilities {
+	return *currentCapabilities()
+}
+
+func currentCapabilities() *Capabilities {
+	if caps := defaultCapabilities.Load(); caps != nil {
+		return caps
+	}
+	return &AllCapabilities
+}
+
+func permissionError(args ...interface{}) error {
+	return NewError(PermissionErrorKey, args...)
+}
+
+// path - map the path into the root directory, if there is one, and check that the filesystem may be accessed as
+// requested.
+func (caps *Capabilities) path(path string, write bool) (string, error) {
+	if strings.HasPrefix(path, "@/") {
+		if write {
+			return "", permissionError("cannot write to built in module ", path)
+		}
+		return path, nil
+	}
+	switch {
+	case caps.Filesystem == FilesystemNone:
+		return "", permissionError("no filesystem access: ", path)
+	case write && caps.Filesystem == FilesystemReadOnly:
+		return "", permissionError("the filesystem is read-only: ", path)
+	}
+	root := caps.Root
+	if root == "" {
+		return path, nil
+	}
+	mapped := filepath.Join(root, filepath.Clean("/"+path))
+	// a symbolic link must not lead out of the root
+	resolved, err := filepath.EvalSymlinks(mapped)
+	if err != nil {
+		resolved, err = filepath.EvalSymlinks(filepath.Dir(mapped))
+		if err != nil {
+			return mapped, nil //it doesn't exist, and neither does its directory
+		}
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return "", permissionError("outside of the root directory: ", path)
+	}
+	return mapped, nil
+}
+
+func (caps *Capabilities) checkNetwork(name string) error {
+	if !caps.Network {
+		return permissionError(name, ": no network access")
+	}
+	return nil
+}
+
+func (caps *Capabilities) checkEnvironment(name string) error {
+	if !caps.Environment {
+		return permissionError(name, ": no environment access")
+	}
+	return nil
+}
+
+// restrictedPrimitives - the primitives that check the capabilities of the VM calling them, with the arguments
+// already checked
+var restrictedPrimitives = map[string]intrinsicFunction{
+	"slurp":        ellSlurp,
+	"spit":         ellSpit,
+	"load":         ellLoad,
+	"save-image":   ellSaveImage,
+	"load-image":   ellLoadImage,
+	"getenv":       ellGetenv,
+	"listen":       ellListen,
+	"connect":      ellConnect,
+	"serve":        ellHTTPServer,
+	"http":         ellHTTPClient,
+	"capabilities": ellCapabilities,
+}
+
+// setRestrictedPrimitives - attach the restricted functions to their primitives. Called without a VM, one runs
+// in a new one, with the capabilities of a new evaluation.
+func setRestrictedPrimitives() {
+	for _, prim := range primitives {
+		if fun, ok := restrictedPrimitives[prim.name]; ok {
+			prim.vmfun = fun
+			prim.fun = func(argv []Value) (Value, error) {
+				return fun(VM(defaultStackSize), argv)
+			}
+		}
+	}
+}
+
+var filesystemKey = Intern("filesystem:")
+var rootKey = Intern("root:")
+var networkKey = Intern("network:")
+var environmentKey = Intern("environment:")
+
+func ellCapabilities(vm *vm, argv []Value) (Value, error) {
+	caps := vm.caps
+	var fs Value
+	switch caps.Filesystem {
+	case FilesystemReadOnly:
+		fs = Intern("read-only:")
+	case FilesystemNone:
+		fs = Intern("none:")
+	default:
+		fs = Intern("full:")
+	}
+	s := NewStruct().Put(filesystemKey, fs)
+	if caps.Root != "" {
+		s.Put(rootKey, NewString(caps.Root))
+	}
+	if caps.Network {
+		s.Put(networkKey, True)
+	} else {
+		s.Put(networkKey, False)
+	}
+	if caps.Environment {
+		s.Put(environmentKey, True)
+	} else {
+		s.Put(environmentKey, False)
+	}
+	return s, nil
+}
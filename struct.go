@@ -24,7 +24,7 @@ import (
 
 // StructLength - return the length (field count) of the <struct> object
 func StructLength(strct *Struct) int {
-	return len(strct.Bindings)
+	return strct.Length()
 }
 
 // Get - return the value for the key of the object. The Value() function is first called to
@@ -124,12 +124,14 @@ func validateKeywordArgBindings(args *List, keys []Value) ([]Value, error) {
 			}
 			bindings = slicePut(bindings, key, Car(args))
 		case *Struct:
+			p.RLock()
 			for k, v := range p.Bindings {
 				sym := Intern(k.Value)
 				if sliceContains(keys, sym) {
 					bindings = slicePut(bindings, sym, v)
 				}
 			}
+			p.RUnlock()
 		default:
 			return nil, NewError(ArgumentErrorKey, "Not a keyword: ", key)
 		}
@@ -140,9 +142,12 @@ func validateKeywordArgBindings(args *List, keys []Value) ([]Value, error) {
 
 // Equal returns true if the object is equal to the argument
 func StructEqual(s1 *Struct, s2 *Struct) bool {
-	bindings1 := s1.Bindings
+	if s1 == s2 {
+		return true
+	}
+	bindings1 := s1.Snapshot()
 	size := len(bindings1)
-	bindings2 := s2.Bindings
+	bindings2 := s2.Snapshot()
 	if size == len(bindings2) {
 		for k, v := range bindings1 {
 			v2, ok := bindings2[k]
@@ -162,7 +167,7 @@ func structToString(s *Struct) string {
 	var buf bytes.Buffer
 	buf.WriteString("{")
 	first := true
-	for k, v := range s.Bindings {
+	for k, v := range s.Snapshot() {
 		if first {
 			first = false
 		} else {
@@ -177,6 +182,8 @@ func structToString(s *Struct) string {
 }
 
 func StructToList(s *Struct) (*List, error) {
+	s.RLock()
+	defer s.RUnlock()
 	result := EmptyList
 	tail := EmptyList
 	for k, v := range s.Bindings {
@@ -193,6 +200,8 @@ func StructToList(s *Struct) (*List, error) {
 }
 
 func StructToVector(s *Struct) *Vector {
+	s.RLock()
+	defer s.RUnlock()
 	size := len(s.Bindings)
 	el := make([]Value, size)
 	j := 0
@@ -218,6 +227,8 @@ func StructValues(s Value) Value {
 }
 
 func structKeyList(s *Struct) *List {
+	s.RLock()
+	defer s.RUnlock()
 	result := EmptyList
 	tail := EmptyList
 	for k := range s.Bindings {
@@ -234,6 +245,8 @@ func structKeyList(s *Struct) *List {
 }
 
 func structValueList(s *Struct) *List {
+	s.RLock()
+	defer s.RUnlock()
 	result := EmptyList
 	tail := EmptyList
 	for _, v := range s.Bindings {
@@ -0,0 +1,320 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/boynton/ell/data"
+)
+
+// the types for sharing state between tasks
+
+var AtomType Value = Intern("<atom>")
+var MutexType Value = Intern("<mutex>")
+var WaitGroupType Value = Intern("<wait-group>")
+
+// Atom - a reference to a value, which can be updated atomically
+type Atom struct {
+	mutex sync.Mutex
+	value Value
+}
+
+func NewAtom(value Value) *Atom {
+	return &Atom{value: value}
+}
+
+func (a *Atom) Type() Value {
+	return AtomType
+}
+
+func (a *Atom) String() string {
+	return "#[atom " + a.Deref().String() + "]"
+}
+
+func (a1 *Atom) Equals(another Value) bool {
+	if a2, ok := another.(*Atom); ok {
+		return a1 == a2
+	}
+	return false
+}
+
+func (a *Atom) Deref() Value {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.value
+}
+
+func (a *Atom) Reset(value Value) {
+	a.mutex.Lock()
+	a.value = value
+	a.mutex.Unlock()
+}
+
+// CompareAndSet - set the value only if the current value is identical to the old one
+func (a *Atom) CompareAndSet(old Value, value Value) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.value != old {
+		return false
+	}
+	a.value = value
+	return true
+}
+
+// Mutex - a mutual exclusion lock
+type Mutex struct {
+	mutex  sync.Mutex
+	state  sync.Mutex // guards locked
+	locked bool       // true while the mutex is held. The deterministic scheduler uses it instead of the mutex
+}
+
+func (m *Mutex) Type() Value {
+	return MutexType
+}
+
+func (m *Mutex) String() string {
+	return fmt.Sprintf("#[mutex %p]", m)
+}
+
+func (m1 *Mutex) Equals(another Value) bool {
+	if m2, ok := another.(*Mutex); ok {
+		return m1 == m2
+	}
+	return false
+}
+
+// WaitGroup - waits for a number of tasks to finish
+type WaitGroup struct {
+	group sync.WaitGroup
+	state sync.Mutex // guards count
+	count int        // the count of the group. The deterministic scheduler uses it instead of the group
+}
+
+func (wg *WaitGroup) Type() Value {
+	return WaitGroupType
+}
+
+func (wg *WaitGroup) String() string {
+	return fmt.Sprintf("#[wait-group %p]", wg)
+}
+
+func (wg1 *WaitGroup) Equals(another Value) bool {
+	if wg2, ok := another.(*WaitGroup); ok {
+		return wg1 == wg2
+	}
+	return false
+}
+
+// Add - add to the count, unless that would make it negative
+func (wg *WaitGroup) Add(delta int) error {
+	wg.state.Lock()
+	defer wg.state.Unlock()
+	if wg.count+delta < 0 {
+		return NewError(ErrorKey, "wait group count cannot be negative: ", wg.count+delta)
+	}
+	wg.count += delta
+	if virtual == nil {
+		wg.group.Add(delta)
+	}
+	return nil
+}
+
+// Wait - wait for the count to reach zero, returning false if the timeout (in seconds) expires first.
+// A negative timeout waits forever.
+func (wg *WaitGroup) Wait(timeout float64) bool {
+	if virtual != nil {
+		return virtual.block(func() bool { return wg.count <= 0 }, timeout)
+	}
+	if timeout < 0 {
+		wg.group.Wait()
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Duration(timeout * float64(time.Second))):
+		return false
+	}
+}
+
+func ellAtom(argv []Value) (Value, error) {
+	return NewAtom(argv[0]), nil
+}
+
+func ellAtomP(argv []Value) (Value, error) {
+	if argv[0].Type() == AtomType {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellDeref(argv []Value) (Value, error) {
+	return argv[0].(*Atom).Deref(), nil
+}
+
+func ellResetBang(argv []Value) (Value, error) {
+	argv[0].(*Atom).Reset(argv[1])
+	return argv[1], nil
+}
+
+func ellCompareAndSetBang(argv []Value) (Value, error) {
+	if argv[0].(*Atom).CompareAndSet(argv[1], argv[2]) {
+		return True, nil
+	}
+	return False, nil
+}
+
+// swap! calls the function with the current value and any extra arguments, and sets the atom to the result.
+// If another task changed the atom in the meantime, the function is called again with the new value.
+func ellSwapBang(vm *vm, argv []Value) (Value, error) {
+	argc := len(argv)
+	if argc < 2 {
+		return nil, argcError("swap!", 2, -1, argc)
+	}
+	a, ok := argv[0].(*Atom)
+	if !ok {
+		return nil, NewError(ArgumentErrorKey, "swap! expected a <atom> for argument 1, got a ", TypeNameOf(argv[0]))
+	}
+	fun := argv[1]
+	if fun.Type() != FunctionType {
+		return nil, NewError(ArgumentErrorKey, "swap! expected a <function> for argument 2, got a ", TypeNameOf(fun))
+	}
+	args := make([]Value, argc-1)
+	copy(args[1:], argv[2:])
+	for {
+		old := a.Deref()
+		args[0] = old
+		val, err := vm.call(fun, args)
+		if err != nil {
+			return nil, err
+		}
+		if a.CompareAndSet(old, val) {
+			return val, nil
+		}
+	}
+}
+
+func ellMutex(argv []Value) (Value, error) {
+	return &Mutex{}, nil
+}
+
+func (m *Mutex) Lock() {
+	if virtual != nil {
+		virtual.block(func() bool { return !m.locked }, -1)
+		m.locked = true
+		return
+	}
+	m.mutex.Lock()
+	m.state.Lock()
+	m.locked = true
+	m.state.Unlock()
+}
+
+// Unlock - release the mutex, unless it is not locked
+func (m *Mutex) Unlock() error {
+	m.state.Lock()
+	defer m.state.Unlock()
+	if !m.locked {
+		return NewError(ErrorKey, "unlock of a mutex that is not locked")
+	}
+	m.locked = false
+	if virtual == nil {
+		m.mutex.Unlock()
+	}
+	return nil
+}
+
+func ellLock(argv []Value) (Value, error) {
+	argv[0].(*Mutex).Lock()
+	return Null, nil
+}
+
+func ellUnlock(argv []Value) (Value, error) {
+	if err := argv[0].(*Mutex).Unlock(); err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+func ellWaitGroup(argv []Value) (Value, error) {
+	return &WaitGroup{}, nil
+}
+
+func ellWaitGroupAdd(argv []Value) (Value, error) {
+	if err := argv[0].(*WaitGroup).Add(IntValue(argv[1])); err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+func ellWaitGroupDone(argv []Value) (Value, error) {
+	if err := argv[0].(*WaitGroup).Add(-1); err != nil {
+		return nil, err
+	}
+	return Null, nil
+}
+
+func ellWaitGroupWait(argv []Value) (Value, error) {
+	if argv[0].(*WaitGroup).Wait(Float64Value(argv[1])) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellSynchronizeBang(argv []Value) (Value, error) {
+	switch p := argv[0].(type) {
+	case *Struct:
+		p.Synchronize()
+	case *Vector:
+		p.Synchronize()
+	case *Instance:
+		if s, ok := p.Value.(*Struct); ok {
+			s.Synchronize()
+			break
+		}
+		return nil, NewError(ArgumentErrorKey, "synchronize! expected a <struct> or <vector>, got a ", TypeNameOf(p))
+	default:
+		return nil, NewError(ArgumentErrorKey, "synchronize! expected a <struct> or <vector>, got a ", TypeNameOf(p))
+	}
+	return argv[0], nil
+}
+
+func ellSynchronizedP(argv []Value) (Value, error) {
+	obj := argv[0]
+	if p, ok := obj.(*Instance); ok {
+		obj = p.Value
+	}
+	switch p := obj.(type) {
+	case *Struct:
+		if p.IsSynchronized() {
+			return True, nil
+		}
+	case *Vector:
+		if p.IsSynchronized() {
+			return True, nil
+		}
+	}
+	return False, nil
+}
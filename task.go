@@ -0,0 +1,307 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/boynton/ell/data"
+)
+
+// TaskType - the type of the handle returned by spawn
+var TaskType Value = Intern("<task>")
+
+var CancelledKey = Intern("cancelled:")
+
+var RunningKey = Intern("running:")
+var DoneKey = Intern("done:")
+var FailedKey = Intern("failed:")
+
+// Task - a function running in its own goroutine, with its own VM
+type Task struct {
+	id        int
+	name      string
+	mutex     sync.Mutex
+	status    Value
+	result    Value
+	err       error
+	done      chan struct{}
+	cancelled int32 // 1 when cancellation is requested, 2 once the task's VM has acted on it
+	actor     *Actor
+	budget    *budget       // the allocation budget of the evaluation that spawned it
+	caps      *Capabilities // the capabilities of the evaluation that spawned it
+}
+
+var taskCounter int32
+var tasksMutex sync.Mutex
+var runningTasks = make(map[int]*Task)
+
+func newTask(name string) *Task {
+	task := &Task{
+		id:     int(atomic.AddInt32(&taskCounter, 1)),
+		name:   name,
+		status: RunningKey,
+		done:   make(chan struct{}),
+	}
+	tasksMutex.Lock()
+	runningTasks[task.id] = task
+	tasksMutex.Unlock()
+	return task
+}
+
+func taskName(fun *Function) string {
+	switch {
+	case fun.code != nil:
+		return fun.code.name
+	case fun.primitive != nil:
+		return fun.primitive.name
+	case fun.intrinsic != nil:
+		return fun.intrinsic.name
+	}
+	return fun.name
+}
+
+func (task *Task) Type() Value {
+	return TaskType
+}
+
+func (task *Task) String() string {
+	s := fmt.Sprintf("#[task %d", task.id)
+	if task.name != "" {
+		s += " " + task.name
+	}
+	return s + " " + task.Status().String() + "]"
+}
+
+func (task1 *Task) Equals(another Value) bool {
+	if task2, ok := another.(*Task); ok {
+		return task1 == task2
+	}
+	return false
+}
+
+// Status - one of running:, done:, failed:, or cancelled:
+func (task *Task) Status() Value {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	return task.status
+}
+
+// Cancel - request that the task stop. This is cooperative: the task's VM checks for it on each function call,
+// so a task blocked in a primitive (i.e. waiting on a channel) stops only after that primitive returns.
+func (task *Task) Cancel() bool {
+	if task.Status() != RunningKey {
+		return false
+	}
+	atomic.CompareAndSwapInt32(&task.cancelled, 0, 1)
+	return true
+}
+
+func (task *Task) isCancelled() bool {
+	return atomic.LoadInt32(&task.cancelled) != 0
+}
+
+// cancelRequested - true the first time it is called after a cancellation request, so that the
+// unwinding that follows is not itself cancelled.
+func (task *Task) cancelRequested() bool {
+	return atomic.LoadInt32(&task.cancelled) == 1 && atomic.CompareAndSwapInt32(&task.cancelled, 1, 2)
+}
+
+// cancelHandled - true once the task's VM has acted on a request to cancel it, so that the error it is failing with
+// cannot be caught
+func (task *Task) cancelHandled() bool {
+	return atomic.LoadInt32(&task.cancelled) == 2
+}
+
+// Wait - wait for the task to finish, returning false if the timeout (in seconds) expires first.
+// A negative timeout waits forever.
+func (task *Task) Wait(timeout float64) bool {
+	if virtual != nil {
+		return virtual.block(task.isDone, timeout)
+	}
+	if timeout < 0 {
+		<-task.done
+		return true
+	}
+	dur := time.Duration(timeout * float64(time.Second))
+	select {
+	case <-task.done:
+		return true
+	case <-time.After(dur):
+		return false
+	}
+}
+
+func (task *Task) finish(result Value, err error) {
+	task.mutex.Lock()
+	if err != nil {
+		task.status = FailedKey
+		if atomic.LoadInt32(&task.cancelled) == 2 {
+			task.status = CancelledKey
+		}
+		task.err = err
+	} else {
+		task.status = DoneKey
+		task.result = result
+	}
+	task.mutex.Unlock()
+	tasksMutex.Lock()
+	delete(runningTasks, task.id)
+	tasksMutex.Unlock()
+	close(task.done)
+	if task.actor != nil {
+		task.actor.exited(err)
+	}
+}
+
+func (task *Task) isDone() bool {
+	select {
+	case <-task.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// start - run the task in a new goroutine. Under the deterministic scheduler, the new task gets a chance to run
+// before this returns.
+func (task *Task) start(fun *Function, env *Frame, args []Value, params *winder) {
+	if virtual == nil {
+		go task.run(fun, env, args, params)
+		return
+	}
+	virtual.spawn(func() {
+		task.run(fun, env, args, params)
+	})
+}
+
+// run - call the function in the task's own VM, recording the result
+func (task *Task) run(fun *Function, env *Frame, args []Value, params *winder) {
+	var result Value
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewError(ErrorKey, "panic in spawned function '", task.name, "': ", fmt.Sprint(r))
+		}
+		if err != nil && verbose {
+			println("; [*** error in spawned function '", task.name, "': ", err.Error(), "]")
+		} else if verbose {
+			println("; [spawned function '", task.name, "' exited cleanly]")
+		}
+		task.finish(result, err)
+	}()
+	vm := VM(defaultStackSize)
+	vm.winders = params
+	vm.task = task
+	vm.budget = task.budget
+	if task.caps != nil {
+		vm.caps = task.caps
+	}
+	if env != nil {
+		result, err = vm.exec(fun.code, env)
+	} else {
+		result, err = vm.call(fun, args)
+	}
+}
+
+// Tasks - return the tasks that are still running, in the order they were spawned
+func Tasks() []*Task {
+	tasksMutex.Lock()
+	result := make([]*Task, 0, len(runningTasks))
+	for _, task := range runningTasks {
+		result = append(result, task)
+	}
+	tasksMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+func ellTaskP(argv []Value) (Value, error) {
+	if argv[0].Type() == TaskType {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellTaskStatus(argv []Value) (Value, error) {
+	return argv[0].(*Task).Status(), nil
+}
+
+func ellTaskWait(argv []Value) (Value, error) {
+	if argv[0].(*Task).Wait(Float64Value(argv[1])) {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellTaskResult(argv []Value) (Value, error) {
+	task := argv[0].(*Task)
+	task.Wait(-1)
+	if task.err != nil {
+		return nil, task.err
+	}
+	return task.result, nil
+}
+
+func ellTaskError(argv []Value) (Value, error) {
+	task := argv[0].(*Task)
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	if task.err != nil {
+		if e, ok := task.err.(*Error); ok {
+			return e, nil
+		}
+		return MakeError(ErrorKey, NewString(task.err.Error())), nil
+	}
+	return Null, nil
+}
+
+func ellTaskCancel(argv []Value) (Value, error) {
+	if argv[0].(*Task).Cancel() {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellTaskCancelledP(argv []Value) (Value, error) {
+	if argv[0].(*Task).isCancelled() {
+		return True, nil
+	}
+	return False, nil
+}
+
+func ellCurrentTask(vm *vm, argv []Value) (Value, error) {
+	if len(argv) != 0 {
+		return nil, argcError("current-task", 0, 0, len(argv))
+	}
+	if vm.task == nil {
+		return Null, nil
+	}
+	return vm.task, nil
+}
+
+func ellTasks(_ []Value) (Value, error) {
+	var result []Value
+	for _, task := range Tasks() {
+		result = append(result, task)
+	}
+	return ListFromValues(result), nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/boynton/ell/data"
+)
+
+// Type expressions. Wherever a type is declared (the arguments and results of primitives and functions, and the
+// fields of defstruct), the type may combine simpler types:
+//
+//   <list|vector>     a <list> or a <vector>
+//   <string?>         a <string> or null
+//   <list<number>>    a <list> of <number>, i.e. a list whose elements are all numbers. Likewise for <vector>.
+//
+// These nest, as in <vector<string|symbol>?>. A type expression is still just a type name: it is parsed the first
+// time a value is checked against it, and the parse is kept.
+
+// typeExpr - a parsed type expression. A value is of the type if it is of one of the terms.
+type typeExpr []*typeTerm
+
+type typeTerm struct {
+	base    Value    // a simple type
+	element typeExpr // if set, the type of each element of a list or vector
+}
+
+var typeExprs = struct {
+	sync.RWMutex
+	parsed map[Value]typeExpr
+}{parsed: make(map[Value]typeExpr)}
+
+// isTypeExpression - true if the value is a type, simple or not
+func isTypeExpression(t Value) bool {
+	if !IsType(t) {
+		return false
+	}
+	_, err := typeExpression(t)
+	return err == nil
+}
+
+// typeExpression - the parse of the type, or nil if it is a simple type
+func typeExpression(t Value) (typeExpr, error) {
+	typeExprs.RLock()
+	expr, ok := typeExprs.parsed[t]
+	typeExprs.RUnlock()
+	if ok {
+		return expr, nil
+	}
+	text := t.String()
+	body := text[1 : len(text)-1]
+	if !strings.ContainsAny(body, "|<>?") {
+		expr = nil
+	} else {
+		var rest string
+		var err error
+		expr, rest, err = parseTypeUnion(body)
+		if err == nil && rest != "" {
+			err = fmt.Errorf("unexpected %q", rest)
+		}
+		if err != nil {
+			return nil, NewError(ArgumentErrorKey, "Bad type expression ", text, ": ", err.Error())
+		}
+	}
+	typeExprs.Lock()
+	typeExprs.parsed[t] = expr
+	typeExprs.Unlock()
+	return expr, nil
+}
+
+func parseTypeUnion(s string) (typeExpr, string, error) {
+	var expr typeExpr
+	for {
+		terms, rest, err := parseTypeTerm(s)
+		if err != nil {
+			return nil, "", err
+		}
+		expr = append(expr, terms...)
+		if !strings.HasPrefix(rest, "|") {
+			return expr, rest, nil
+		}
+		s = rest[1:]
+	}
+}
+
+// parseTypeTerm - a type name, optionally followed by the type of its elements in angle brackets, and a ? if null
+// is allowed too
+func parseTypeTerm(s string) ([]*typeTerm, string, error) {
+	i := strings.IndexAny(s, "|<>?")
+	if i < 0 {
+		i = len(s)
+	}
+	if i == 0 {
+		if s == "" {
+			return nil, "", fmt.Errorf("expected a type name at the end")
+		}
+		return nil, "", fmt.Errorf("expected a type name at %q", s)
+	}
+	term := &typeTerm{base: Intern("<" + s[:i] + ">")}
+	s = s[i:]
+	if strings.HasPrefix(s, "<") {
+		if term.base != ListType && term.base != VectorType {
+			return nil, "", fmt.Errorf("only <list> and <vector> have element types, not %v", term.base)
+		}
+		element, rest, err := parseTypeUnion(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ">") {
+			return nil, "", fmt.Errorf("expected > after the element type of %v", term.base)
+		}
+		term.element = element
+		s = rest[1:]
+	}
+	terms := []*typeTerm{term}
+	if strings.HasPrefix(s, "?") {
+		terms = append(terms, &typeTerm{base: NullType})
+		s = s[1:]
+	}
+	return terms, s, nil
+}
+
+func (expr typeExpr) matches(val Value) bool {
+	for _, term := range expr {
+		if term.matches(val) {
+			return true
+		}
+	}
+	return false
+}
+
+func (term *typeTerm) matches(val Value) bool {
+	if term.base != AnyType && val.Type() != term.base {
+		return false
+	}
+	return term.element == nil || badElement(val, term.element) < 0
+}
+
+// badElement - the index of the first element of the list or vector that is not of the type, or -1 if they all are
+func badElement(val Value, element typeExpr) int {
+	switch p := val.(type) {
+	case *List:
+		for i := 0; p != EmptyList; i, p = i+1, p.Cdr {
+			if !element.matches(p.Car) {
+				return i
+			}
+		}
+	case *Vector:
+		for i, e := range p.Elements {
+			if !element.matches(e) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// conforms - true if the value is of the type
+func conforms(val Value, t Value) bool {
+	if t == AnyType || val.Type() == t {
+		return true
+	}
+	expr, err := typeExpression(t)
+	return err == nil && expr != nil && expr.matches(val)
+}
+
+// typeMismatch - a description of the value's type, for an error saying it is not of the type. If the value is a
+// list or vector of the right type with an element of the wrong type, the element is described too.
+func typeMismatch(val Value, t Value) string {
+	name := TypeNameOf(val)
+	expr, err := typeExpression(t)
+	if err != nil || expr == nil {
+		return name
+	}
+	for _, term := range expr {
+		if term.element != nil && val.Type() == term.base {
+			if i := badElement(val, term.element); i >= 0 {
+				var e Value
+				if lst, ok := val.(*List); ok {
+					for j := 0; j < i; j++ {
+						lst = lst.Cdr
+					}
+					e = lst.Car
+				} else {
+					e = val.(*Vector).Elements[i]
+				}
+				return fmt.Sprintf("%s whose element %d is a %s", name, i, TypeNameOf(e))
+			}
+		}
+	}
+	return name
+}
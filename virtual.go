@@ -0,0 +1,423 @@
+/*
+Copyright 2015 Lee Boynton
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ell
+
+import (
+	"math/rand"
+	"sort"
+
+	. "github.com/boynton/ell/data"
+)
+
+// The deterministic scheduler. In this mode every task still has its own goroutine, but only one of them runs at a
+// time: a task runs until it blocks (on a channel, sleep, a timer, waiting for another task, ...), and then the
+// scheduler picks the next task to run from those that can, using a seeded random number generator. When none can,
+// virtual time advances to the next timeout. Computation takes no virtual time, and a given seed always produces
+// the same interleaving.
+
+// virtual is non-nil when the deterministic scheduler is in effect
+var virtual *virtualScheduler
+
+const (
+	threadRunnable = iota
+	threadBlocked
+	threadExited
+)
+
+type virtualThread struct {
+	wake     chan struct{}
+	state    int
+	cond     func() bool // for a blocked thread, true once it can continue
+	deadline float64     // for a blocked thread, the virtual time it gives up waiting, or -1
+	timedOut bool
+}
+
+type virtualTimer struct {
+	at       float64
+	interval float64 // for tickers
+	fire     func()
+	stopped  bool
+}
+
+// the number of function calls a task may make before it is preempted, so that tasks that never block don't
+// keep the others from running
+const virtualQuantum = 1000
+
+type virtualScheduler struct {
+	rng     *rand.Rand
+	now     float64
+	calls   int
+	threads []*virtualThread
+	timers  []*virtualTimer
+	current *virtualThread
+}
+
+// SetDeterministic - run all tasks on a single scheduler with virtual time, with the interleaving determined by
+// the seed, which also seeds random. This must be called before any tasks are spawned, and cannot be undone.
+func SetDeterministic(seed int64) {
+	if virtual != nil {
+		return
+	}
+	RandomSeed(seed)
+	main := &virtualThread{wake: make(chan struct{}, 1), state: threadRunnable}
+	virtual = &virtualScheduler{
+		rng:     rand.New(rand.NewSource(seed)),
+		threads: []*virtualThread{main},
+		current: main,
+	}
+}
+
+// notDeterministic - an error for operations that involve goroutines the scheduler cannot control
+func notDeterministic(name string) error {
+	if virtual != nil {
+		return NewError(ErrorKey, name, ": not available in deterministic mode")
+	}
+	return nil
+}
+
+// IsDeterministic - true if the deterministic scheduler is in effect
+func IsDeterministic() bool {
+	return virtual != nil
+}
+
+// newThread - register a thread for a new goroutine, which must call start before doing anything else, and exit
+// when it is done.
+func (vs *virtualScheduler) newThread() *virtualThread {
+	t := &virtualThread{wake: make(chan struct{}, 1), state: threadRunnable}
+	vs.threads = append(vs.threads, t)
+	return t
+}
+
+// start - wait for the scheduler to run this thread
+func (vs *virtualScheduler) start(t *virtualThread) {
+	<-t.wake
+}
+
+// spawn - run the function in a new goroutine, as a new thread, giving it a chance to run before returning
+func (vs *virtualScheduler) spawn(fn func()) {
+	t := vs.newThread()
+	go func() {
+		vs.start(t)
+		fn()
+		vs.exit(t)
+	}()
+	vs.yield()
+}
+
+// exit - the thread is done. Another one is run in its place.
+func (vs *virtualScheduler) exit(t *virtualThread) {
+	t.state = threadExited
+	for i, other := range vs.threads {
+		if other == t {
+			vs.threads = append(vs.threads[:i], vs.threads[i+1:]...)
+			break
+		}
+	}
+	vs.schedule(t)
+}
+
+// yield - give other runnable threads a chance to run
+func (vs *virtualScheduler) yield() {
+	t := vs.current
+	vs.schedule(t)
+	vs.await(t)
+}
+
+// tick - count a function call, preempting the current thread every virtualQuantum calls
+func (vs *virtualScheduler) tick() {
+	vs.calls++
+	if vs.calls%virtualQuantum == 0 {
+		vs.yield()
+	}
+}
+
+// block - wait until the condition is true, or the timeout (in virtual seconds) expires. A negative timeout waits
+// forever. Returns false if the timeout expired. The condition must not have side effects.
+func (vs *virtualScheduler) block(cond func() bool, timeout float64) bool {
+	if cond() {
+		return true
+	}
+	if timeout == 0 {
+		return false
+	}
+	t := vs.current
+	t.state = threadBlocked
+	t.cond = cond
+	t.deadline = -1
+	if timeout > 0 {
+		t.deadline = vs.now + timeout
+	}
+	vs.schedule(t)
+	vs.await(t)
+	timedOut := t.timedOut
+	t.cond = nil
+	t.timedOut = false
+	return !timedOut
+}
+
+func (vs *virtualScheduler) sleep(seconds float64) {
+	if seconds <= 0 {
+		vs.yield()
+		return
+	}
+	vs.block(func() bool { return false }, seconds)
+}
+
+// await - wait to be run again, after a call to schedule handed control to another thread
+func (vs *virtualScheduler) await(t *virtualThread) {
+	if vs.current != t {
+		<-t.wake
+	}
+}
+
+func (vs *virtualScheduler) runnable() []*virtualThread {
+	var result []*virtualThread
+	for _, t := range vs.threads {
+		if t.state == threadRunnable || (t.state == threadBlocked && t.cond()) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// schedule - pick the next thread to run, advancing virtual time if necessary, and hand control to it.
+// The caller (the current thread) has already recorded its own state.
+func (vs *virtualScheduler) schedule(from *virtualThread) {
+	for {
+		candidates := vs.runnable()
+		if len(candidates) > 0 {
+			next := candidates[vs.rng.Intn(len(candidates))]
+			next.state = threadRunnable
+			vs.current = next
+			if next != from {
+				next.wake <- struct{}{}
+			}
+			return
+		}
+		if !vs.advance() {
+			Fatal("*** deadlock: all tasks are blocked")
+		}
+	}
+}
+
+// advance - move virtual time forward to the next timer or timeout, firing timers and timing out waits that are
+// due. Returns false if there is nothing to wait for.
+func (vs *virtualScheduler) advance() bool {
+	next := -1.0
+	for _, t := range vs.threads {
+		if t.state == threadBlocked && t.deadline >= 0 && (next < 0 || t.deadline < next) {
+			next = t.deadline
+		}
+	}
+	for _, timer := range vs.timers {
+		if next < 0 || timer.at < next {
+			next = timer.at
+		}
+	}
+	if next < 0 {
+		return false
+	}
+	if next > vs.now {
+		vs.now = next
+	}
+	var due []*virtualTimer
+	var pending []*virtualTimer
+	for _, timer := range vs.timers {
+		if timer.at <= vs.now {
+			due = append(due, timer)
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	vs.timers = pending
+	for _, timer := range due {
+		if timer.interval > 0 {
+			timer.at += timer.interval
+			vs.addTimer(timer)
+		}
+		timer.fire()
+	}
+	for _, t := range vs.threads {
+		if t.state == threadBlocked && t.deadline >= 0 && t.deadline <= vs.now {
+			t.state = threadRunnable
+			t.timedOut = !t.cond()
+		}
+	}
+	return true
+}
+
+func (vs *virtualScheduler) addTimer(timer *virtualTimer) {
+	vs.timers = append(vs.timers, timer)
+	sort.SliceStable(vs.timers, func(i, j int) bool { return vs.timers[i].at < vs.timers[j].at })
+}
+
+// newTimer - call fire after delay virtual seconds, and then every interval seconds if the interval is positive
+func (vs *virtualScheduler) newTimer(delay float64, interval float64, fire func()) *virtualTimer {
+	timer := &virtualTimer{at: vs.now + delay, interval: interval, fire: fire}
+	vs.addTimer(timer)
+	return timer
+}
+
+// stopTimer - returns false if the timer had already fired (or was stopped)
+func (vs *virtualScheduler) stopTimer(timer *virtualTimer) bool {
+	for i, t := range vs.timers {
+		if t == timer {
+			vs.timers = append(vs.timers[:i], vs.timers[i+1:]...)
+			timer.stopped = true
+			return true
+		}
+	}
+	return false
+}
+
+// channel operations, on the channel's own buffer and queue of waiting senders
+
+type pendingSend struct {
+	value Value
+	taken bool
+}
+
+func (ch *Channel) virtualRecvReady() bool {
+	return len(ch.buffer) > 0 || len(ch.senders) > 0 || ch.IsClosed()
+}
+
+func (ch *Channel) virtualSendReady() bool {
+	return !ch.IsClosed() && (len(ch.buffer) < ch.bufsize || ch.receivers > 0)
+}
+
+// virtualTake - take the next value, which must be available
+func (ch *Channel) virtualTake() (Value, bool) {
+	if len(ch.buffer) > 0 {
+		val := ch.buffer[0]
+		ch.buffer = ch.buffer[1:]
+		if len(ch.senders) > 0 {
+			p := ch.senders[0]
+			ch.senders = ch.senders[1:]
+			ch.buffer = append(ch.buffer, p.value)
+			p.taken = true
+		}
+		return val, true
+	}
+	if len(ch.senders) > 0 {
+		p := ch.senders[0]
+		ch.senders = ch.senders[1:]
+		p.taken = true
+		return p.value, true
+	}
+	return Null, false
+}
+
+// virtualPut - put a value, without waiting for it to be received
+func (ch *Channel) virtualPut(val Value) {
+	if len(ch.buffer) < ch.bufsize {
+		ch.buffer = append(ch.buffer, val)
+	} else {
+		ch.senders = append(ch.senders, &pendingSend{value: val})
+	}
+}
+
+func (vs *virtualScheduler) send(ch *Channel, val Value, timeout float64) bool {
+	if ch.IsClosed() {
+		return false
+	}
+	if len(ch.buffer) < ch.bufsize {
+		ch.buffer = append(ch.buffer, val)
+		return true
+	}
+	p := &pendingSend{value: val}
+	ch.senders = append(ch.senders, p)
+	vs.block(func() bool { return p.taken || ch.IsClosed() }, timeout)
+	if !p.taken {
+		for i, other := range ch.senders {
+			if other == p {
+				ch.senders = append(ch.senders[:i], ch.senders[i+1:]...)
+				break
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (vs *virtualScheduler) receive(ch *Channel, timeout float64) (Value, bool) {
+	ch.receivers++
+	ok := vs.block(ch.virtualRecvReady, timeout)
+	ch.receivers--
+	if !ok {
+		return Null, false
+	}
+	return ch.virtualTake()
+}
+
+type selectCase struct {
+	channel *Channel
+	send    bool
+	value   Value
+}
+
+// selectChannels - like reflect.Select, but for the deterministic scheduler. Returns -1 if the timeout expires.
+func (vs *virtualScheduler) selectChannels(cases []selectCase, timeout float64) (int, Value, bool) {
+	ready := func(c selectCase) bool {
+		if c.send {
+			return c.channel.virtualSendReady()
+		}
+		return c.channel.virtualRecvReady()
+	}
+	anyReady := func() bool {
+		for _, c := range cases {
+			if ready(c) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, c := range cases {
+		if !c.send {
+			c.channel.receivers++
+		}
+	}
+	ok := vs.block(anyReady, timeout)
+	for _, c := range cases {
+		if !c.send {
+			c.channel.receivers--
+		}
+	}
+	if !ok {
+		return -1, Null, false
+	}
+	var choices []int
+	for i, c := range cases {
+		if ready(c) {
+			choices = append(choices, i)
+		}
+	}
+	chosen := choices[vs.rng.Intn(len(choices))]
+	c := cases[chosen]
+	if c.send {
+		c.channel.virtualPut(c.value)
+		return chosen, Null, true
+	}
+	val, received := c.channel.virtualTake()
+	return chosen, val, received
+}
+
+func ellDeterministicP(argv []Value) (Value, error) {
+	if virtual != nil {
+		return True, nil
+	}
+	return False, nil
+}